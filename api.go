@@ -1,39 +1,73 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type APIServer struct {
-	listenAddr string
-	store      Storage
+	listenAddr     string
+	store          Storage
+	idempotencyTTL time.Duration
+	loginPolicy    *LoginPolicy
+	stepUpPolicy   *StepUpPolicy
+	mailer         Mailer
+	// background tracks work that outlives the request, such as mail.
+	background sync.WaitGroup
 }
 
-func NewAPIServer(listenAddr string, store Storage) *APIServer {
+func NewAPIServer(listenAddr string, store Storage, mailer Mailer) *APIServer {
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		listenAddr:     listenAddr,
+		store:          store,
+		mailer:         mailer,
+		idempotencyTTL: getEnvDuration("IDEMPOTENCY_KEY_TTL", defaultIdempotencyTTL),
+		loginPolicy:    loginPolicyFromEnv(),
+		stepUpPolicy:   stepUpPolicyFromEnv(),
 	}
 }
 
 func (s *APIServer) Run() {
 	router := http.NewServeMux()
 
+	router.HandleFunc("GET /.well-known/jwks.json", makeHTTPHandleFunc(s.handleJWKS, false))
 	router.HandleFunc("POST /login", makeHTTPHandleFunc(s.handleLogin, false))
-	router.HandleFunc("GET /account", authWithJWT(makeHTTPHandleFunc(s.handleGetAllAccounts, true), s.store))
-	router.HandleFunc("POST /account", authWithJWT(makeHTTPHandleFunc(s.handleCreateAccount, true), s.store))
-	router.HandleFunc("GET /account/{id}", authWithJWT(makeHTTPHandleFunc(s.handleGetAccountByID, true), s.store))
-	router.HandleFunc("DELETE /account/{id}", authWithJWT(makeHTTPHandleFunc(s.handleDeleteAccount, true), s.store))
-	router.HandleFunc("POST /transfer", authWithJWT(makeHTTPHandleFunc(s.handleTransfer, true), s.store))
+	router.HandleFunc("POST /signup", makeHTTPHandleFunc(s.handleSignup, false))
+	router.HandleFunc("POST /login/2fa", makeHTTPHandleFunc(s.handleLoginTOTP, false))
+	router.HandleFunc("POST /2fa/enroll", authWithJWT(requirePermission(PermAccountsWrite, makeHTTPHandleFunc(s.handleEnrollTOTP, true)), s.store))
+	router.HandleFunc("POST /2fa/confirm", authWithJWT(requirePermission(PermAccountsWrite, makeHTTPHandleFunc(s.handleConfirmTOTP, true)), s.store))
+	router.HandleFunc("DELETE /2fa", authWithJWT(requirePermission(PermAccountsWrite, makeHTTPHandleFunc(s.handleDisableTOTP, true)), s.store))
+	router.HandleFunc("POST /password/forgot", makeHTTPHandleFunc(s.handleForgotPassword, false))
+	router.HandleFunc("POST /password/reset", makeHTTPHandleFunc(s.handleResetPassword, false))
+	router.HandleFunc("GET /verify-email", makeHTTPHandleFunc(s.handleVerifyEmail, false))
+	router.HandleFunc("POST /verify-email/resend", authWithJWT(requirePermission(PermAccountsWrite, makeHTTPHandleFunc(s.handleResendVerification, true)), s.store))
+	router.HandleFunc("POST /token/refresh", makeHTTPHandleFunc(s.handleRefreshToken, false))
+	router.HandleFunc("POST /logout", authWithJWT(makeHTTPHandleFunc(s.handleLogout, true), s.store))
+	router.HandleFunc("POST /auth/step-up", authWithJWT(makeHTTPHandleFunc(s.handleStepUp, true), s.store))
+	router.HandleFunc("POST /apikeys", authWithJWT(requirePermission(PermAccountsWrite, makeHTTPHandleFunc(s.handleCreateAPIKey, true)), s.store))
+	router.HandleFunc("GET /apikeys", authWithJWT(requirePermission(PermAccountsRead, makeHTTPHandleFunc(s.handleGetAPIKeys, true)), s.store))
+	router.HandleFunc("DELETE /apikeys/{id}", authWithJWT(requirePermission(PermAccountsWrite, makeHTTPHandleFunc(s.handleRevokeAPIKey, true)), s.store))
+	router.HandleFunc("GET /sessions", authWithJWT(requirePermission(PermAccountsRead, makeHTTPHandleFunc(s.handleGetSessions, true)), s.store))
+	router.HandleFunc("DELETE /sessions/{id}", authWithJWT(requirePermission(PermAccountsWrite, makeHTTPHandleFunc(s.handleRevokeSession, true)), s.store))
+	router.HandleFunc("GET /account", authWithJWT(requirePermission(PermAccountsRead, makeHTTPHandleFunc(s.handleGetAllAccounts, true)), s.store))
+	router.HandleFunc("POST /account", authWithJWT(requirePermission(PermAdmin, makeHTTPHandleFunc(s.handleCreateAccount, true)), s.store))
+	router.HandleFunc("GET /account/{id}", authWithJWT(requirePermission(PermAccountsRead, requireAccountOwner(makeHTTPHandleFunc(s.handleGetAccountByID, true))), s.store))
+	router.HandleFunc("GET /account/{id}/transactions", authWithJWT(requirePermission(PermAccountsRead, requireAccountOwner(makeHTTPHandleFunc(s.handleGetAccountTransactions, true))), s.store))
+	router.HandleFunc("POST /account/{id}/email", authWithJWT(requirePermission(PermAccountsWrite, requireAccountOwner(requireStepUp(nil, makeHTTPHandleFunc(s.handleChangeEmail, true)))), s.store))
+	router.HandleFunc("POST /account/{id}/unlock", authWithJWT(requirePermission(PermAdmin, makeHTTPHandleFunc(s.handleUnlockAccount, true)), s.store))
+	router.HandleFunc("GET /account/{id}/login-events", authWithJWT(requirePermission(PermAdmin, makeHTTPHandleFunc(s.handleGetLoginEvents, true)), s.store))
+	router.HandleFunc("DELETE /account/{id}", authWithJWT(requirePermission(PermAccountsWrite, requireAccountOwner(requireStepUp(nil, makeHTTPHandleFunc(s.handleDeleteAccount, true)))), s.store))
+	router.HandleFunc("POST /transfer", authWithJWT(requirePermission(PermTransfersWrite, requireVerifiedEmail(requireTransferOwner(requireStepUp(s.isHighValueTransfer, withIdempotency(makeHTTPHandleFunc(s.handleTransfer, true), s.store, s.idempotencyTTL))))), s.store))
 
 	log.Println("API server running on port:", s.listenAddr)
 	if err := http.ListenAndServe(s.listenAddr, router); err != nil {
@@ -43,40 +77,129 @@ func (s *APIServer) Run() {
 
 func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 	var loginReq LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&loginReq); err != nil {
+	if err := decodeJSON(r, &loginReq); err != nil {
 		return err
 	}
 
+	loginReq.Email = normalizeEmail(loginReq.Email)
 	acc, err := s.store.GetAccountByEmail(loginReq.Email)
+	if errors.Is(err, ErrNotFound) {
+		acc = nil
+	} else if err != nil {
+		return err
+	}
+
+	throttle, retryAfter, err := s.reserveLoginAttempt(r, loginReq.Email)
 	if err != nil {
-		return WriteJSON(w, http.StatusUnauthorized, APIError{Error: "Invalid credentials"})
+		return err
+	}
+	if retryAfter > 0 {
+		s.recordLoginEvent(r, acc, loginReq.Email, LoginEventThrottled)
+		return tooManyAttempts(w, retryAfter)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(acc.EncryptedPassword), []byte(loginReq.EncryptedPassword)); err != nil {
-		return WriteJSON(w, http.StatusUnauthorized, APIError{Error: "Invalid credentials"})
+	// Unknown emails are checked against a dummy hash, so that they take as
+	// long to reject as a wrong password.
+	hasher := currentPasswordHasher()
+	hash := dummyPasswordHash()
+	if acc != nil {
+		hash = acc.EncryptedPassword
+	}
+	ok, err := hasher.Verify(loginReq.EncryptedPassword, hash)
+	if err != nil {
+		log.Printf("Error verifying password for %s: %v", loginReq.Email, err)
+	}
+	if !ok || acc == nil {
+		if err := s.recordLoginFailure(r, acc, loginReq.Email, LoginEventFailed, throttle); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidCredentials, Error: "Invalid credentials"})
 	}
+	s.rehashPassword(r.Context(), hasher, acc, loginReq.EncryptedPassword)
 
-	tokenString, err := createJWT(acc)
+	scopes, err := parseScope(acc.Role, loginReq.Scope)
 	if err != nil {
 		return err
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    tokenString,
-		HttpOnly: true,
-		Secure:   false, // true if using HTTPS
-		SameSite: http.SameSiteStrictMode,
-		MaxAge:   86400, // 24 hours
-	})
+	totp, err := s.store.GetTOTP(r.Context(), acc.ID)
+	if err != nil {
+		return err
+	}
+	if totp != nil && totp.Enabled() {
+		// The attempt stays counted until the second factor succeeds.
+		challenge, err := createMFAChallenge(acc, scopes)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, &LoginChallenge{MFARequired: true, Challenge: challenge})
+	}
+
+	if err := s.recordLoginSuccess(r, acc); err != nil {
+		return err
+	}
+
+	resp, err := s.issueTokens(w, r, acc, scopes)
+	if err != nil {
+		return err
+	}
+	resp.Message = "Login successful"
+
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleSignup is the public registration endpoint. It creates a customer
+// account and logs the new customer in.
+func (s *APIServer) handleSignup(w http.ResponseWriter, r *http.Request) error {
+	newAccount := &NewAccount{}
+	if err := decodeJSON(r, newAccount); err != nil {
+		return err
+	}
+	if err := newAccount.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := s.store.GetAccountByEmail(newAccount.Email); err == nil {
+		return conflictError("Email is already registered")
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	account, err := GenerateNewAccount(newAccount.FirstName, newAccount.LastName, newAccount.Email, newAccount.Password)
+	if err != nil {
+		return err
+	}
+	if err := s.store.CreateAccount(account); err != nil {
+		return err
+	}
+	s.sendVerificationEmail(r, account)
+
+	if _, err := s.issueTokens(w, r, account, nil); err != nil {
+		return err
+	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		Message string `json:"message"`
-	}{Message: "Login successful"})
+	return WriteJSON(w, http.StatusCreated, account)
 }
 
+// handleGetAllAccounts lists every account for admins, optionally filtered by
+// the q search parameter. Customers only get their own account.
 func (s *APIServer) handleGetAllAccounts(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.store.GetAccounts()
+	authCtx, _ := GetAuthContext(r.Context())
+	if !authCtx.Can(PermAdmin) {
+		acc, err := s.store.GetAccountByID(authCtx.AccountID)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, []*Account{acc})
+	}
+
+	var accounts []*Account
+	var err error
+	if q := r.URL.Query().Get("q"); q != "" {
+		accounts, err = s.store.SearchAccounts(q)
+	} else {
+		accounts, err = s.store.GetAccounts()
+	}
 	if err != nil {
 		return err
 	}
@@ -98,18 +221,58 @@ func (s *APIServer) handleGetAccountByID(w http.ResponseWriter, r *http.Request)
 	return WriteJSON(w, http.StatusOK, acc)
 }
 
+func (s *APIServer) handleGetAccountTransactions(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	q, err := parseTransactionQuery(r)
+	if err != nil {
+		return err
+	}
+	q.AccountID = id
+
+	// Fetch one extra row to find out whether another page follows.
+	limit := q.Limit
+	q.Limit++
+
+	transactions, err := s.store.GetAccountTransactions(r.Context(), q)
+	if err != nil {
+		return err
+	}
+
+	page := &TransactionPage{Transactions: transactions}
+	if len(transactions) > limit {
+		page.Transactions = transactions[:limit]
+		page.NextCursor = strconv.Itoa(page.Transactions[limit-1].ID)
+	}
+
+	return WriteJSON(w, http.StatusOK, page)
+}
+
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
 	newAccount := &NewAccount{}
-	if err := json.NewDecoder(r.Body).Decode(newAccount); err != nil {
+	if err := decodeJSON(r, newAccount); err != nil {
+		return err
+	}
+	if err := newAccount.Validate(); err != nil {
 		return err
 	}
-	account, err := GenerateNewAccount(newAccount.FirstName, newAccount.LastName, newAccount.Email, newAccount.EncryptedPassword)
+	account, err := GenerateNewAccount(newAccount.FirstName, newAccount.LastName, newAccount.Email, newAccount.Password)
 	if err != nil {
 		return err
 	}
+	if newAccount.Role != "" {
+		if !newAccount.Role.Valid() {
+			return validationError("invalid role: %s", newAccount.Role)
+		}
+		account.Role = newAccount.Role
+	}
 	if err := s.store.CreateAccount(account); err != nil {
 		return err
 	}
+	s.sendVerificationEmail(r, account)
 
 	return WriteJSON(w, http.StatusOK, account)
 }
@@ -125,115 +288,268 @@ func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request)
 	return WriteJSON(w, http.StatusOK, map[string]int{"deleted": id})
 }
 
-func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
-	transferReq := &TransferRequest{}
-	if err := json.NewDecoder(r.Body).Decode(transferReq); err != nil {
+// handleChangeEmail moves the account to a new email address, which has to
+// be verified again. The email is part of every token, so the change signs
+// the account out everywhere.
+func (s *APIServer) handleChangeEmail(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
 		return err
 	}
-	defer r.Body.Close()
 
-	fromAccount, err := s.store.GetAccountByID(transferReq.FromAccount)
-	if err != nil {
+	var changeReq ChangeEmailRequest
+	if err := decodeJSON(r, &changeReq); err != nil {
+		return err
+	}
+	email := normalizeEmail(changeReq.Email)
+	if err := validateEmail(email); err != nil {
 		return err
 	}
 
-	if fromAccount.Balance < transferReq.Amount {
-		return fmt.Errorf("insufficient funds")
+	if _, err := s.store.GetAccountByEmail(email); err == nil {
+		return conflictError("Email is already registered")
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
 	}
 
-	toAccount, err := s.store.GetAccountByID(transferReq.ToAccount)
+	if err := s.store.UpdateEmail(r.Context(), id, email); err != nil {
+		return err
+	}
+	account, err := s.store.GetAccountByID(id)
 	if err != nil {
 		return err
 	}
+	if err := s.store.RevokeAllTokens(r.Context(), id); err != nil {
+		return err
+	}
+	s.sendVerificationEmail(r, account)
+
+	if ownsAccount(r, id) {
+		clearTokenCookies(w)
+	}
 
-	fromAccount.Balance -= transferReq.Amount
-	toAccount.Balance += transferReq.Amount
+	return WriteJSON(w, http.StatusOK, account)
+}
 
-	if err := s.store.UpdateAccount(fromAccount); err != nil {
+func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
+	transferReq := &TransferRequest{}
+	if err := decodeJSON(r, transferReq); err != nil {
 		return err
 	}
+	defer r.Body.Close()
 
-	if err := s.store.UpdateAccount(toAccount); err != nil {
-		fromAccount.Balance += transferReq.Amount
-		s.store.UpdateAccount(fromAccount)
+	if err := s.store.Transfer(r.Context(), transferReq.FromAccount, transferReq.ToAccount, transferReq.Amount); err != nil {
 		return err
 	}
 
 	return WriteJSON(w, http.StatusOK, transferReq)
 }
 
+// maxTransferBodySize caps how much of a transfer request middlewares read
+// into memory.
+const maxTransferBodySize = 64 << 10
+
+// peekTransferRequest decodes the transfer in the request body for a
+// middleware. The body is restored for the handler.
+func peekTransferRequest(r *http.Request) (*TransferRequest, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxTransferBodySize))
+	if err != nil {
+		return nil, invalidRequestError("invalid request body: %v", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	transferReq := &TransferRequest{}
+	if err := json.Unmarshal(body, transferReq); err != nil {
+		return nil, invalidRequestError("invalid request body: %v", err)
+	}
+	return transferReq, nil
+}
+
 func unauthorized(w http.ResponseWriter) {
-	WriteJSON(w, http.StatusUnauthorized, APIError{Error: "Unauthorized"})
+	w.Header().Set(authChallengeHeader, authChallenge("", "", ""))
+	WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeUnauthorized, Error: "Unauthorized"})
 }
 
-func createJWT(account *Account) (string, error) {
+func setTokenCookie(w http.ResponseWriter, tokenString string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    tokenString,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // true if using HTTPS
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(accessTokenTTL().Seconds()),
+	})
+}
+
+// createJWT issues an access token limited to scopes, which should be
+// granted by the account's role.
+func createJWT(account *Account, sessionID string, scopes []Permission) (string, error) {
+	tokenID, err := newRandomToken()
+	if err != nil {
+		return "", err
+	}
+
 	claims := jwt.MapClaims{
 		"id":    account.ID,
 		"email": account.Email,
-		"exp":   time.Now().Add(time.Hour * 24).Unix(), // 24 hours
+		"role":  string(account.Role),
+		"sid":   sessionID,
+		"jti":   tokenID,
+		"ver":   account.TokenVersion,
+		"typ":   tokenTypeAccess,
+		"scope": formatScope(scopes),
+		"exp":   time.Now().Add(accessTokenTTL()).Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	return signJWT(claims)
+}
+
+func signJWT(claims jwt.MapClaims) (string, error) {
+	ks, err := currentKeySet()
+	if err != nil {
+		return "", err
+	}
+	return ks.Sign(claims)
 }
 
 func validateJWT(tokenString string) (*jwt.Token, error) {
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
+	ks, err := currentKeySet()
+	if err != nil {
+		return nil, err
+	}
+	return jwt.Parse(tokenString, ks.Keyfunc)
+}
+
+// parseJWT validates tokenString and checks that it was issued for the given
+// purpose, so that a login challenge can never be used as an access token.
+func parseJWT(tokenString, typ string) (jwt.MapClaims, error) {
+	token, err := validateJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("invalid claims")
+	}
+	if claims["typ"] != typ {
+		return nil, fmt.Errorf("unexpected token type: %v", claims["typ"])
+	}
+	return claims, nil
 }
 
 func authWithJWT(f http.HandlerFunc, store Storage) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if cookie, err := r.Cookie("token"); err == nil {
-			tokenString = cookie.Value
+		if key, ok := apiKeyFromHeader(r); ok {
+			authCtx, err := authenticateAPIKey(r.Context(), store, key)
+			if err != nil {
+				invalidToken(w) // Unknown or revoked API key
+				return
+			}
+			f.ServeHTTP(w, r.WithContext(WithAuthContext(r.Context(), authCtx)))
+			return
+		}
+
+		tokenString, source, err := accessTokenFromRequest(r, authTokenSources())
+		if err != nil {
+			invalidAuthRequest(w, err)
+			return
 		}
 		if tokenString == "" {
 			unauthorized(w) // Token not found
 			return
 		}
 
-		token, err := validateJWT(tokenString)
-		if err != nil || !token.Valid {
-			unauthorized(w) // Invalid token
+		// Browsers attach cookies to cross-site requests too. An explicit
+		// Authorization header cannot be forged that way.
+		if source == TokenSourceCookie && !validCSRF(r) {
+			csrfFailed(w)
 			return
 		}
 
-		// Rest of the function remains the same
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			unauthorized(w) // Invalid claims
+		claims, err := parseJWT(tokenString, tokenTypeAccess)
+		if err != nil {
+			invalidToken(w) // Invalid token
 			return
 		}
 
 		accountID, ok := claims["id"].(float64)
 		if !ok {
-			unauthorized(w) // Invalid account ID
+			invalidToken(w) // Invalid account ID
 			return
 		}
 
 		email, ok := claims["email"].(string)
 		if !ok {
-			unauthorized(w) // Invalid email
+			invalidToken(w) // Invalid email
+			return
+		}
+
+		role, ok := claims["role"].(string)
+		if !ok {
+			invalidToken(w) // Invalid role
+			return
+		}
+
+		// Tokens issued before scopes existed carry the full role.
+		scope, _ := claims["scope"].(string)
+		scopes := splitScope(scope)
+
+		sessionID, _ := claims["sid"].(string)
+		tokenID, _ := claims["jti"].(string)
+		version, _ := claims["ver"].(float64)
+		expiresAt, err := claims.GetExpirationTime()
+		if sessionID == "" || tokenID == "" || err != nil || expiresAt == nil {
+			invalidToken(w) // Token issued before sessions existed
+			return
+		}
+
+		revoked, err := store.IsTokenRevoked(r.Context(), tokenID)
+		if err != nil || revoked {
+			invalidToken(w) // Token was logged out
+			return
+		}
+
+		if err := store.UseSession(r.Context(), sessionID, time.Now().UTC()); err != nil {
+			invalidToken(w) // Session was signed out
 			return
 		}
 
 		account, err := store.GetAccountByID(int(accountID))
 		if err != nil {
-			unauthorized(w) // User not found
+			invalidToken(w) // User not found
 			return
 		}
 
 		if account.Email != email {
-			unauthorized(w) // Email mismatch
+			invalidToken(w) // Email mismatch
+			return
+		}
+
+		if account.Role != Role(role) {
+			invalidToken(w) // Role changed since the token was issued
+			return
+		}
+
+		if account.TokenVersion != int(version) {
+			invalidToken(w) // All sessions were revoked since the token was issued
 			return
 		}
 
-		ctx := NewAuthContext(r.Context(), int(accountID), email)
+		ctx := WithAuthContext(r.Context(), &AuthContext{
+			AccountID:      int(accountID),
+			Email:          email,
+			Role:           account.Role,
+			EmailVerified:  account.EmailVerified,
+			Scopes:         scopes,
+			SessionID:      sessionID,
+			TokenID:        tokenID,
+			TokenExpiresAt: expiresAt.Time,
+		})
 		r = r.WithContext(ctx)
 
 		f.ServeHTTP(w, r)
@@ -246,9 +562,20 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 	return json.NewEncoder(w).Encode(v)
 }
 
+// decodeJSON reads the JSON request body into v.
+func decodeJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return invalidRequestError("invalid request body: %v", err)
+	}
+	return nil
+}
+
 type APIFunc func(http.ResponseWriter, *http.Request) error
 
+// APIError is the body of every error response. Code is a stable,
+// machine-readable identifier; Error is meant for people.
 type APIError struct {
+	Code  string `json:"code"`
 	Error string `json:"error"`
 }
 
@@ -260,11 +587,11 @@ func makeHTTPHandleFunc(f APIFunc, requireAuth bool) http.HandlerFunc {
 				unauthorized(w) // Unauthorized
 				return
 			}
-			log.Printf("Authenticated request: AccountID=%d, Email=%s\n", authCtx.AccountID, authCtx.Email)
+			log.Printf("Authenticated request: AccountID=%d, Email=%s, Role=%s\n", authCtx.AccountID, authCtx.Email, authCtx.Role)
 		}
 
 		if err := f(w, r); err != nil {
-			WriteJSON(w, http.StatusBadRequest, APIError{Error: err.Error()})
+			writeError(w, r, err)
 		}
 	}
 }
@@ -273,7 +600,51 @@ func getID(r *http.Request) (int, error) {
 	strID := r.PathValue("id")
 	id, err := strconv.Atoi(strID)
 	if err != nil {
-		return id, fmt.Errorf("invalid ID: %d", id)
+		return id, invalidRequestError("invalid ID: %s", strID)
 	}
 	return id, nil
 }
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+func parseTransactionQuery(r *http.Request) (*TransactionQuery, error) {
+	params := r.URL.Query()
+	q := &TransactionQuery{Limit: defaultPageSize}
+
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return nil, invalidRequestError("invalid limit: must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = limit
+	}
+
+	if v := params.Get("cursor"); v != "" {
+		before, err := strconv.Atoi(v)
+		if err != nil || before < 1 {
+			return nil, invalidRequestError("invalid cursor: %s", v)
+		}
+		q.Before = before
+	}
+
+	if v := params.Get("from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, invalidRequestError("invalid from date, expected RFC 3339: %s", v)
+		}
+		q.From = from.UTC()
+	}
+
+	if v := params.Get("to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, invalidRequestError("invalid to date, expected RFC 3339: %s", v)
+		}
+		q.To = to.UTC()
+	}
+
+	return q, nil
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type MockStorage struct {
@@ -20,6 +25,11 @@ func (m *MockStorage) CreateAccount(account *Account) error {
 	return args.Error(0)
 }
 
+func (m *MockStorage) VerifyEmail(ctx context.Context, accountID int, email string) error {
+	args := m.Called(ctx, accountID, email)
+	return args.Error(0)
+}
+
 func (m *MockStorage) DeleteAccount(id int) error {
 	args := m.Called(id)
 	return args.Error(0)
@@ -30,11 +40,26 @@ func (m *MockStorage) UpdateAccount(account *Account) error {
 	return args.Error(0)
 }
 
+func (m *MockStorage) UpdatePassword(ctx context.Context, accountID int, encryptedPassword string) error {
+	args := m.Called(ctx, accountID, encryptedPassword)
+	return args.Error(0)
+}
+
+func (m *MockStorage) UpdateEmail(ctx context.Context, accountID int, email string) error {
+	args := m.Called(ctx, accountID, email)
+	return args.Error(0)
+}
+
 func (m *MockStorage) GetAccounts() ([]*Account, error) {
 	args := m.Called()
 	return args.Get(0).([]*Account), args.Error(1)
 }
 
+func (m *MockStorage) SearchAccounts(query string) ([]*Account, error) {
+	args := m.Called(query)
+	return args.Get(0).([]*Account), args.Error(1)
+}
+
 func (m *MockStorage) GetAccountByID(id int) (*Account, error) {
 	args := m.Called(id)
 	return args.Get(0).(*Account), args.Error(1)
@@ -42,7 +67,210 @@ func (m *MockStorage) GetAccountByID(id int) (*Account, error) {
 
 func (m *MockStorage) GetAccountByEmail(email string) (*Account, error) {
 	args := m.Called(email)
-	return args.Get(0).(*Account), args.Error(1)
+	acc, _ := args.Get(0).(*Account)
+	return acc, args.Error(1)
+}
+
+func (m *MockStorage) Transfer(ctx context.Context, from, to int, amount int64) error {
+	args := m.Called(ctx, from, to, amount)
+	return args.Error(0)
+}
+
+func (m *MockStorage) GetAccountTransactions(ctx context.Context, q *TransactionQuery) ([]*AccountTransaction, error) {
+	args := m.Called(ctx, q)
+	return args.Get(0).([]*AccountTransaction), args.Error(1)
+}
+
+func (m *MockStorage) CheckLedger(ctx context.Context) (*LedgerReport, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(*LedgerReport), args.Error(1)
+}
+
+func (m *MockStorage) ReserveIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	args := m.Called(ctx, rec)
+	existing, _ := args.Get(0).(*IdempotencyRecord)
+	return existing, args.Error(1)
+}
+
+func (m *MockStorage) CompleteIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) error {
+	args := m.Called(ctx, rec)
+	return args.Error(0)
+}
+
+func (m *MockStorage) ReleaseIdempotencyKey(ctx context.Context, accountID int, key string) error {
+	args := m.Called(ctx, accountID, key)
+	return args.Error(0)
+}
+
+func (m *MockStorage) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	args := m.Called(ctx, token)
+	return args.Error(0)
+}
+
+func (m *MockStorage) RotateRefreshToken(ctx context.Context, tokenHash string, next *RefreshToken) (*RefreshToken, error) {
+	args := m.Called(ctx, tokenHash, next)
+	current, _ := args.Get(0).(*RefreshToken)
+	if current != nil {
+		next.AccountID = current.AccountID
+		next.SessionID = current.SessionID
+	}
+	return current, args.Error(1)
+}
+
+func (m *MockStorage) CreateSession(ctx context.Context, session *Session) error {
+	args := m.Called(ctx, session)
+	return args.Error(0)
+}
+
+func (m *MockStorage) GetSessions(ctx context.Context, accountID int) ([]*Session, error) {
+	args := m.Called(ctx, accountID)
+	return args.Get(0).([]*Session), args.Error(1)
+}
+
+func (m *MockStorage) UseSession(ctx context.Context, sessionID string, at time.Time) error {
+	args := m.Called(ctx, sessionID, at)
+	return args.Error(0)
+}
+
+func (m *MockStorage) RevokeAccountSession(ctx context.Context, accountID, id int) (*Session, error) {
+	args := m.Called(ctx, accountID, id)
+	session, _ := args.Get(0).(*Session)
+	return session, args.Error(1)
+}
+
+func (m *MockStorage) RevokeSession(ctx context.Context, sessionID string) error {
+	args := m.Called(ctx, sessionID)
+	return args.Error(0)
+}
+
+func (m *MockStorage) RevokeAllTokens(ctx context.Context, accountID int) error {
+	args := m.Called(ctx, accountID)
+	return args.Error(0)
+}
+
+func (m *MockStorage) RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	args := m.Called(ctx, tokenID, expiresAt)
+	return args.Error(0)
+}
+
+func (m *MockStorage) IsTokenRevoked(ctx context.Context, tokenID string) (bool, error) {
+	args := m.Called(ctx, tokenID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockStorage) GetTOTP(ctx context.Context, accountID int) (*TOTP, error) {
+	args := m.Called(ctx, accountID)
+	totp, _ := args.Get(0).(*TOTP)
+	return totp, args.Error(1)
+}
+
+func (m *MockStorage) SaveTOTP(ctx context.Context, totp *TOTP) error {
+	args := m.Called(ctx, totp)
+	return args.Error(0)
+}
+
+func (m *MockStorage) ConfirmTOTP(ctx context.Context, accountID int, step int64, recoveryCodeHashes []string) error {
+	args := m.Called(ctx, accountID, step, recoveryCodeHashes)
+	return args.Error(0)
+}
+
+func (m *MockStorage) UseTOTPStep(ctx context.Context, accountID int, step int64) (bool, error) {
+	args := m.Called(ctx, accountID, step)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockStorage) UseRecoveryCode(ctx context.Context, accountID int, codeHash string) (bool, error) {
+	args := m.Called(ctx, accountID, codeHash)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockStorage) DeleteTOTP(ctx context.Context, accountID int) error {
+	args := m.Called(ctx, accountID)
+	return args.Error(0)
+}
+
+// ReserveLoginAttempt takes the stored throttle from the expectation and
+// applies retryAfter to it like the real stores.
+func (m *MockStorage) ReserveLoginAttempt(ctx context.Context, email string, at, staleBefore time.Time, retryAfter func(*LoginThrottle) time.Duration) (*LoginThrottle, time.Duration, error) {
+	args := m.Called(ctx, email, at)
+	throttle, _ := args.Get(0).(*LoginThrottle)
+	if err := args.Error(1); err != nil {
+		return nil, 0, err
+	}
+	if wait := retryAfter(throttle); wait > 0 {
+		return throttle, wait, nil
+	}
+	reserved := *throttle
+	reserved.Failures++
+	reserved.LastFailureAt = at
+	return &reserved, 0, nil
+}
+
+func (m *MockStorage) LockLogin(ctx context.Context, email string, until time.Time) error {
+	args := m.Called(ctx, email, until)
+	return args.Error(0)
+}
+
+func (m *MockStorage) ResetLoginThrottle(ctx context.Context, email string) error {
+	args := m.Called(ctx, email)
+	return args.Error(0)
+}
+
+func (m *MockStorage) RecordLoginEvent(ctx context.Context, event *LoginEvent) error {
+	args := m.Called(ctx, event)
+	return args.Error(0)
+}
+
+func (m *MockStorage) GetLoginEvents(ctx context.Context, accountID int, limit int) ([]*LoginEvent, error) {
+	args := m.Called(ctx, accountID, limit)
+	return args.Get(0).([]*LoginEvent), args.Error(1)
+}
+
+func (m *MockStorage) CountLoginFailuresByIP(ctx context.Context, ip string, since time.Time) (int, error) {
+	args := m.Called(ctx, ip, since)
+	return args.Int(0), args.Error(1)
+}
+
+// RecordPasswordResetRequest takes the counts from the expectation and
+// applies allow to them like the real stores.
+func (m *MockStorage) RecordPasswordResetRequest(ctx context.Context, event *LoginEvent, since time.Time, allow func(byEmail, byIP int) bool) (bool, error) {
+	args := m.Called(ctx, event, since)
+	if err := args.Error(2); err != nil {
+		return false, err
+	}
+	return allow(args.Int(0), args.Int(1)), nil
+}
+
+func (m *MockStorage) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	args := m.Called(ctx, reset)
+	return args.Error(0)
+}
+
+func (m *MockStorage) ConsumePasswordReset(ctx context.Context, tokenHash string, at time.Time) (*PasswordReset, error) {
+	args := m.Called(ctx, tokenHash, at)
+	reset, _ := args.Get(0).(*PasswordReset)
+	return reset, args.Error(1)
+}
+
+func (m *MockStorage) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	args := m.Called(ctx, key)
+	return args.Error(0)
+}
+
+func (m *MockStorage) GetAPIKeys(ctx context.Context, accountID int) ([]*APIKey, error) {
+	args := m.Called(ctx, accountID)
+	return args.Get(0).([]*APIKey), args.Error(1)
+}
+
+func (m *MockStorage) UseAPIKey(ctx context.Context, keyHash string, at time.Time) (*APIKey, error) {
+	args := m.Called(ctx, keyHash, at)
+	key, _ := args.Get(0).(*APIKey)
+	return key, args.Error(1)
+}
+
+func (m *MockStorage) RevokeAPIKey(ctx context.Context, accountID, id int) error {
+	args := m.Called(ctx, accountID, id)
+	return args.Error(0)
 }
 
 func (m *MockStorage) DropTable() error {
@@ -50,16 +278,31 @@ func (m *MockStorage) DropTable() error {
 	return args.Error(0)
 }
 
+func withAuth(req *http.Request, accountID int) *http.Request {
+	return req.WithContext(NewAuthContext(req.Context(), accountID, "john@example.com", RoleCustomer))
+}
+
+func withAdmin(req *http.Request, accountID int) *http.Request {
+	return req.WithContext(NewAuthContext(req.Context(), accountID, "admin@example.com", RoleAdmin))
+}
+
+// withCSRF adds a matching CSRF cookie and header, as a browser client would.
+func withCSRF(req *http.Request) *http.Request {
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: "csrf-token"})
+	req.Header.Set(csrfHeader, "csrf-token")
+	return req
+}
+
 func TestHandleAccount(t *testing.T) {
 	mockStorage := new(MockStorage)
-	server := NewAPIServer(":8080", mockStorage)
+	server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
 
 	t.Run("Create Account", func(t *testing.T) {
-		newAccount := &Account{
+		newAccount := &NewAccount{
 			FirstName: "John",
 			LastName:  "Doe",
 			Email:     "john@example.com",
-			Phone:     1234567890,
+			Password:  "password123",
 		}
 
 		mockStorage.On("CreateAccount", mock.AnythingOfType("*main.Account")).Return(nil)
@@ -86,6 +329,7 @@ func TestHandleAccount(t *testing.T) {
 		mockStorage.On("GetAccountByID", 1).Return(account, nil)
 
 		req, _ := http.NewRequest("GET", "/account/1", nil)
+		req.SetPathValue("id", "1")
 		rr := httptest.NewRecorder()
 
 		server.handleGetAccountByID(rr, req)
@@ -96,7 +340,7 @@ func TestHandleAccount(t *testing.T) {
 
 func TestHandleGetAccounts(t *testing.T) {
 	mockStorage := new(MockStorage)
-	server := NewAPIServer(":8080", mockStorage)
+	server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
 
 	accounts := []*Account{
 		{ID: 1, FirstName: "John", LastName: "Doe", Email: "john@example.com"},
@@ -106,6 +350,7 @@ func TestHandleGetAccounts(t *testing.T) {
 	mockStorage.On("GetAccounts").Return(accounts, nil)
 
 	req, _ := http.NewRequest("GET", "/accounts", nil)
+	req = withAdmin(req, 1)
 	rr := httptest.NewRecorder()
 
 	server.handleGetAllAccounts(rr, req)
@@ -117,3 +362,1656 @@ func TestHandleGetAccounts(t *testing.T) {
 	json.Unmarshal(rr.Body.Bytes(), &responseAccounts)
 	assert.Equal(t, accounts, responseAccounts)
 }
+
+func TestHandleTransfer(t *testing.T) {
+	mockStorage := new(MockStorage)
+	server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+	transferReq := &TransferRequest{FromAccount: 1, ToAccount: 2, Amount: 500}
+
+	mockStorage.On("Transfer", mock.Anything, 1, 2, int64(500)).Return(nil)
+
+	body, _ := json.Marshal(transferReq)
+	req, _ := http.NewRequest("POST", "/transfer", bytes.NewBuffer(body))
+	req = withAuth(req, 1)
+	rr := httptest.NewRecorder()
+
+	err := server.handleTransfer(rr, req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	mockStorage.AssertExpectations(t)
+}
+
+func TestHandleGetAccountTransactions(t *testing.T) {
+	mockStorage := new(MockStorage)
+	server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+	transactions := []*AccountTransaction{
+		{ID: 9, EntryID: 5, Kind: EntryKindTransfer, Direction: DirectionDebit, Amount: 100, Counterparty: 2, BalanceAfter: 400},
+		{ID: 7, EntryID: 4, Kind: EntryKindTransfer, Direction: DirectionCredit, Amount: 50, Counterparty: 3, BalanceAfter: 500},
+		{ID: 1, EntryID: 1, Kind: EntryKindOpening, Direction: DirectionCredit, Amount: 450, Counterparty: ExternalAccountID, BalanceAfter: 450},
+	}
+
+	mockStorage.On("GetAccountTransactions", mock.Anything, mock.MatchedBy(func(q *TransactionQuery) bool {
+		return q.AccountID == 1 && q.Before == 10 && q.Limit == 3 && q.From.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	})).Return(transactions, nil)
+
+	req, _ := http.NewRequest("GET", "/account/1/transactions?limit=2&cursor=10&from=2024-01-01T00:00:00Z", nil)
+	req.SetPathValue("id", "1")
+	rr := httptest.NewRecorder()
+
+	err := server.handleGetAccountTransactions(rr, req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	mockStorage.AssertExpectations(t)
+
+	var page TransactionPage
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Len(t, page.Transactions, 2)
+	assert.Equal(t, "7", page.NextCursor)
+
+	t.Run("Invalid limit", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account/1/transactions?limit=500", nil)
+		req.SetPathValue("id", "1")
+
+		err := server.handleGetAccountTransactions(httptest.NewRecorder(), req)
+		assert.Error(t, err)
+	})
+}
+
+func TestIdempotentTransfer(t *testing.T) {
+	body, _ := json.Marshal(&TransferRequest{FromAccount: 1, ToAccount: 2, Amount: 500})
+
+	newRequest := func(body []byte) *http.Request {
+		req, _ := http.NewRequest("POST", "/transfer", bytes.NewBuffer(body))
+		req.Header.Set(idempotencyKeyHeader, "retry-me")
+		return withAuth(req, 1)
+	}
+
+	t.Run("First request is executed and stored", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+		handler := withIdempotency(makeHTTPHandleFunc(server.handleTransfer, true), mockStorage, time.Hour)
+
+		mockStorage.On("ReserveIdempotencyKey", mock.Anything, mock.AnythingOfType("*main.IdempotencyRecord")).Return(nil, nil)
+		mockStorage.On("Transfer", mock.Anything, 1, 2, int64(500)).Return(nil)
+		mockStorage.On("CompleteIdempotencyKey", mock.Anything, mock.MatchedBy(func(rec *IdempotencyRecord) bool {
+			return rec.StatusCode == http.StatusOK && rec.AccountID == 1 && len(rec.Response) > 0
+		})).Return(nil)
+
+		rr := httptest.NewRecorder()
+		handler(rr, newRequest(body))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("Retry replays the stored response", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+		handler := withIdempotency(makeHTTPHandleFunc(server.handleTransfer, true), mockStorage, time.Hour)
+
+		stored := &IdempotencyRecord{
+			AccountID:   1,
+			Key:         "retry-me",
+			Fingerprint: requestFingerprint(newRequest(body), body),
+			StatusCode:  http.StatusOK,
+			Response:    []byte(`{"replayed":true}`),
+		}
+		mockStorage.On("ReserveIdempotencyKey", mock.Anything, mock.Anything).Return(stored, nil)
+
+		rr := httptest.NewRecorder()
+		handler(rr, newRequest(body))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, `{"replayed":true}`, rr.Body.String())
+		assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"))
+		mockStorage.AssertNotCalled(t, "Transfer", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Same key with a different body is rejected", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+		handler := withIdempotency(makeHTTPHandleFunc(server.handleTransfer, true), mockStorage, time.Hour)
+
+		stored := &IdempotencyRecord{AccountID: 1, Key: "retry-me", Fingerprint: "something-else", StatusCode: http.StatusOK}
+		mockStorage.On("ReserveIdempotencyKey", mock.Anything, mock.Anything).Return(stored, nil)
+
+		rr := httptest.NewRecorder()
+		handler(rr, newRequest(body))
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+		mockStorage.AssertNotCalled(t, "Transfer", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Forbidden transfer does not use up the key", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+		handler := requireTransferOwner(withIdempotency(makeHTTPHandleFunc(server.handleTransfer, true), mockStorage, time.Hour))
+
+		body, _ := json.Marshal(&TransferRequest{FromAccount: 2, ToAccount: 1, Amount: 500})
+		rr := httptest.NewRecorder()
+		handler(rr, newRequest(body))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		mockStorage.AssertNotCalled(t, "ReserveIdempotencyKey", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Busy key keeps its conflict status", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+		handler := withIdempotency(makeHTTPHandleFunc(server.handleTransfer, true), mockStorage, time.Hour)
+
+		mockStorage.On("ReserveIdempotencyKey", mock.Anything, mock.Anything).Return(nil, conflictError("idempotency key %q is busy, try again", "retry-me"))
+
+		rr := httptest.NewRecorder()
+		handler(rr, newRequest(body))
+
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		mockStorage.AssertNotCalled(t, "Transfer", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestOwnershipChecks(t *testing.T) {
+	mockStorage := new(MockStorage)
+	server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+	mockStorage.On("GetAccountByID", 1).Return(&Account{ID: 1, Email: "john@example.com"}, nil)
+
+	t.Run("Owner can read their account", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account/1", nil)
+		req.SetPathValue("id", "1")
+		rr := httptest.NewRecorder()
+
+		requireAccountOwner(makeHTTPHandleFunc(server.handleGetAccountByID, true))(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("Reading another account is forbidden", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account/2", nil)
+		req.SetPathValue("id", "2")
+		rr := httptest.NewRecorder()
+
+		requireAccountOwner(makeHTTPHandleFunc(server.handleGetAccountByID, true))(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		mockStorage.AssertNotCalled(t, "GetAccountByID", 2)
+	})
+
+	t.Run("Deleting another account is forbidden", func(t *testing.T) {
+		req, _ := http.NewRequest("DELETE", "/account/2", nil)
+		req.SetPathValue("id", "2")
+		rr := httptest.NewRecorder()
+
+		requireAccountOwner(makeHTTPHandleFunc(server.handleDeleteAccount, true))(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		mockStorage.AssertNotCalled(t, "DeleteAccount", 2)
+	})
+
+	t.Run("Reading another account's transactions is forbidden", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account/2/transactions", nil)
+		req.SetPathValue("id", "2")
+		rr := httptest.NewRecorder()
+
+		requireAccountOwner(makeHTTPHandleFunc(server.handleGetAccountTransactions, true))(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("Transferring out of another account is forbidden", func(t *testing.T) {
+		body, _ := json.Marshal(&TransferRequest{FromAccount: 2, ToAccount: 1, Amount: 100})
+		req, _ := http.NewRequest("POST", "/transfer", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+
+		requireTransferOwner(makeHTTPHandleFunc(server.handleTransfer, true))(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		mockStorage.AssertNotCalled(t, "Transfer", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestRoleBasedAccess(t *testing.T) {
+	mockStorage := new(MockStorage)
+	server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+	own := &Account{ID: 1, FirstName: "John", Email: "john@example.com", Role: RoleCustomer}
+	other := &Account{ID: 2, FirstName: "Jane", Email: "jane@example.com", Role: RoleCustomer}
+
+	mockStorage.On("GetAccountByID", 1).Return(own, nil)
+	mockStorage.On("GetAccountByID", 2).Return(other, nil)
+	mockStorage.On("SearchAccounts", "jane").Return([]*Account{other}, nil)
+	mockStorage.On("DeleteAccount", 2).Return(nil)
+
+	t.Run("Customer listing accounts only sees their own", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account", nil)
+		rr := httptest.NewRecorder()
+
+		requirePermission(PermAccountsRead, makeHTTPHandleFunc(server.handleGetAllAccounts, true))(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var accounts []*Account
+		json.Unmarshal(rr.Body.Bytes(), &accounts)
+		assert.Equal(t, []*Account{own}, accounts)
+		mockStorage.AssertNotCalled(t, "GetAccounts")
+	})
+
+	t.Run("Admin can search accounts", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account?q=jane", nil)
+		rr := httptest.NewRecorder()
+
+		requirePermission(PermAccountsRead, makeHTTPHandleFunc(server.handleGetAllAccounts, true))(rr, withAdmin(req, 1))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var accounts []*Account
+		json.Unmarshal(rr.Body.Bytes(), &accounts)
+		assert.Equal(t, []*Account{other}, accounts)
+	})
+
+	t.Run("Customer cannot create accounts", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/account", bytes.NewBufferString(`{}`))
+		rr := httptest.NewRecorder()
+
+		requirePermission(PermAdmin, makeHTTPHandleFunc(server.handleCreateAccount, true))(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		mockStorage.AssertNotCalled(t, "CreateAccount", mock.Anything)
+	})
+
+	t.Run("Admin can read any account", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account/2", nil)
+		req.SetPathValue("id", "2")
+		rr := httptest.NewRecorder()
+
+		requireAccountOwner(makeHTTPHandleFunc(server.handleGetAccountByID, true))(rr, withAdmin(req, 1))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("Admin can delete any account", func(t *testing.T) {
+		req, _ := http.NewRequest("DELETE", "/account/2", nil)
+		req.SetPathValue("id", "2")
+		rr := httptest.NewRecorder()
+
+		requirePermission(PermAccountsWrite, requireAccountOwner(makeHTTPHandleFunc(server.handleDeleteAccount, true)))(rr, withAdmin(req, 1))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockStorage.AssertCalled(t, "DeleteAccount", 2)
+	})
+
+	t.Run("Admin cannot transfer out of another account", func(t *testing.T) {
+		body, _ := json.Marshal(&TransferRequest{FromAccount: 2, ToAccount: 1, Amount: 100})
+		req, _ := http.NewRequest("POST", "/transfer", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+
+		requireTransferOwner(makeHTTPHandleFunc(server.handleTransfer, true))(rr, withAdmin(req, 1))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+}
+
+func TestHandleSignup(t *testing.T) {
+	t.Run("Valid signup creates a customer and logs in", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mailer := &MemoryMailer{}
+		server := NewAPIServer(":8080", mockStorage, mailer)
+
+		mockStorage.On("GetAccountByEmail", "new@example.com").Return(nil, notFoundError("account new@example.com not found"))
+		mockStorage.On("CreateAccount", mock.MatchedBy(func(acc *Account) bool {
+			return acc.Email == "new@example.com" && acc.Role == RoleCustomer && acc.EncryptedPassword != "s3cretpass"
+		})).Return(nil)
+		mockStorage.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
+		mockStorage.On("CreateRefreshToken", mock.Anything, mock.AnythingOfType("*main.RefreshToken")).Return(nil)
+
+		body := `{"firstName":"New","lastName":"Customer","email":" New@Example.com ","password":"s3cretpass","role":"admin"}`
+		req, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleSignup, false)(rr, req)
+
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		mockStorage.AssertExpectations(t)
+
+		var cookieSet bool
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "token" && c.Value != "" {
+				cookieSet = true
+			}
+		}
+		assert.True(t, cookieSet)
+
+		messages := mailer.Messages()
+		assert.Len(t, messages, 1)
+		assert.Equal(t, "new@example.com", messages[0].To)
+		assert.Contains(t, messages[0].Body, "/verify-email?token=")
+	})
+
+	t.Run("Existing email is rejected", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("GetAccountByEmail", "taken@example.com").Return(&Account{ID: 1, Email: "taken@example.com"}, nil)
+
+		body := `{"firstName":"New","lastName":"Customer","email":"taken@example.com","password":"s3cretpass"}`
+		req, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleSignup, false)(rr, req)
+
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		mockStorage.AssertNotCalled(t, "CreateAccount", mock.Anything)
+	})
+
+	t.Run("Store failure is not taken for a free email", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("GetAccountByEmail", "new@example.com").Return(nil, fmt.Errorf("pq: connection refused"))
+
+		body := `{"firstName":"New","lastName":"Customer","email":"new@example.com","password":"s3cretpass"}`
+		req, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleSignup, false)(rr, req)
+
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+		mockStorage.AssertNotCalled(t, "CreateAccount", mock.Anything)
+	})
+
+	t.Run("Weak password is rejected", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		body := `{"firstName":"New","lastName":"Customer","email":"new@example.com","password":"short"}`
+		req, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleSignup, false)(rr, req)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+		mockStorage.AssertNotCalled(t, "CreateAccount", mock.Anything)
+	})
+}
+
+func TestRefreshToken(t *testing.T) {
+	account := &Account{ID: 1, Email: "john@example.com", Role: RoleCustomer}
+
+	t.Run("Valid refresh token is rotated", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("RotateRefreshToken", mock.Anything, hashToken("old-token"), mock.AnythingOfType("*main.RefreshToken")).
+			Return(&RefreshToken{AccountID: 1, SessionID: "session-1"}, nil)
+		mockStorage.On("GetAccountByID", 1).Return(account, nil)
+
+		req, _ := http.NewRequest("POST", "/token/refresh", bytes.NewBufferString(`{"refreshToken":"old-token"}`))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleRefreshToken, false)(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var resp TokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		assert.NotEmpty(t, resp.AccessToken)
+		assert.NotEmpty(t, resp.RefreshToken)
+		assert.NotEqual(t, "old-token", resp.RefreshToken)
+	})
+
+	t.Run("Refresh token from cookie", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("RotateRefreshToken", mock.Anything, hashToken("cookie-token"), mock.Anything).
+			Return(&RefreshToken{AccountID: 1, SessionID: "session-1"}, nil)
+		mockStorage.On("GetAccountByID", 1).Return(account, nil)
+
+		req, _ := http.NewRequest("POST", "/token/refresh", nil)
+		req.AddCookie(&http.Cookie{Name: refreshTokenCookie, Value: "cookie-token"})
+		withCSRF(req)
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleRefreshToken, false)(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("Rejected refresh token", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("RotateRefreshToken", mock.Anything, hashToken("reused"), mock.Anything).
+			Return(nil, fmt.Errorf("refresh token reuse detected"))
+
+		req, _ := http.NewRequest("POST", "/token/refresh", bytes.NewBufferString(`{"refreshToken":"reused"}`))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleRefreshToken, false)(rr, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+}
+
+func TestAuthWithJWT(t *testing.T) {
+	account := &Account{ID: 1, Email: "john@example.com", Role: RoleCustomer, TokenVersion: 2}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	newRequest := func(t *testing.T, acc *Account) *http.Request {
+		token, err := createJWT(acc, "session-1", nil)
+		assert.NoError(t, err)
+
+		req, _ := http.NewRequest("GET", "/account", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		return req
+	}
+
+	t.Run("Valid token", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("IsTokenRevoked", mock.Anything, mock.Anything).Return(false, nil)
+		mockStorage.On("UseSession", mock.Anything, "session-1", mock.Anything).Return(nil)
+		mockStorage.On("GetAccountByID", 1).Return(account, nil)
+
+		rr := httptest.NewRecorder()
+		authWithJWT(ok, mockStorage)(rr, newRequest(t, account))
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+	})
+
+	t.Run("Logged out token", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("IsTokenRevoked", mock.Anything, mock.Anything).Return(true, nil)
+
+		rr := httptest.NewRecorder()
+		authWithJWT(ok, mockStorage)(rr, newRequest(t, account))
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("Signed out session", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("IsTokenRevoked", mock.Anything, mock.Anything).Return(false, nil)
+		mockStorage.On("UseSession", mock.Anything, "session-1", mock.Anything).Return(fmt.Errorf("session session-1 not found"))
+
+		rr := httptest.NewRecorder()
+		authWithJWT(ok, mockStorage)(rr, newRequest(t, account))
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		mockStorage.AssertNotCalled(t, "GetAccountByID", mock.Anything)
+	})
+
+	t.Run("Token from before all sessions were revoked", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("IsTokenRevoked", mock.Anything, mock.Anything).Return(false, nil)
+		mockStorage.On("UseSession", mock.Anything, "session-1", mock.Anything).Return(nil)
+		mockStorage.On("GetAccountByID", 1).Return(account, nil)
+
+		stale := *account
+		stale.TokenVersion = 1
+
+		rr := httptest.NewRecorder()
+		authWithJWT(ok, mockStorage)(rr, newRequest(t, &stale))
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+}
+
+func TestCSRF(t *testing.T) {
+	account := &Account{ID: 1, Email: "john@example.com", Role: RoleCustomer}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	token, err := createJWT(account, "session-1", nil)
+	assert.NoError(t, err)
+
+	newStorage := func() *MockStorage {
+		mockStorage := new(MockStorage)
+		mockStorage.On("IsTokenRevoked", mock.Anything, mock.Anything).Return(false, nil)
+		mockStorage.On("UseSession", mock.Anything, "session-1", mock.Anything).Return(nil)
+		mockStorage.On("GetAccountByID", 1).Return(account, nil)
+		return mockStorage
+	}
+
+	t.Run("Cookie POST without token is rejected", func(t *testing.T) {
+		mockStorage := newStorage()
+		req, _ := http.NewRequest("POST", "/transfer", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		rr := httptest.NewRecorder()
+
+		authWithJWT(ok, mockStorage)(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		mockStorage.AssertNotCalled(t, "GetAccountByID", mock.Anything)
+	})
+
+	t.Run("Cookie POST with mismatched token is rejected", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/transfer", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		req.AddCookie(&http.Cookie{Name: csrfCookie, Value: "csrf-token"})
+		req.Header.Set(csrfHeader, "other-token")
+		rr := httptest.NewRecorder()
+
+		authWithJWT(ok, newStorage())(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("Cookie POST with matching token passes", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/transfer", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		withCSRF(req)
+		rr := httptest.NewRecorder()
+
+		authWithJWT(ok, newStorage())(rr, req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+	})
+
+	t.Run("Cookie GET needs no token", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		rr := httptest.NewRecorder()
+
+		authWithJWT(ok, newStorage())(rr, req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+	})
+
+	t.Run("Authorization header is exempt", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/transfer", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		rr := httptest.NewRecorder()
+
+		authWithJWT(ok, newStorage())(rr, req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+	})
+
+	t.Run("Refresh from cookie needs a token", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		req, _ := http.NewRequest("POST", "/token/refresh", nil)
+		req.AddCookie(&http.Cookie{Name: refreshTokenCookie, Value: "cookie-token"})
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleRefreshToken, false)(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		mockStorage.AssertNotCalled(t, "RotateRefreshToken", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Issued tokens come with a CSRF cookie", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		_, err := writeTokens(rr, account, "session-1", "refresh", nil)
+		assert.NoError(t, err)
+
+		var csrf *http.Cookie
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == csrfCookie {
+				csrf = c
+			}
+		}
+		if assert.NotNil(t, csrf) {
+			assert.NotEmpty(t, csrf.Value)
+			assert.False(t, csrf.HttpOnly)
+		}
+	})
+
+	t.Run("Cookies apply to the whole site", func(t *testing.T) {
+		// Without an explicit path, cookies set by /token/refresh or
+		// /login/2fa would only be sent back to those paths.
+		rr := httptest.NewRecorder()
+		_, err := writeTokens(rr, account, "session-1", "refresh", nil)
+		assert.NoError(t, err)
+		clearTokenCookies(rr)
+
+		cookies := rr.Result().Cookies()
+		assert.Len(t, cookies, 6)
+		for _, c := range cookies {
+			assert.Equal(t, "/", c.Path, "cookie %s", c.Name)
+		}
+	})
+}
+
+func TestHandleLogout(t *testing.T) {
+	mockStorage := new(MockStorage)
+	server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+	expiresAt := time.Now().Add(time.Minute)
+	mockStorage.On("RevokeSession", mock.Anything, "session-1").Return(nil)
+	mockStorage.On("RevokeToken", mock.Anything, "token-1", expiresAt).Return(nil)
+
+	req, _ := http.NewRequest("POST", "/logout", nil)
+	req = req.WithContext(WithAuthContext(req.Context(), &AuthContext{
+		AccountID:      1,
+		Email:          "john@example.com",
+		Role:           RoleCustomer,
+		SessionID:      "session-1",
+		TokenID:        "token-1",
+		TokenExpiresAt: expiresAt,
+	}))
+	rr := httptest.NewRecorder()
+
+	makeHTTPHandleFunc(server.handleLogout, true)(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	mockStorage.AssertExpectations(t)
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	acc, err := GenerateNewAccount("John", "Doe", "john@example.com", "password123")
+	assert.NoError(t, err)
+	acc.ID = 1
+
+	secret, _ := generateTOTPSecret()
+	confirmedAt := time.Now().UTC()
+	totp := &TOTP{AccountID: 1, Secret: secret, ConfirmedAt: &confirmedAt}
+
+	mockStorage := new(MockStorage)
+	server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+	mockStorage.On("GetAccountByEmail", "john@example.com").Return(acc, nil)
+	mockStorage.On("GetAccountByID", 1).Return(acc, nil)
+	mockStorage.On("GetTOTP", mock.Anything, 1).Return(totp, nil)
+	mockStorage.On("UseTOTPStep", mock.Anything, 1, mock.Anything).Return(true, nil)
+	mockStorage.On("UseRecoveryCode", mock.Anything, 1, hashRecoveryCode("abcde-fghij")).Return(false, nil)
+	mockStorage.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
+	mockStorage.On("CreateRefreshToken", mock.Anything, mock.Anything).Return(nil)
+	mockStorage.On("CountLoginFailuresByIP", mock.Anything, mock.Anything, mock.Anything).Return(0, nil)
+	mockStorage.On("ReserveLoginAttempt", mock.Anything, "john@example.com", mock.Anything).Return(&LoginThrottle{Email: "john@example.com"}, nil)
+	mockStorage.On("RecordLoginEvent", mock.Anything, mock.Anything).Return(nil)
+	mockStorage.On("ResetLoginThrottle", mock.Anything, "john@example.com").Return(nil)
+
+	req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"john@example.com","password":"password123"}`))
+	rr := httptest.NewRecorder()
+
+	makeHTTPHandleFunc(server.handleLogin, false)(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Result().Cookies(), "no session before the second factor")
+
+	var challenge LoginChallenge
+	json.Unmarshal(rr.Body.Bytes(), &challenge)
+	assert.True(t, challenge.MFARequired)
+	assert.NotEmpty(t, challenge.Challenge)
+
+	t.Run("Challenge is not an access token", func(t *testing.T) {
+		_, err := parseJWT(challenge.Challenge, tokenTypeAccess)
+		assert.Error(t, err)
+	})
+
+	t.Run("Wrong recovery code", func(t *testing.T) {
+		body, _ := json.Marshal(&TOTPLoginRequest{Challenge: challenge.Challenge, RecoveryCode: "abcde-fghij"})
+		req, _ := http.NewRequest("POST", "/login/2fa", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleLoginTOTP, false)(rr, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("Valid code completes login", func(t *testing.T) {
+		key, _ := base32NoPadding.DecodeString(secret)
+		code := hotp(key, uint64(totpStep(time.Now())), totpDigits)
+
+		body, _ := json.Marshal(&TOTPLoginRequest{Challenge: challenge.Challenge, Code: code})
+		req, _ := http.NewRequest("POST", "/login/2fa", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleLoginTOTP, false)(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var resp TokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		assert.NotEmpty(t, resp.AccessToken)
+	})
+}
+
+func TestTOTPCodeChecksAreThrottled(t *testing.T) {
+	acc := &Account{ID: 1, Email: "john@example.com", Role: RoleCustomer}
+	secret, _ := generateTOTPSecret()
+	key, _ := base32NoPadding.DecodeString(secret)
+	confirmedAt := time.Now().UTC()
+
+	newServer := func(totp *TOTP, throttle *LoginThrottle) (*APIServer, *MockStorage) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("GetAccountByID", 1).Return(acc, nil)
+		mockStorage.On("GetTOTP", mock.Anything, 1).Return(totp, nil)
+		mockStorage.On("UseTOTPStep", mock.Anything, 1, mock.Anything).Return(true, nil)
+		mockStorage.On("CountLoginFailuresByIP", mock.Anything, mock.Anything, mock.Anything).Return(0, nil)
+		mockStorage.On("ReserveLoginAttempt", mock.Anything, "john@example.com", mock.Anything).Return(throttle, nil)
+		mockStorage.On("ResetLoginThrottle", mock.Anything, "john@example.com").Return(nil)
+		mockStorage.On("RecordLoginEvent", mock.Anything, mock.Anything).Return(nil)
+		return NewAPIServer(":8080", mockStorage, &MemoryMailer{}), mockStorage
+	}
+
+	call := func(handler APIFunc, method, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/2fa", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		makeHTTPHandleFunc(handler, true)(rr, withAuth(req, 1))
+		return rr
+	}
+
+	t.Run("Disabling is refused while locked", func(t *testing.T) {
+		lockedUntil := time.Now().UTC().Add(10 * time.Minute)
+		server, mockStorage := newServer(&TOTP{AccountID: 1, Secret: secret, ConfirmedAt: &confirmedAt},
+			&LoginThrottle{Email: "john@example.com", Failures: 10, LockedUntil: &lockedUntil})
+
+		code := hotp(key, uint64(totpStep(time.Now())), totpDigits)
+		rr := call(server.handleDisableTOTP, "DELETE", `{"code":"`+code+`"}`)
+
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		mockStorage.AssertNotCalled(t, "DeleteTOTP", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Wrong code when disabling counts as a failure", func(t *testing.T) {
+		server, mockStorage := newServer(&TOTP{AccountID: 1, Secret: secret, ConfirmedAt: &confirmedAt}, &LoginThrottle{Email: "john@example.com"})
+		mockStorage.On("UseRecoveryCode", mock.Anything, 1, mock.Anything).Return(false, nil)
+
+		rr := call(server.handleDisableTOTP, "DELETE", `{"recoveryCode":"abcde-fghij"}`)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		mockStorage.AssertCalled(t, "ReserveLoginAttempt", mock.Anything, "john@example.com", mock.Anything)
+		mockStorage.AssertNotCalled(t, "ResetLoginThrottle", mock.Anything, mock.Anything)
+		mockStorage.AssertNotCalled(t, "DeleteTOTP", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Wrong code when confirming counts as a failure", func(t *testing.T) {
+		server, mockStorage := newServer(&TOTP{AccountID: 1, Secret: secret}, &LoginThrottle{Email: "john@example.com"})
+
+		rr := call(server.handleConfirmTOTP, "POST", `{"code":"12345"}`)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		mockStorage.AssertCalled(t, "ReserveLoginAttempt", mock.Anything, "john@example.com", mock.Anything)
+		mockStorage.AssertNotCalled(t, "ConfirmTOTP", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Valid code disables 2FA", func(t *testing.T) {
+		server, mockStorage := newServer(&TOTP{AccountID: 1, Secret: secret, ConfirmedAt: &confirmedAt}, &LoginThrottle{Email: "john@example.com"})
+		mockStorage.On("DeleteTOTP", mock.Anything, 1).Return(nil)
+
+		code := hotp(key, uint64(totpStep(time.Now())), totpDigits)
+		rr := call(server.handleDisableTOTP, "DELETE", `{"code":"`+code+`"}`)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockStorage.AssertCalled(t, "ResetLoginThrottle", mock.Anything, "john@example.com")
+	})
+}
+
+func TestLoginThrottling(t *testing.T) {
+	acc, err := GenerateNewAccount("John", "Doe", "john@example.com", "password123")
+	assert.NoError(t, err)
+	acc.ID = 1
+
+	login := func(server *APIServer, password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(&LoginRequest{Email: "john@example.com", EncryptedPassword: password})
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(body))
+		req.RemoteAddr = "203.0.113.7:52000"
+		rr := httptest.NewRecorder()
+		makeHTTPHandleFunc(server.handleLogin, false)(rr, req)
+		return rr
+	}
+
+	t.Run("Locked account is refused before the password is checked", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		lockedUntil := time.Now().UTC().Add(10 * time.Minute)
+		mockStorage.On("GetAccountByEmail", "john@example.com").Return(acc, nil)
+		mockStorage.On("CountLoginFailuresByIP", mock.Anything, "203.0.113.7", mock.Anything).Return(0, nil)
+		mockStorage.On("ReserveLoginAttempt", mock.Anything, "john@example.com", mock.Anything).Return(&LoginThrottle{Email: "john@example.com", Failures: 10, LockedUntil: &lockedUntil}, nil)
+		mockStorage.On("RecordLoginEvent", mock.Anything, mock.MatchedBy(func(e *LoginEvent) bool {
+			return e.Event == LoginEventThrottled && e.IP == "203.0.113.7"
+		})).Return(nil)
+
+		rr := login(server, "password123")
+
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("Too many failures from one IP", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("GetAccountByEmail", "john@example.com").Return(acc, nil)
+		mockStorage.On("CountLoginFailuresByIP", mock.Anything, "203.0.113.7", mock.Anything).Return(server.loginPolicy.IPMaxFailures, nil)
+		mockStorage.On("RecordLoginEvent", mock.Anything, mock.Anything).Return(nil)
+
+		rr := login(server, "password123")
+
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	})
+
+	t.Run("Reaching the threshold locks the account", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("GetAccountByEmail", "john@example.com").Return(acc, nil)
+		mockStorage.On("CountLoginFailuresByIP", mock.Anything, mock.Anything, mock.Anything).Return(0, nil)
+		mockStorage.On("ReserveLoginAttempt", mock.Anything, "john@example.com", mock.Anything).
+			Return(&LoginThrottle{Email: "john@example.com", Failures: server.loginPolicy.LockoutThreshold - 1}, nil)
+		mockStorage.On("LockLogin", mock.Anything, "john@example.com", mock.Anything).Return(nil)
+		mockStorage.On("RecordLoginEvent", mock.Anything, mock.MatchedBy(func(e *LoginEvent) bool { return e.Event == LoginEventFailed })).Return(nil)
+		mockStorage.On("RecordLoginEvent", mock.Anything, mock.MatchedBy(func(e *LoginEvent) bool { return e.Event == LoginEventLocked })).Return(nil)
+
+		rr := login(server, "wrongpassword1")
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("Admin unlocks an account", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("GetAccountByID", 1).Return(acc, nil)
+		mockStorage.On("ResetLoginThrottle", mock.Anything, "john@example.com").Return(nil)
+		mockStorage.On("RecordLoginEvent", mock.Anything, mock.MatchedBy(func(e *LoginEvent) bool { return e.Event == LoginEventUnlocked })).Return(nil)
+
+		req, _ := http.NewRequest("POST", "/account/1/unlock", nil)
+		req.SetPathValue("id", "1")
+		rr := httptest.NewRecorder()
+
+		requirePermission(PermAdmin, makeHTTPHandleFunc(server.handleUnlockAccount, true))(rr, withAdmin(req, 99))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockStorage.AssertExpectations(t)
+	})
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	login := func(t *testing.T, hash string) *MockStorage {
+		acc := &Account{ID: 1, Email: "john@example.com", Role: RoleCustomer, EncryptedPassword: hash}
+
+		mockStorage := new(MockStorage)
+		mockStorage.On("GetAccountByEmail", "john@example.com").Return(acc, nil)
+		mockStorage.On("CountLoginFailuresByIP", mock.Anything, mock.Anything, mock.Anything).Return(0, nil)
+		mockStorage.On("ReserveLoginAttempt", mock.Anything, "john@example.com", mock.Anything).Return(&LoginThrottle{Email: "john@example.com"}, nil)
+		mockStorage.On("ResetLoginThrottle", mock.Anything, "john@example.com").Return(nil)
+		mockStorage.On("RecordLoginEvent", mock.Anything, mock.Anything).Return(nil)
+		mockStorage.On("GetTOTP", mock.Anything, 1).Return(nil, nil)
+		mockStorage.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
+		mockStorage.On("CreateRefreshToken", mock.Anything, mock.Anything).Return(nil)
+		mockStorage.On("UpdatePassword", mock.Anything, 1, mock.Anything).Return(nil)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"john@example.com","password":"password123"}`))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleLogin, false)(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		return mockStorage
+	}
+
+	t.Run("Legacy bcrypt hash is upgraded", func(t *testing.T) {
+		mockStorage := login(t, string(legacy))
+
+		mockStorage.AssertCalled(t, "UpdatePassword", mock.Anything, 1, mock.MatchedBy(func(hash string) bool {
+			ok, err := currentPasswordHasher().Verify("password123", hash)
+			return ok && err == nil && strings.HasPrefix(hash, "$argon2id$")
+		}))
+	})
+
+	t.Run("Current hash is kept", func(t *testing.T) {
+		hash, err := currentPasswordHasher().Hash("password123")
+		assert.NoError(t, err)
+
+		mockStorage := login(t, hash)
+
+		mockStorage.AssertNotCalled(t, "UpdatePassword", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Stronger parameters upgrade the hash", func(t *testing.T) {
+		hash, err := currentPasswordHasher().Hash("password123")
+		assert.NoError(t, err)
+		t.Setenv("ARGON2_ITERATIONS", "3")
+
+		mockStorage := login(t, hash)
+
+		mockStorage.AssertCalled(t, "UpdatePassword", mock.Anything, 1, mock.MatchedBy(func(hash string) bool {
+			return strings.Contains(hash, ",t=3,")
+		}))
+	})
+}
+
+func TestPasswordReset(t *testing.T) {
+	acc, err := GenerateNewAccount("John", "Doe", "john@example.com", "password123")
+	assert.NoError(t, err)
+	acc.ID = 1
+
+	t.Run("Forgot password mails a reset link", func(t *testing.T) {
+		t.Setenv("APP_BASE_URL", "https://bank.example.com/")
+
+		mockStorage := new(MockStorage)
+		mailer := &MemoryMailer{}
+		server := NewAPIServer(":8080", mockStorage, mailer)
+
+		var stored *PasswordReset
+		mockStorage.On("GetAccountByEmail", "john@example.com").Return(acc, nil)
+		mockStorage.On("RecordPasswordResetRequest", mock.Anything, mock.MatchedBy(func(e *LoginEvent) bool {
+			return e.AccountID == 1 && e.Email == "john@example.com"
+		}), mock.Anything).Return(0, 0, nil)
+		mockStorage.On("CreatePasswordReset", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			stored = args.Get(1).(*PasswordReset)
+		}).Return(nil)
+
+		req, _ := http.NewRequest("POST", "/password/forgot", bytes.NewBufferString(`{"email":"john@example.com"}`))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleForgotPassword, false)(rr, req)
+		server.background.Wait()
+
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		messages := mailer.Messages()
+		assert.Len(t, messages, 1)
+		assert.Equal(t, "john@example.com", messages[0].To)
+		assert.Contains(t, messages[0].Body, "https://bank.example.com/reset-password?token=")
+
+		token := messages[0].Body[strings.Index(messages[0].Body, "token=")+len("token="):]
+		token = token[:strings.Index(token, "\n")]
+		assert.Equal(t, hashToken(token), stored.TokenHash)
+		assert.Equal(t, 1, stored.AccountID)
+		assert.True(t, stored.ExpiresAt.After(stored.CreatedAt))
+	})
+
+	t.Run("Forgot password for an unknown email", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mailer := &MemoryMailer{}
+		server := NewAPIServer(":8080", mockStorage, mailer)
+
+		mockStorage.On("GetAccountByEmail", "nobody@example.com").Return(nil, notFoundError("account with email [nobody@example.com] not found"))
+		mockStorage.On("RecordPasswordResetRequest", mock.Anything, mock.MatchedBy(func(e *LoginEvent) bool {
+			return e.AccountID == 0 && e.Email == "nobody@example.com"
+		}), mock.Anything).Return(0, 0, nil)
+
+		req, _ := http.NewRequest("POST", "/password/forgot", bytes.NewBufferString(`{"email":"nobody@example.com"}`))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleForgotPassword, false)(rr, req)
+		server.background.Wait()
+
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		assert.Empty(t, mailer.Messages())
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("Forgot password is limited per email and per IP", func(t *testing.T) {
+		for _, counts := range [][2]int{{3, 0}, {0, 20}} {
+			mockStorage := new(MockStorage)
+			mailer := &MemoryMailer{}
+			server := NewAPIServer(":8080", mockStorage, mailer)
+
+			mockStorage.On("GetAccountByEmail", "john@example.com").Return(acc, nil)
+			mockStorage.On("RecordPasswordResetRequest", mock.Anything, mock.Anything, mock.Anything).Return(counts[0], counts[1], nil)
+			mockStorage.On("RecordLoginEvent", mock.Anything, mock.MatchedBy(func(e *LoginEvent) bool { return e.Event == LoginEventThrottled })).Return(nil)
+
+			req, _ := http.NewRequest("POST", "/password/forgot", bytes.NewBufferString(`{"email":"john@example.com"}`))
+			rr := httptest.NewRecorder()
+
+			makeHTTPHandleFunc(server.handleForgotPassword, false)(rr, req)
+			server.background.Wait()
+
+			assert.Equal(t, http.StatusTooManyRequests, rr.Code, "counts %v", counts)
+			assert.Empty(t, mailer.Messages())
+			mockStorage.AssertNotCalled(t, "CreatePasswordReset", mock.Anything, mock.Anything)
+		}
+	})
+
+	t.Run("Reset password ends all sessions", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("ConsumePasswordReset", mock.Anything, hashToken("reset-token"), mock.Anything).
+			Return(&PasswordReset{ID: 1, AccountID: 1}, nil)
+		mockStorage.On("UpdatePassword", mock.Anything, 1, mock.MatchedBy(func(hash string) bool {
+			ok, err := currentPasswordHasher().Verify("newpassword456", hash)
+			return ok && err == nil
+		})).Return(nil)
+		mockStorage.On("RevokeAllTokens", mock.Anything, 1).Return(nil)
+
+		req, _ := http.NewRequest("POST", "/password/reset", bytes.NewBufferString(`{"token":"reset-token","password":"newpassword456"}`))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleResetPassword, false)(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("Reset password with a spent token", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("ConsumePasswordReset", mock.Anything, hashToken("spent"), mock.Anything).
+			Return(nil, fmt.Errorf("password reset token not found"))
+
+		req, _ := http.NewRequest("POST", "/password/reset", bytes.NewBufferString(`{"token":"spent","password":"newpassword456"}`))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleResetPassword, false)(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		mockStorage.AssertNotCalled(t, "UpdatePassword", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Reset password with a weak password", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		req, _ := http.NewRequest("POST", "/password/reset", bytes.NewBufferString(`{"token":"reset-token","password":"short"}`))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleResetPassword, false)(rr, req)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+		mockStorage.AssertNotCalled(t, "ConsumePasswordReset", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestEmailVerification(t *testing.T) {
+	account := &Account{ID: 1, FirstName: "John", Email: "john@example.com", Role: RoleCustomer}
+
+	verify := func(server *APIServer, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/verify-email?token="+token, nil)
+		rr := httptest.NewRecorder()
+		makeHTTPHandleFunc(server.handleVerifyEmail, false)(rr, req)
+		return rr
+	}
+
+	t.Run("Valid link verifies the email", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("VerifyEmail", mock.Anything, 1, "john@example.com").Return(nil)
+
+		token, err := createVerificationToken(account, time.Hour)
+		assert.NoError(t, err)
+
+		rr := verify(server, token)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("Link for a changed email", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("VerifyEmail", mock.Anything, 1, "john@example.com").Return(fmt.Errorf("account 1 with email [john@example.com] not found"))
+
+		token, err := createVerificationToken(account, time.Hour)
+		assert.NoError(t, err)
+
+		rr := verify(server, token)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("Access token is not a verification link", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		token, err := createJWT(account, "session-1", nil)
+		assert.NoError(t, err)
+
+		rr := verify(server, token)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		mockStorage.AssertNotCalled(t, "VerifyEmail", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Resend to an unverified account", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mailer := &MemoryMailer{}
+		server := NewAPIServer(":8080", mockStorage, mailer)
+
+		mockStorage.On("GetAccountByID", 1).Return(account, nil)
+
+		req, _ := http.NewRequest("POST", "/verify-email/resend", nil)
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleResendVerification, true)(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		assert.Len(t, mailer.Messages(), 1)
+	})
+
+	t.Run("Unverified accounts cannot transfer", func(t *testing.T) {
+		called := false
+		handler := requireVerifiedEmail(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+
+		req, _ := http.NewRequest("POST", "/transfer", nil)
+		rr := httptest.NewRecorder()
+		handler(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.False(t, called)
+
+		req = req.WithContext(WithAuthContext(req.Context(), &AuthContext{AccountID: 1, Role: RoleCustomer, EmailVerified: true}))
+		rr = httptest.NewRecorder()
+		handler(rr, req)
+
+		assert.True(t, called)
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	account := &Account{ID: 1, Email: "john@example.com", Role: RoleCustomer, EmailVerified: true}
+
+	t.Run("Create a key with a subset of the caller's permissions", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("CreateAPIKey", mock.Anything, mock.MatchedBy(func(k *APIKey) bool {
+			return k.AccountID == 1 && k.Name == "reporting" && len(k.Permissions) == 1
+		})).Return(nil)
+
+		body := `{"name":"reporting","permissions":["accounts:read"]}`
+		req, _ := http.NewRequest("POST", "/apikeys", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleCreateAPIKey, true)(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		mockStorage.AssertExpectations(t)
+
+		var created struct {
+			Key    string `json:"key"`
+			Prefix string `json:"prefix"`
+		}
+		err := json.NewDecoder(rr.Body).Decode(&created)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(created.Key, created.Prefix))
+
+		stored := mockStorage.Calls[0].Arguments.Get(1).(*APIKey)
+		assert.Equal(t, hashToken(created.Key), stored.KeyHash)
+	})
+
+	t.Run("Customers cannot create admin keys", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		body := `{"name":"escalate","permissions":["admin"]}`
+		req, _ := http.NewRequest("POST", "/apikeys", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleCreateAPIKey, true)(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+		mockStorage.AssertNotCalled(t, "CreateAPIKey", mock.Anything, mock.Anything)
+	})
+
+	t.Run("API keys cannot create keys", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		body := `{"name":"copy","permissions":["accounts:read"]}`
+		req, _ := http.NewRequest("POST", "/apikeys", bytes.NewBufferString(body))
+		req = req.WithContext(WithAuthContext(req.Context(), &AuthContext{AccountID: 1, Role: RoleCustomer, APIKeyID: 7}))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleCreateAPIKey, true)(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("Authenticate with an API key", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("UseAPIKey", mock.Anything, hashToken("gmk_secret"), mock.Anything).
+			Return(&APIKey{ID: 7, AccountID: 1, Permissions: []Permission{PermAccountsRead}}, nil)
+		mockStorage.On("GetAccountByID", 1).Return(account, nil)
+
+		var authCtx *AuthContext
+		handler := authWithJWT(func(w http.ResponseWriter, r *http.Request) {
+			authCtx, _ = GetAuthContext(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+		}, mockStorage)
+
+		req, _ := http.NewRequest("GET", "/account", nil)
+		req.Header.Set("Authorization", "ApiKey gmk_secret")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.Equal(t, 1, authCtx.AccountID)
+		assert.Equal(t, 7, authCtx.APIKeyID)
+		assert.True(t, authCtx.Can(PermAccountsRead))
+		assert.False(t, authCtx.Can(PermTransfersWrite))
+	})
+
+	t.Run("Read-only key cannot transfer", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("UseAPIKey", mock.Anything, hashToken("gmk_secret"), mock.Anything).
+			Return(&APIKey{ID: 7, AccountID: 1, Permissions: []Permission{PermAccountsRead}}, nil)
+		mockStorage.On("GetAccountByID", 1).Return(account, nil)
+
+		handler := authWithJWT(requirePermission(PermTransfersWrite, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}), mockStorage)
+
+		req, _ := http.NewRequest("POST", "/transfer", nil)
+		req.Header.Set("Authorization", "ApiKey gmk_secret")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("Revoked key is rejected", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("UseAPIKey", mock.Anything, hashToken("gmk_revoked"), mock.Anything).
+			Return(nil, fmt.Errorf("api key not found"))
+
+		handler := authWithJWT(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}, mockStorage)
+
+		req, _ := http.NewRequest("GET", "/account", nil)
+		req.Header.Set("Authorization", "ApiKey gmk_revoked")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("Revoke someone else's key", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("RevokeAPIKey", mock.Anything, 1, 9).Return(notFoundError("api key 9 not found"))
+
+		req, _ := http.NewRequest("DELETE", "/apikeys/9", nil)
+		req.SetPathValue("id", "9")
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleRevokeAPIKey, true)(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
+
+func TestScopedLogin(t *testing.T) {
+	acc, err := GenerateNewAccount("John", "Doe", "john@example.com", "password123")
+	assert.NoError(t, err)
+	acc.ID = 1
+	acc.EmailVerified = true
+
+	newServer := func() (*APIServer, *MockStorage) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("GetAccountByEmail", "john@example.com").Return(acc, nil)
+		mockStorage.On("GetAccountByID", 1).Return(acc, nil)
+		mockStorage.On("CountLoginFailuresByIP", mock.Anything, mock.Anything, mock.Anything).Return(0, nil)
+		mockStorage.On("ReserveLoginAttempt", mock.Anything, "john@example.com", mock.Anything).Return(&LoginThrottle{Email: "john@example.com"}, nil)
+		mockStorage.On("ResetLoginThrottle", mock.Anything, "john@example.com").Return(nil)
+		mockStorage.On("RecordLoginEvent", mock.Anything, mock.Anything).Return(nil)
+		mockStorage.On("GetTOTP", mock.Anything, 1).Return(nil, nil)
+		mockStorage.On("IsTokenRevoked", mock.Anything, mock.Anything).Return(false, nil)
+		mockStorage.On("UseSession", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		return NewAPIServer(":8080", mockStorage, &MemoryMailer{}), mockStorage
+	}
+
+	t.Run("Read-only token cannot move money", func(t *testing.T) {
+		server, mockStorage := newServer()
+		mockStorage.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
+		mockStorage.On("CreateRefreshToken", mock.Anything, mock.MatchedBy(func(rt *RefreshToken) bool {
+			return len(rt.Scopes) == 1 && rt.Scopes[0] == PermAccountsRead
+		})).Return(nil)
+
+		body := `{"email":"john@example.com","password":"password123","scope":"accounts:read"}`
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleLogin, false)(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var resp TokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		assert.Equal(t, "accounts:read", resp.Scope)
+
+		ok := func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		for p, expected := range map[Permission]int{
+			PermAccountsRead:   http.StatusNoContent,
+			PermTransfersWrite: http.StatusForbidden,
+		} {
+			req, _ := http.NewRequest("POST", "/", nil)
+			req.AddCookie(&http.Cookie{Name: "token", Value: resp.AccessToken})
+			withCSRF(req)
+			rr := httptest.NewRecorder()
+
+			authWithJWT(requirePermission(p, ok), mockStorage)(rr, req)
+
+			assert.Equal(t, expected, rr.Code, string(p))
+		}
+	})
+
+	t.Run("Default scope is the full role", func(t *testing.T) {
+		server, mockStorage := newServer()
+		mockStorage.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
+		mockStorage.On("CreateRefreshToken", mock.Anything, mock.Anything).Return(nil)
+
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"john@example.com","password":"password123"}`))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleLogin, false)(rr, req)
+
+		var resp TokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		assert.Equal(t, "accounts:read accounts:write transfers:write", resp.Scope)
+	})
+
+	t.Run("Scope beyond the role is rejected", func(t *testing.T) {
+		server, mockStorage := newServer()
+
+		body := `{"email":"john@example.com","password":"password123","scope":"accounts:read admin"}`
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleLogin, false)(rr, req)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+		mockStorage.AssertNotCalled(t, "CreateRefreshToken", mock.Anything, mock.Anything)
+	})
+}
+
+func TestSessions(t *testing.T) {
+	withSession := func(req *http.Request, sessionID string) *http.Request {
+		return req.WithContext(WithAuthContext(req.Context(), &AuthContext{
+			AccountID: 1,
+			Email:     "john@example.com",
+			Role:      RoleCustomer,
+			SessionID: sessionID,
+		}))
+	}
+
+	t.Run("Login records the session", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("CreateSession", mock.Anything, mock.MatchedBy(func(s *Session) bool {
+			return s.AccountID == 1 && s.UserAgent == "Mozilla/5.0 (Test)" && s.IP == "192.0.2.1" && s.SessionID != ""
+		})).Return(nil)
+		mockStorage.On("CreateRefreshToken", mock.Anything, mock.Anything).Return(nil)
+
+		req, _ := http.NewRequest("POST", "/login", nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0 (Test)")
+		req.RemoteAddr = "192.0.2.1:4000"
+
+		_, err := server.issueTokens(httptest.NewRecorder(), req, &Account{ID: 1, Role: RoleCustomer}, nil)
+		assert.NoError(t, err)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("List marks the current session", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("GetSessions", mock.Anything, 1).Return([]*Session{
+			{ID: 2, SessionID: "phone", UserAgent: "Phone"},
+			{ID: 1, SessionID: "laptop", UserAgent: "Laptop"},
+		}, nil)
+
+		req, _ := http.NewRequest("GET", "/sessions", nil)
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleGetSessions, true)(rr, withSession(req, "laptop"))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NotContains(t, rr.Body.String(), "phone\"")
+
+		var sessions []*Session
+		json.Unmarshal(rr.Body.Bytes(), &sessions)
+		assert.Len(t, sessions, 2)
+		assert.False(t, sessions[0].Current)
+		assert.True(t, sessions[1].Current)
+	})
+
+	t.Run("Sign out another session", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("RevokeAccountSession", mock.Anything, 1, 2).Return(&Session{ID: 2, AccountID: 1, SessionID: "phone"}, nil)
+
+		req, _ := http.NewRequest("DELETE", "/sessions/2", nil)
+		req.SetPathValue("id", "2")
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleRevokeSession, true)(rr, withSession(req, "laptop"))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Empty(t, rr.Result().Cookies())
+	})
+
+	t.Run("Sign out the current session", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("RevokeAccountSession", mock.Anything, 1, 1).Return(&Session{ID: 1, AccountID: 1, SessionID: "laptop"}, nil)
+
+		req, _ := http.NewRequest("DELETE", "/sessions/1", nil)
+		req.SetPathValue("id", "1")
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleRevokeSession, true)(rr, withSession(req, "laptop"))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NotEmpty(t, rr.Result().Cookies())
+	})
+
+	t.Run("Someone else's session", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("RevokeAccountSession", mock.Anything, 1, 5).Return(nil, notFoundError("session 5 not found"))
+
+		req, _ := http.NewRequest("DELETE", "/sessions/5", nil)
+		req.SetPathValue("id", "5")
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleRevokeSession, true)(rr, withSession(req, "laptop"))
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
+
+func TestStepUp(t *testing.T) {
+	acc, err := GenerateNewAccount("John", "Doe", "john@example.com", "password123")
+	assert.NoError(t, err)
+	acc.ID = 1
+
+	withSession := func(req *http.Request, sessionID string) *http.Request {
+		return req.WithContext(WithAuthContext(req.Context(), &AuthContext{
+			AccountID: 1,
+			Email:     "john@example.com",
+			Role:      RoleCustomer,
+			SessionID: sessionID,
+		}))
+	}
+
+	newServer := func() (*APIServer, *MockStorage) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("GetAccountByID", 1).Return(acc, nil)
+		mockStorage.On("CountLoginFailuresByIP", mock.Anything, mock.Anything, mock.Anything).Return(0, nil)
+		mockStorage.On("ReserveLoginAttempt", mock.Anything, "john@example.com", mock.Anything).Return(&LoginThrottle{Email: "john@example.com"}, nil)
+		mockStorage.On("ResetLoginThrottle", mock.Anything, "john@example.com").Return(nil)
+		mockStorage.On("RecordLoginEvent", mock.Anything, mock.Anything).Return(nil)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+		server.stepUpPolicy.TransferThreshold = 1000
+		return server, mockStorage
+	}
+
+	stepUp := func(t *testing.T, server *APIServer, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/auth/step-up", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		makeHTTPHandleFunc(server.handleStepUp, true)(rr, withSession(req, "session-1"))
+		return rr
+	}
+
+	transfer := func(server *APIServer, amount int64, stepUpToken, sessionID string) (*httptest.ResponseRecorder, *TransferRequest) {
+		var received TransferRequest
+		handler := requireStepUp(server.isHighValueTransfer, func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&received)
+			w.WriteHeader(http.StatusOK)
+		})
+
+		body, _ := json.Marshal(&TransferRequest{FromAccount: 1, ToAccount: 2, Amount: amount})
+		req, _ := http.NewRequest("POST", "/transfer", bytes.NewBuffer(body))
+		if stepUpToken != "" {
+			req.Header.Set(stepUpTokenHeader, stepUpToken)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, withSession(req, sessionID))
+		return rr, &received
+	}
+
+	t.Run("Small transfers need no step-up", func(t *testing.T) {
+		server, _ := newServer()
+
+		rr, received := transfer(server, 1000, "", "session-1")
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, int64(1000), received.Amount)
+	})
+
+	t.Run("Large transfers return a challenge", func(t *testing.T) {
+		server, _ := newServer()
+
+		rr, _ := transfer(server, 1001, "", "session-1")
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		var challenge StepUpChallenge
+		json.Unmarshal(rr.Body.Bytes(), &challenge)
+		assert.True(t, challenge.StepUpRequired)
+		assert.Equal(t, errCodeStepUpRequired, challenge.Code)
+	})
+
+	t.Run("Oversized bodies are not read into memory", func(t *testing.T) {
+		server, _ := newServer()
+
+		body := `{"fromAccount":1,"toAccount":2,"amount":1,"note":"` + strings.Repeat("x", maxTransferBodySize) + `"}`
+		req, _ := http.NewRequest("POST", "/transfer", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		requireTransferOwner(makeHTTPHandleFunc(server.handleTransfer, true))(rr, withSession(req, "session-1"))
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.True(t, server.isHighValueTransfer(httptest.NewRequest("POST", "/transfer", bytes.NewBufferString(body))))
+	})
+
+	t.Run("Password step-up allows the large transfer", func(t *testing.T) {
+		server, _ := newServer()
+
+		rr := stepUp(t, server, `{"password":"password123"}`)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var resp StepUpResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		assert.NotEmpty(t, resp.StepUpToken)
+
+		rr, received := transfer(server, 5000, resp.StepUpToken, "session-1")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, int64(5000), received.Amount)
+
+		rr, _ = transfer(server, 5000, resp.StepUpToken, "session-2")
+		assert.Equal(t, http.StatusForbidden, rr.Code, "elevated token is bound to its session")
+	})
+
+	t.Run("Access token is not an elevated token", func(t *testing.T) {
+		server, _ := newServer()
+
+		token, err := createJWT(acc, "session-1", nil)
+		assert.NoError(t, err)
+
+		rr, _ := transfer(server, 5000, token, "session-1")
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("Wrong password counts as a failed login", func(t *testing.T) {
+		server, mockStorage := newServer()
+
+		rr := stepUp(t, server, `{"password":"wrongpassword1"}`)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		mockStorage.AssertCalled(t, "ReserveLoginAttempt", mock.Anything, "john@example.com", mock.Anything)
+		mockStorage.AssertNotCalled(t, "ResetLoginThrottle", mock.Anything, mock.Anything)
+	})
+
+	t.Run("TOTP code without 2FA enabled", func(t *testing.T) {
+		server, mockStorage := newServer()
+		mockStorage.On("GetTOTP", mock.Anything, 1).Return(nil, nil)
+
+		rr := stepUp(t, server, `{"code":"123456"}`)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("Deleting an account always needs step-up", func(t *testing.T) {
+		called := false
+		handler := requireStepUp(nil, func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+
+		req, _ := http.NewRequest("DELETE", "/account/1", nil)
+		rr := httptest.NewRecorder()
+		handler(rr, withSession(req, "session-1"))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.False(t, called)
+	})
+}
+
+func TestHandleChangeEmail(t *testing.T) {
+	t.Run("Change email requires verification and signs out", func(t *testing.T) {
+		acc := &Account{ID: 1, FirstName: "John", Email: "new@example.com", Role: RoleCustomer}
+
+		mockStorage := new(MockStorage)
+		mailer := &MemoryMailer{}
+		server := NewAPIServer(":8080", mockStorage, mailer)
+
+		mockStorage.On("GetAccountByEmail", "new@example.com").Return(nil, notFoundError("account with email [new@example.com] not found"))
+		mockStorage.On("UpdateEmail", mock.Anything, 1, "new@example.com").Return(nil)
+		mockStorage.On("GetAccountByID", 1).Return(acc, nil)
+		mockStorage.On("RevokeAllTokens", mock.Anything, 1).Return(nil)
+
+		req, _ := http.NewRequest("POST", "/account/1/email", bytes.NewBufferString(`{"email":"new@example.com"}`))
+		req.SetPathValue("id", "1")
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleChangeEmail, true)(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockStorage.AssertExpectations(t)
+		assert.Len(t, mailer.Messages(), 1)
+		assert.Equal(t, "new@example.com", mailer.Messages()[0].To)
+	})
+
+	t.Run("Email of another account", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+
+		mockStorage.On("GetAccountByEmail", "taken@example.com").Return(&Account{ID: 2, Email: "taken@example.com"}, nil)
+
+		req, _ := http.NewRequest("POST", "/account/1/email", bytes.NewBufferString(`{"email":"taken@example.com"}`))
+		req.SetPathValue("id", "1")
+		rr := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleChangeEmail, true)(rr, withAuth(req, 1))
+
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		mockStorage.AssertNotCalled(t, "UpdateEmail", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyScheme    = "ApiKey"
+	apiKeyPrefix    = "gmk_"
+	apiKeyPrefixLen = len(apiKeyPrefix) + 8
+	maxAPIKeyName   = 100
+)
+
+// apiKeyFromHeader returns the key of an "Authorization: ApiKey <key>"
+// header.
+func apiKeyFromHeader(r *http.Request) (string, bool) {
+	scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, apiKeyScheme) {
+		return "", false
+	}
+	key = strings.TrimSpace(key)
+	return key, key != ""
+}
+
+// authenticateAPIKey builds the AuthContext for an API key. The key acts as
+// its account, limited to the key's permissions.
+func authenticateAPIKey(ctx context.Context, store Storage, key string) (*AuthContext, error) {
+	apiKey, err := store.UseAPIKey(ctx, hashToken(key), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := store.GetAccountByID(apiKey.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthContext{
+		AccountID:     account.ID,
+		Email:         account.Email,
+		Role:          account.Role,
+		EmailVerified: account.EmailVerified,
+		APIKeyID:      apiKey.ID,
+		Scopes:        apiKey.Permissions,
+	}, nil
+}
+
+// handleCreateAPIKey issues a key with a subset of the caller's permissions.
+// The key is only shown in this response. Keys cannot be used to create
+// further keys.
+func (s *APIServer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+	if authCtx.APIKeyID != 0 {
+		forbidden(w)
+		return nil
+	}
+
+	var createReq CreateAPIKeyRequest
+	if err := decodeJSON(r, &createReq); err != nil {
+		return err
+	}
+
+	createReq.Name = strings.TrimSpace(createReq.Name)
+	if createReq.Name == "" || len(createReq.Name) > maxAPIKeyName {
+		return validationError("name must be between 1 and %d characters", maxAPIKeyName)
+	}
+	if len(createReq.Permissions) == 0 {
+		return validationError("at least one permission is required")
+	}
+	for _, p := range createReq.Permissions {
+		if !authCtx.Can(p) {
+			return validationError("permission not granted: %s", p)
+		}
+	}
+
+	secret, err := newRandomToken()
+	if err != nil {
+		return err
+	}
+	key := apiKeyPrefix + secret
+
+	apiKey := &APIKey{
+		AccountID:   authCtx.AccountID,
+		Name:        createReq.Name,
+		Prefix:      key[:apiKeyPrefixLen],
+		KeyHash:     hashToken(key),
+		Permissions: createReq.Permissions,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := s.store.CreateAPIKey(r.Context(), apiKey); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusCreated, &CreatedAPIKey{APIKey: apiKey, Key: key})
+}
+
+func (s *APIServer) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+
+	keys, err := s.store.GetAPIKeys(r.Context(), authCtx.AccountID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, keys)
+}
+
+func (s *APIServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.RevokeAPIKey(r.Context(), authCtx.AccountID, id); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]int{"revoked": id})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type Permission string
+
+const (
+	// PermAccountsRead allows reading the caller's own account and history.
+	PermAccountsRead Permission = "accounts:read"
+	// PermAccountsWrite allows changing and deleting the caller's own account.
+	PermAccountsWrite Permission = "accounts:write"
+	// PermTransfersWrite allows moving money out of the caller's own account.
+	PermTransfersWrite Permission = "transfers:write"
+	// PermAdmin allows creating, listing, searching, reading and deleting
+	// any account.
+	PermAdmin Permission = "admin"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleCustomer: {PermAccountsRead, PermAccountsWrite, PermTransfersWrite},
+	RoleAdmin:    {PermAccountsRead, PermAccountsWrite, PermTransfersWrite, PermAdmin},
+}
+
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+func (r Role) Can(p Permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScope parses a space-separated OAuth scope such as
+// "accounts:read transfers:write". Every scope must be granted by the role.
+// An empty scope asks for everything the role grants.
+func parseScope(role Role, scope string) ([]Permission, error) {
+	fields := strings.Fields(scope)
+	if len(fields) == 0 {
+		return slices.Clone(rolePermissions[role]), nil
+	}
+
+	scopes := []Permission{}
+	for _, f := range fields {
+		p := Permission(f)
+		if !role.Can(p) {
+			return nil, validationError("invalid scope: %s", f)
+		}
+		if !slices.Contains(scopes, p) {
+			scopes = append(scopes, p)
+		}
+	}
+	return scopes, nil
+}
+
+func formatScope(scopes []Permission) string {
+	return strings.ReplaceAll(joinPermissions(scopes), ",", " ")
+}
+
+// splitScope reads the scope claim of a token. It returns nil, meaning no
+// restriction, for an empty claim.
+func splitScope(scope string) []Permission {
+	var scopes []Permission
+	for _, f := range strings.Fields(scope) {
+		scopes = append(scopes, Permission(f))
+	}
+	return scopes
+}
+
+// joinPermissions and splitPermissions convert a permission list to and from
+// the comma-separated form it is stored in.
+func joinPermissions(perms []Permission) string {
+	s := make([]string, len(perms))
+	for i, p := range perms {
+		s[i] = string(p)
+	}
+	return strings.Join(s, ",")
+}
+
+func splitPermissions(s string) []Permission {
+	perms := []Permission{}
+	for _, p := range strings.Split(s, ",") {
+		if p != "" {
+			perms = append(perms, Permission(p))
+		}
+	}
+	return perms
+}
+
+// ownsAccount reports whether the authenticated caller is the owner of the
+// account with the given id.
+func ownsAccount(r *http.Request, id int) bool {
+	authCtx, ok := GetAuthContext(r.Context())
+	return ok && authCtx.AccountID == id
+}
+
+func forbidden(w http.ResponseWriter) {
+	WriteJSON(w, http.StatusForbidden, APIError{Code: errCodeForbidden, Error: "Forbidden"})
+}
+
+// requirePermission rejects the request with 403 unless the caller's role
+// grants p. It must run after authWithJWT.
+func requirePermission(p Permission, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authCtx, ok := GetAuthContext(r.Context())
+		if !ok {
+			unauthorized(w)
+			return
+		}
+
+		if !authCtx.Can(p) {
+			insufficientScope(w, p)
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+// requireAccountOwner rejects the request with 403 unless the {id} path value
+// is the caller's own account or the caller is an admin. It must run after
+// authWithJWT.
+func requireAccountOwner(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getID(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		authCtx, ok := GetAuthContext(r.Context())
+		if !ownsAccount(r, id) && !(ok && authCtx.Can(PermAdmin)) {
+			forbidden(w)
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+// requireTransferOwner rejects the request with 403 unless the transfer in
+// the body is out of the caller's own account; admins are no exception. It
+// must run after authWithJWT and before withIdempotency, so that a refusal is
+// not stored and replayed to a later retry.
+func requireTransferOwner(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		transferReq, err := peekTransferRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if !ownsAccount(r, transferReq.FromAccount) {
+			forbidden(w)
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+// requireVerifiedEmail rejects the request with 403 until the caller has
+// confirmed their email address. It must run after authWithJWT.
+func requireVerifiedEmail(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authCtx, ok := GetAuthContext(r.Context())
+		if !ok {
+			unauthorized(w)
+			return
+		}
+
+		if !authCtx.EmailVerified {
+			WriteJSON(w, http.StatusForbidden, APIError{Code: errCodeEmailNotVerified, Error: "Email address is not verified"})
+			return
+		}
+
+		f(w, r)
+	}
+}
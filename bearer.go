@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	authRealm                = "gomoni"
+	defaultAuthTokenSources  = "header,cookie"
+	bearerScheme             = "Bearer"
+	authChallengeHeader      = "WWW-Authenticate"
+	errCodeInvalidRequest    = "invalid_request"
+	errCodeInvalidToken      = "invalid_token"
+	errCodeInsufficientScope = "insufficient_scope"
+)
+
+// TokenSource is a place an access token can be read from.
+type TokenSource string
+
+const (
+	// TokenSourceHeader is an "Authorization: Bearer <token>" header.
+	TokenSourceHeader TokenSource = "header"
+	// TokenSourceCookie is the token cookie set on login.
+	TokenSourceCookie TokenSource = "cookie"
+)
+
+// b64token is the token68 syntax of RFC 6750 section 2.1.
+var b64token = regexp.MustCompile(`^[A-Za-z0-9\-._~+/]+=*$`)
+
+// parseTokenSources parses a comma-separated list such as "header,cookie".
+// The order is the precedence when a request carries more than one token.
+func parseTokenSources(v string) ([]TokenSource, error) {
+	var sources []TokenSource
+	for _, s := range strings.Split(v, ",") {
+		source := TokenSource(strings.ToLower(strings.TrimSpace(s)))
+		switch source {
+		case TokenSourceHeader, TokenSourceCookie:
+		default:
+			return nil, fmt.Errorf("unknown token source %q", s)
+		}
+		if slices.Contains(sources, source) {
+			return nil, fmt.Errorf("duplicate token source %q", s)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// authTokenSources reads the accepted token sources from AUTH_TOKEN_SOURCES.
+// It falls back to the header, then the cookie, when the variable is unset
+// or cannot be parsed.
+func authTokenSources() []TokenSource {
+	v := os.Getenv("AUTH_TOKEN_SOURCES")
+	if v != "" {
+		sources, err := parseTokenSources(v)
+		if err == nil {
+			return sources
+		}
+		log.Printf("Invalid AUTH_TOKEN_SOURCES %q, using default %s: %v", v, defaultAuthTokenSources, err)
+	}
+	sources, _ := parseTokenSources(defaultAuthTokenSources)
+	return sources
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header
+// as described in RFC 6750 section 2.1. ok is false when the request has no
+// Authorization header; a header with another scheme or a malformed token is
+// an error.
+func bearerToken(r *http.Request) (token string, ok bool, err error) {
+	values := r.Header.Values("Authorization")
+	switch len(values) {
+	case 0:
+		return "", false, nil
+	case 1:
+	default:
+		return "", false, fmt.Errorf("multiple Authorization headers")
+	}
+
+	scheme, token, found := strings.Cut(strings.TrimSpace(values[0]), " ")
+	if !found || !strings.EqualFold(scheme, bearerScheme) {
+		return "", false, fmt.Errorf("the Authorization header must use the Bearer scheme")
+	}
+	token = strings.TrimLeft(token, " ")
+	if !b64token.MatchString(token) {
+		return "", false, fmt.Errorf("malformed bearer token")
+	}
+	return token, true, nil
+}
+
+// accessTokenFromRequest returns the access token from the first of sources
+// that the request carries, together with where it was found. The token is
+// empty when none of them is present.
+func accessTokenFromRequest(r *http.Request, sources []TokenSource) (string, TokenSource, error) {
+	for _, source := range sources {
+		switch source {
+		case TokenSourceHeader:
+			token, ok, err := bearerToken(r)
+			if err != nil {
+				return "", source, err
+			}
+			if ok {
+				return token, source, nil
+			}
+		case TokenSourceCookie:
+			if cookie, err := r.Cookie("token"); err == nil && cookie.Value != "" {
+				return cookie.Value, source, nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// authChallenge builds a Bearer WWW-Authenticate challenge as in RFC 6750
+// section 3. Empty attributes are left out.
+func authChallenge(code, description, scope string) string {
+	params := []string{fmt.Sprintf("realm=%q", authRealm)}
+	if code != "" {
+		params = append(params, fmt.Sprintf("error=%q", code))
+	}
+	if description != "" {
+		params = append(params, fmt.Sprintf("error_description=%q", description))
+	}
+	if scope != "" {
+		params = append(params, fmt.Sprintf("scope=%q", scope))
+	}
+	return bearerScheme + " " + strings.Join(params, ", ")
+}
+
+func invalidAuthRequest(w http.ResponseWriter, err error) {
+	w.Header().Set(authChallengeHeader, authChallenge(errCodeInvalidRequest, err.Error(), ""))
+	WriteJSON(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Error: err.Error()})
+}
+
+func invalidToken(w http.ResponseWriter) {
+	w.Header().Set(authChallengeHeader, authChallenge(errCodeInvalidToken, "The access token is invalid or expired", ""))
+	WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidToken, Error: "Unauthorized"})
+}
+
+func insufficientScope(w http.ResponseWriter, p Permission) {
+	w.Header().Set(authChallengeHeader, authChallenge(errCodeInsufficientScope, "", string(p)))
+	forbidden(w)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBearerToken(t *testing.T) {
+	testCases := []struct {
+		name     string
+		header   []string
+		token    string
+		ok       bool
+		hasError bool
+	}{
+		{"No header", nil, "", false, false},
+		{"Bearer token", []string{"Bearer abc.def-ghi_jk~l+m/n=="}, "abc.def-ghi_jk~l+m/n==", true, false},
+		{"Scheme is case-insensitive", []string{"bearer abc"}, "abc", true, false},
+		{"Raw token", []string{"abc.def.ghi"}, "", false, true},
+		{"Other scheme", []string{"Basic dXNlcjpwYXNz"}, "", false, true},
+		{"Empty token", []string{"Bearer "}, "", false, true},
+		{"Token with spaces", []string{"Bearer abc def"}, "", false, true},
+		{"Padding in the middle", []string{"Bearer ab=c"}, "", false, true},
+		{"Multiple headers", []string{"Bearer abc", "Bearer def"}, "", false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			for _, v := range tc.header {
+				req.Header.Add("Authorization", v)
+			}
+
+			token, ok, err := bearerToken(req)
+			assert.Equal(t, tc.token, token)
+			assert.Equal(t, tc.ok, ok)
+			if tc.hasError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseTokenSources(t *testing.T) {
+	sources, err := parseTokenSources(" Cookie , header")
+	assert.NoError(t, err)
+	assert.Equal(t, []TokenSource{TokenSourceCookie, TokenSourceHeader}, sources)
+
+	_, err = parseTokenSources("header,header")
+	assert.Error(t, err)
+	_, err = parseTokenSources("query")
+	assert.Error(t, err)
+	_, err = parseTokenSources("")
+	assert.Error(t, err)
+
+	t.Setenv("AUTH_TOKEN_SOURCES", "bogus")
+	assert.Equal(t, []TokenSource{TokenSourceHeader, TokenSourceCookie}, authTokenSources())
+}
+
+func TestAuthTokenSources(t *testing.T) {
+	account := &Account{ID: 1, Email: "john@example.com", Role: RoleCustomer}
+	other := &Account{ID: 2, Email: "jane@example.com", Role: RoleCustomer}
+	token, err := createJWT(account, "session-1", nil)
+	assert.NoError(t, err)
+	otherToken, err := createJWT(other, "session-2", nil)
+	assert.NoError(t, err)
+
+	newStorage := func() *MockStorage {
+		mockStorage := new(MockStorage)
+		mockStorage.On("IsTokenRevoked", mock.Anything, mock.Anything).Return(false, nil)
+		mockStorage.On("UseSession", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		mockStorage.On("GetAccountByID", 1).Return(account, nil)
+		mockStorage.On("GetAccountByID", 2).Return(other, nil)
+		return mockStorage
+	}
+
+	var authenticated int
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		authCtx, _ := GetAuthContext(r.Context())
+		authenticated = authCtx.AccountID
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		authenticated = 0
+		rr := httptest.NewRecorder()
+		authWithJWT(ok, newStorage())(rr, req)
+		return rr
+	}
+
+	t.Run("Bearer header", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := serve(req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.Equal(t, 1, authenticated)
+	})
+
+	t.Run("Header wins over cookie by default", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.AddCookie(&http.Cookie{Name: "token", Value: otherToken})
+
+		rr := serve(req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.Equal(t, 1, authenticated)
+	})
+
+	t.Run("Policy order decides precedence", func(t *testing.T) {
+		t.Setenv("AUTH_TOKEN_SOURCES", "cookie,header")
+		req, _ := http.NewRequest("GET", "/account", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.AddCookie(&http.Cookie{Name: "token", Value: otherToken})
+
+		rr := serve(req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.Equal(t, 2, authenticated)
+	})
+
+	t.Run("Disabled source is ignored", func(t *testing.T) {
+		t.Setenv("AUTH_TOKEN_SOURCES", "header")
+		req, _ := http.NewRequest("GET", "/account", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+
+		rr := serve(req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, `Bearer realm="gomoni"`, rr.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("Malformed header", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account", nil)
+		req.Header.Set("Authorization", token)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+
+		rr := serve(req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="invalid_request"`)
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/account", nil)
+		req.Header.Set("Authorization", "Bearer not-a-jwt")
+
+		rr := serve(req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+	})
+
+	t.Run("Insufficient scope", func(t *testing.T) {
+		readOnly, err := createJWT(account, "session-1", []Permission{PermAccountsRead})
+		assert.NoError(t, err)
+		req, _ := http.NewRequest("POST", "/transfer", nil)
+		req.Header.Set("Authorization", "Bearer "+readOnly)
+		rr := httptest.NewRecorder()
+
+		authWithJWT(requirePermission(PermTransfersWrite, ok), newStorage())(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Equal(t, `Bearer realm="gomoni", error="insufficient_scope", scope="transfers:write"`, rr.Header().Get("WWW-Authenticate"))
+	})
+}
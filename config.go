@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// loadDotEnv reads the .env file into the environment. The file is optional,
+// since deployments may set the variables directly, but a file that exists
+// and cannot be read is an error.
+func loadDotEnv() error {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error loading .env file: %w", err)
+	}
+	return nil
+}
+
+// getEnvDuration reads a duration such as "24h" from the environment. It
+// falls back to def when the variable is unset or cannot be parsed.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using default %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// getEnvInt reads a positive integer from the environment. It falls back to
+// def when the variable is unset or cannot be parsed.
+func getEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s %q, using default %d", key, v, def)
+		return def
+	}
+	return n
+}
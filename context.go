@@ -2,22 +2,58 @@ package main
 
 import (
 	"context"
+	"time"
 )
 
 type AuthContext struct {
-	AccountID int
-	Email     string
+	AccountID     int
+	Email         string
+	Role          Role
+	EmailVerified bool
+	// SessionID identifies the login the token was issued for; refresh
+	// tokens and revocation are tracked per session.
+	SessionID      string
+	TokenID        string
+	TokenExpiresAt time.Time
+	// APIKeyID is set when the request was authenticated with an API key
+	// rather than a login.
+	APIKeyID int
+	// Scopes narrows what the role grants, for tokens issued with a scope
+	// and for API keys; nil means no restriction.
+	Scopes []Permission
+}
+
+// Can reports whether the caller's role grants permission p and, for scoped
+// credentials, whether p is among their scopes.
+func (a *AuthContext) Can(p Permission) bool {
+	if !a.Role.Can(p) {
+		return false
+	}
+	if a.Scopes == nil {
+		return true
+	}
+	for _, granted := range a.Scopes {
+		if granted == p {
+			return true
+		}
+	}
+	return false
 }
 
 type authContextKey struct{}
 
-func NewAuthContext(ctx context.Context, accountID int, email string) context.Context {
-	return context.WithValue(ctx, authContextKey{}, &AuthContext{
+func NewAuthContext(ctx context.Context, accountID int, email string, role Role) context.Context {
+	return WithAuthContext(ctx, &AuthContext{
 		AccountID: accountID,
 		Email:     email,
+		Role:      role,
 	})
 }
 
+func WithAuthContext(ctx context.Context, auth *AuthContext) context.Context {
+	return context.WithValue(ctx, authContextKey{}, auth)
+}
+
 func GetAuthContext(ctx context.Context) (*AuthContext, bool) {
 	auth, ok := ctx.Value(authContextKey{}).(*AuthContext)
 	return auth, ok
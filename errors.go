@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Kinds of errors that handlers can report to clients. Storage and domain
+// code wrap them in a DomainError with the details; makeHTTPHandleFunc maps
+// them to a status code and an error code. Any other error is internal.
+var (
+	ErrInvalidRequest    = errors.New("invalid request")
+	ErrNotFound          = errors.New("not found")
+	ErrConflict          = errors.New("conflict")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrValidation        = errors.New("validation failed")
+)
+
+// Error codes of APIError. They are part of the API and must not change.
+const (
+	errCodeNotFound              = "not_found"
+	errCodeConflict              = "conflict"
+	errCodeInsufficientFunds     = "insufficient_funds"
+	errCodeValidation            = "validation_failed"
+	errCodeInternal              = "internal_error"
+	errCodeUnauthorized          = "unauthorized"
+	errCodeForbidden             = "forbidden"
+	errCodeInvalidCredentials    = "invalid_credentials"
+	errCodeInvalidCode           = "invalid_code"
+	errCodeInvalidChallenge      = "invalid_challenge"
+	errCodeInvalidLink           = "invalid_link"
+	errCodeCSRF                  = "csrf_failed"
+	errCodeEmailNotVerified      = "email_not_verified"
+	errCodeSessionRequired       = "session_required"
+	errCodeStepUpRequired        = "step_up_required"
+	errCodeTooManyAttempts       = "too_many_attempts"
+	errCodeIdempotencyMismatch   = "idempotency_key_mismatch"
+	errCodeIdempotencyInProgress = "idempotency_key_in_progress"
+)
+
+// DomainError is an error of one of the kinds above whose message is safe to
+// show to clients.
+type DomainError struct {
+	Kind    error
+	Message string
+}
+
+func (e *DomainError) Error() string {
+	return e.Message
+}
+
+func (e *DomainError) Unwrap() error {
+	return e.Kind
+}
+
+func invalidRequestError(format string, args ...any) error {
+	return &DomainError{Kind: ErrInvalidRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+func notFoundError(format string, args ...any) error {
+	return &DomainError{Kind: ErrNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func conflictError(format string, args ...any) error {
+	return &DomainError{Kind: ErrConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+func validationError(format string, args ...any) error {
+	return &DomainError{Kind: ErrValidation, Message: fmt.Sprintf(format, args...)}
+}
+
+var errorKinds = []struct {
+	kind   error
+	status int
+	code   string
+}{
+	{ErrInvalidRequest, http.StatusBadRequest, errCodeInvalidRequest},
+	{ErrNotFound, http.StatusNotFound, errCodeNotFound},
+	{ErrConflict, http.StatusConflict, errCodeConflict},
+	{ErrInsufficientFunds, http.StatusUnprocessableEntity, errCodeInsufficientFunds},
+	{ErrValidation, http.StatusUnprocessableEntity, errCodeValidation},
+}
+
+// writeError responds with the status and code of err's kind. Errors of no
+// known kind are logged and reported without details, so that database
+// messages never reach clients.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	for _, k := range errorKinds {
+		if !errors.Is(err, k.kind) {
+			continue
+		}
+
+		message := k.kind.Error()
+		var de *DomainError
+		if errors.As(err, &de) {
+			message = de.Message
+		}
+		WriteJSON(w, k.status, APIError{Code: k.code, Error: message})
+		return
+	}
+
+	log.Printf("Error handling %s %s: %v", r.Method, r.URL.Path, err)
+	WriteJSON(w, http.StatusInternalServerError, APIError{Code: errCodeInternal, Error: "Internal server error"})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWriteError(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{"Invalid request", invalidRequestError("invalid ID: abc"), http.StatusBadRequest, errCodeInvalidRequest, "invalid ID: abc"},
+		{"Not found", notFoundError("account %d not found", 7), http.StatusNotFound, errCodeNotFound, "account 7 not found"},
+		{"Conflict", conflictError("email %s is already registered", "john@example.com"), http.StatusConflict, errCodeConflict, "email john@example.com is already registered"},
+		{"Insufficient funds", ErrInsufficientFunds, http.StatusUnprocessableEntity, errCodeInsufficientFunds, "insufficient funds"},
+		{"Validation", validationError("invalid email address"), http.StatusUnprocessableEntity, errCodeValidation, "invalid email address"},
+		{"Wrapped", fmt.Errorf("error updating account: %w", notFoundError("account 7 not found")), http.StatusNotFound, errCodeNotFound, "account 7 not found"},
+		{"Internal", fmt.Errorf(`pq: relation "account" does not exist`), http.StatusInternalServerError, errCodeInternal, "Internal server error"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			rr := httptest.NewRecorder()
+
+			writeError(rr, req, tc.err)
+
+			assert.Equal(t, tc.status, rr.Code)
+			var apiErr APIError
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &apiErr))
+			assert.Equal(t, APIError{Code: tc.code, Error: tc.message}, apiErr)
+		})
+	}
+}
+
+func TestHandlerErrorStatus(t *testing.T) {
+	transfer := func(mockStorage *MockStorage, body string) *httptest.ResponseRecorder {
+		server := NewAPIServer(":8080", mockStorage, &MemoryMailer{})
+		req, _ := http.NewRequest("POST", "/transfer", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		makeHTTPHandleFunc(server.handleTransfer, true)(rr, withAuth(req, 1))
+		return rr
+	}
+
+	t.Run("Malformed body", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+
+		rr := transfer(mockStorage, `{"fromAccount":`)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"code":"invalid_request"`)
+	})
+
+	t.Run("Insufficient funds", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("Transfer", mock.Anything, 1, 2, int64(500)).Return(ErrInsufficientFunds)
+
+		rr := transfer(mockStorage, `{"fromAccount":1,"toAccount":2,"amount":500}`)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"code":"insufficient_funds"`)
+	})
+
+	t.Run("Unknown recipient", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("Transfer", mock.Anything, 1, 9, int64(5)).Return(notFoundError("account 9 not found"))
+
+		rr := transfer(mockStorage, `{"fromAccount":1,"toAccount":9,"amount":5}`)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.Contains(t, rr.Body.String(), "account 9 not found")
+	})
+
+	t.Run("Database failure is not leaked", func(t *testing.T) {
+		mockStorage := new(MockStorage)
+		mockStorage.On("Transfer", mock.Anything, 1, 2, int64(5)).Return(fmt.Errorf("pq: connection refused"))
+
+		rr := transfer(mockStorage, `{"fromAccount":1,"toAccount":2,"amount":5}`)
+
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"code":"internal_error"`)
+		assert.NotContains(t, rr.Body.String(), "pq:")
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	hashAlgorithmArgon2id = "argon2id"
+	hashAlgorithmBcrypt   = "bcrypt"
+
+	// Defaults follow the OWASP recommendation for argon2id.
+	defaultArgon2Memory      = 19 * 1024 // KiB
+	defaultArgon2Iterations  = 2
+	defaultArgon2Parallelism = 1
+	argon2SaltLength         = 16
+	argon2KeyLength          = 32
+)
+
+// PasswordHasher turns passwords into self-describing hashes and checks them.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password.
+	Hash(password string) (string, error)
+	// Verify reports whether password matches the encoded hash.
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded was made with another algorithm
+	// or other parameters than Hash uses now.
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2Params are the cost parameters of argon2id. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// PasswordHashPolicy hashes new passwords with Algorithm and verifies hashes
+// of every supported algorithm, so the algorithm and its parameters can be
+// changed without locking anyone out. argon2id hashes are stored in the PHC
+// string format, e.g. "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>"; bcrypt
+// hashes keep their own "$2a$<cost>$..." format.
+type PasswordHashPolicy struct {
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+// currentPasswordHasher reads the hashing policy from the environment:
+// PASSWORD_HASH_ALGORITHM (argon2id or bcrypt), ARGON2_MEMORY in KiB,
+// ARGON2_ITERATIONS, ARGON2_PARALLELISM and BCRYPT_COST.
+func currentPasswordHasher() PasswordHasher {
+	policy := &PasswordHashPolicy{
+		Algorithm: hashAlgorithmArgon2id,
+		Argon2: Argon2Params{
+			Memory:     uint32(getEnvInt("ARGON2_MEMORY", defaultArgon2Memory)),
+			Iterations: uint32(getEnvInt("ARGON2_ITERATIONS", defaultArgon2Iterations)),
+		},
+		BcryptCost: getEnvInt("BCRYPT_COST", bcrypt.DefaultCost),
+	}
+
+	switch alg := strings.ToLower(os.Getenv("PASSWORD_HASH_ALGORITHM")); alg {
+	case "", hashAlgorithmArgon2id:
+	case hashAlgorithmBcrypt:
+		policy.Algorithm = hashAlgorithmBcrypt
+	default:
+		log.Printf("Invalid PASSWORD_HASH_ALGORITHM %q, using default %s", alg, hashAlgorithmArgon2id)
+	}
+
+	parallelism := getEnvInt("ARGON2_PARALLELISM", defaultArgon2Parallelism)
+	if parallelism > 255 {
+		log.Printf("Invalid ARGON2_PARALLELISM %d, using default %d", parallelism, defaultArgon2Parallelism)
+		parallelism = defaultArgon2Parallelism
+	}
+	policy.Argon2.Parallelism = uint8(parallelism)
+
+	if policy.BcryptCost < bcrypt.MinCost || policy.BcryptCost > bcrypt.MaxCost {
+		log.Printf("Invalid BCRYPT_COST %d, using default %d", policy.BcryptCost, bcrypt.DefaultCost)
+		policy.BcryptCost = bcrypt.DefaultCost
+	}
+
+	return policy
+}
+
+func (p *PasswordHashPolicy) Hash(password string) (string, error) {
+	if p.Algorithm == hashAlgorithmBcrypt {
+		enpw, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(enpw), nil
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Argon2.Iterations, p.Argon2.Memory, p.Argon2.Parallelism, argon2KeyLength)
+
+	return formatArgon2Hash(p.Argon2, salt, key), nil
+}
+
+func (p *PasswordHashPolicy) Verify(password, encoded string) (bool, error) {
+	if isBcryptHash(encoded) {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	params, salt, key, err := parseArgon2Hash(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (p *PasswordHashPolicy) NeedsRehash(encoded string) bool {
+	if p.Algorithm == hashAlgorithmBcrypt {
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost != p.BcryptCost
+	}
+
+	params, _, key, err := parseArgon2Hash(encoded)
+	return err != nil || params != p.Argon2 || len(key) != argon2KeyLength
+}
+
+func isBcryptHash(encoded string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(encoded, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatArgon2Hash(params Argon2Params, salt, key []byte) string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		hashAlgorithmArgon2id, argon2.Version,
+		params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+// parseArgon2Hash splits a PHC string made by formatArgon2Hash.
+func parseArgon2Hash(encoded string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != hashAlgorithmArgon2id {
+		return params, nil, nil, fmt.Errorf("unsupported password hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+	if params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2 hash")
+	}
+
+	return params, salt, key, nil
+}
+
+// dummyPasswordHash is checked instead of a stored hash when a login names an
+// unknown email, so that the attempt costs as much as a real one.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := currentPasswordHasher().Hash("no password matches this hash")
+	if err != nil {
+		log.Printf("Error creating dummy password hash: %v", err)
+	}
+	return hash
+})
+
+// rehashPassword upgrades the stored hash of acc to the current algorithm and
+// parameters after password has been verified. Failures only mean the old
+// hash is kept until the next login.
+func (s *APIServer) rehashPassword(ctx context.Context, hasher PasswordHasher, acc *Account, password string) {
+	if !hasher.NeedsRehash(acc.EncryptedPassword) {
+		return
+	}
+
+	enpw, err := hasher.Hash(password)
+	if err != nil {
+		log.Printf("Error rehashing password of account %d: %v", acc.ID, err)
+		return
+	}
+	if err := s.store.UpdatePassword(ctx, acc.ID, enpw); err != nil {
+		log.Printf("Error storing rehashed password of account %d: %v", acc.ID, err)
+	}
+}
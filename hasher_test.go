@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashPolicy(t *testing.T) {
+	argon := &PasswordHashPolicy{
+		Algorithm:  hashAlgorithmArgon2id,
+		Argon2:     Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1},
+		BcryptCost: bcrypt.MinCost,
+	}
+	bcryptPolicy := &PasswordHashPolicy{
+		Algorithm:  hashAlgorithmBcrypt,
+		Argon2:     argon.Argon2,
+		BcryptCost: bcrypt.MinCost,
+	}
+
+	t.Run("argon2id hashes are PHC strings", func(t *testing.T) {
+		hash, err := argon.Hash("password123")
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"), hash)
+
+		other, err := argon.Hash("password123")
+		assert.NoError(t, err)
+		assert.NotEqual(t, hash, other, "salts must differ")
+
+		ok, err := argon.Verify("password123", hash)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = argon.Verify("password124", hash)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		assert.False(t, argon.NeedsRehash(hash))
+	})
+
+	t.Run("Both algorithms verify", func(t *testing.T) {
+		hash, err := bcryptPolicy.Hash("password123")
+		assert.NoError(t, err)
+
+		ok, err := argon.Verify("password123", hash)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.True(t, argon.NeedsRehash(hash))
+		assert.False(t, bcryptPolicy.NeedsRehash(hash))
+
+		argonHash, err := argon.Hash("password123")
+		assert.NoError(t, err)
+		ok, err = bcryptPolicy.Verify("password123", argonHash)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.True(t, bcryptPolicy.NeedsRehash(argonHash))
+	})
+
+	t.Run("Changed parameters need a rehash", func(t *testing.T) {
+		hash, err := argon.Hash("password123")
+		assert.NoError(t, err)
+
+		stronger := *argon
+		stronger.Argon2.Memory = 2048
+		assert.True(t, stronger.NeedsRehash(hash))
+
+		costlier := *bcryptPolicy
+		costlier.BcryptCost = bcrypt.MinCost + 1
+		bcryptHash, err := bcryptPolicy.Hash("password123")
+		assert.NoError(t, err)
+		assert.True(t, costlier.NeedsRehash(bcryptHash))
+	})
+
+	t.Run("Malformed hashes are errors", func(t *testing.T) {
+		for _, hash := range []string{
+			"",
+			"plaintext",
+			"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA",
+			"$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$aGFzaA",
+			"$argon2id$v=19$m=0,t=1,p=1$c2FsdA$aGFzaA",
+			"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+		} {
+			ok, err := argon.Verify("password123", hash)
+			assert.Error(t, err, hash)
+			assert.False(t, ok)
+		}
+	})
+}
+
+func TestCurrentPasswordHasher(t *testing.T) {
+	policy := currentPasswordHasher().(*PasswordHashPolicy)
+	assert.Equal(t, hashAlgorithmArgon2id, policy.Algorithm)
+	assert.Equal(t, Argon2Params{Memory: defaultArgon2Memory, Iterations: defaultArgon2Iterations, Parallelism: defaultArgon2Parallelism}, policy.Argon2)
+
+	t.Setenv("PASSWORD_HASH_ALGORITHM", "bcrypt")
+	t.Setenv("BCRYPT_COST", "12")
+	t.Setenv("ARGON2_PARALLELISM", "1000")
+	policy = currentPasswordHasher().(*PasswordHashPolicy)
+	assert.Equal(t, hashAlgorithmBcrypt, policy.Algorithm)
+	assert.Equal(t, 12, policy.BcryptCost)
+	assert.Equal(t, uint8(defaultArgon2Parallelism), policy.Argon2.Parallelism)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotencyKeyMaxLength = 255
+	defaultIdempotencyTTL   = 24 * time.Hour
+)
+
+// withIdempotency makes a state-changing handler safe to retry. When the
+// request carries an Idempotency-Key header, the first response for that key
+// is stored and replayed to every retry with the same method, path and body.
+// Keys are scoped to the authenticated account and expire after ttl.
+func withIdempotency(f http.HandlerFunc, store Storage, ttl time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			f(w, r)
+			return
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			WriteJSON(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Error: "Idempotency-Key is too long"})
+			return
+		}
+
+		authCtx, ok := GetAuthContext(r.Context())
+		if !ok {
+			unauthorized(w)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Error: err.Error()})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now().UTC()
+		record := &IdempotencyRecord{
+			AccountID:   authCtx.AccountID,
+			Key:         key,
+			Fingerprint: requestFingerprint(r, body),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(ttl),
+		}
+
+		existing, err := store.ReserveIdempotencyKey(r.Context(), record)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != record.Fingerprint:
+				WriteJSON(w, http.StatusUnprocessableEntity, APIError{Code: errCodeIdempotencyMismatch, Error: "Idempotency-Key was already used for a different request"})
+			case existing.StatusCode == 0:
+				WriteJSON(w, http.StatusConflict, APIError{Code: errCodeIdempotencyInProgress, Error: "A request with this Idempotency-Key is still in progress"})
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.StatusCode)
+				w.Write(existing.Response)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		f(rec, r)
+
+		// The outcome must be saved even if the client has gone away.
+		ctx := context.WithoutCancel(r.Context())
+
+		if rec.status >= http.StatusInternalServerError {
+			// Let the client retry requests that failed on our side.
+			if err := store.ReleaseIdempotencyKey(ctx, record.AccountID, record.Key); err != nil {
+				log.Printf("Error releasing idempotency key: %v", err)
+			}
+			return
+		}
+
+		record.StatusCode = rec.status
+		record.Response = rec.body.Bytes()
+		if err := store.CompleteIdempotencyKey(ctx, record); err != nil {
+			log.Printf("Error saving idempotent response: %v", err)
+		}
+	}
+}
+
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of its
+// status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	minRSAKeyBits     = 2048
+	minHMACSecretSize = 32
+)
+
+// jwtKeys holds the keys loaded at startup. No token is signed or accepted
+// until it is set.
+var jwtKeys *KeySet
+
+// signingKey is a single key that can sign and verify tokens. HS256 keys use
+// the same secret for both; RS256 and EdDSA keys publish Verify in the JWKS.
+type signingKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	Sign   any
+	Verify any
+}
+
+// KeySet is the ordered list of active signing keys. The first key signs new
+// tokens and every key is accepted for verification, so a key can be rotated
+// out by moving a new one to the front and dropping the old one once the
+// tokens it signed have expired.
+type KeySet struct {
+	keys []*signingKey
+}
+
+func currentKeySet() (*KeySet, error) {
+	if jwtKeys == nil {
+		return nil, fmt.Errorf("no JWT signing keys loaded")
+	}
+	return jwtKeys, nil
+}
+
+func hmacKeySet(secret string) *KeySet {
+	return &KeySet{keys: []*signingKey{{
+		Method: jwt.SigningMethodHS256,
+		Sign:   []byte(secret),
+		Verify: []byte(secret),
+	}}}
+}
+
+// loadKeySetFromEnv reads the comma-separated PEM files in JWT_SIGNING_KEYS.
+// When the variable is unset, it falls back to HS256 with JWT_SECRET, which
+// must be at least 32 bytes long: an empty or short secret would let anyone
+// forge tokens.
+func loadKeySetFromEnv() (*KeySet, error) {
+	paths := os.Getenv("JWT_SIGNING_KEYS")
+	if paths == "" {
+		secret := os.Getenv("JWT_SECRET")
+		if len(secret) < minHMACSecretSize {
+			return nil, fmt.Errorf("JWT_SECRET must be at least %d bytes long when JWT_SIGNING_KEYS is not set", minHMACSecretSize)
+		}
+		return hmacKeySet(secret), nil
+	}
+
+	ks := &KeySet{}
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return nil, fmt.Errorf("error reading signing key: %v", err)
+		}
+
+		key, err := parseSigningKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing signing key %s: %v", path, err)
+		}
+		if ks.lookup(key.ID) != nil {
+			return nil, fmt.Errorf("signing key %s is listed twice", path)
+		}
+		ks.keys = append(ks.keys, key)
+	}
+
+	if len(ks.keys) == 0 {
+		return nil, fmt.Errorf("JWT_SIGNING_KEYS does not name any key")
+	}
+	return ks, nil
+}
+
+// parseSigningKey reads an RSA or Ed25519 private key in PEM format. The key
+// ID is the RFC 7638 thumbprint of its public key.
+func parseSigningKey(data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var privateKey any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{Sign: privateKey}
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key must have at least %d bits", minRSAKeyBits)
+		}
+		key.Method = jwt.SigningMethodRS256
+		key.Verify = &k.PublicKey
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.Verify = k.Public()
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", privateKey)
+	}
+
+	jwk, err := key.JWK()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = jwk.thumbprint()
+	return key, nil
+}
+
+func (ks *KeySet) lookup(kid string) *signingKey {
+	for _, k := range ks.keys {
+		if k.ID == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+// Sign signs claims with the first key of the set.
+func (ks *KeySet) Sign(claims jwt.MapClaims) (string, error) {
+	key := ks.keys[0]
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.Sign)
+}
+
+// Keyfunc finds the key named by the token's kid header. The token's alg must
+// match the key, so an RS256 public key can never be used as an HMAC secret.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := ks.lookup(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key: %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Verify, nil
+}
+
+// JWKS returns the public keys of the set. HMAC secrets are never published.
+func (ks *KeySet) JWKS() *JWKSet {
+	set := &JWKSet{Keys: []*JWK{}}
+	for _, k := range ks.keys {
+		jwk, err := k.JWK()
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// JWK describes the public half of an asymmetric key.
+func (k *signingKey) JWK() (*JWK, error) {
+	jwk := &JWK{KeyID: k.ID, Use: "sig", Alg: k.Method.Alg()}
+
+	switch pub := k.Verify.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return nil, fmt.Errorf("key has no public JWK form")
+	}
+	return jwk, nil
+}
+
+// thumbprint computes the RFC 7638 thumbprint from the required members of
+// the JWK in lexicographic order.
+func (jwk *JWK) thumbprint() string {
+	var members string
+	switch jwk.KeyType {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, jwk.Curve, jwk.X)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (s *APIServer) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	ks, err := currentKeySet()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(ks.JWKS())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKeyFile(t *testing.T, key any) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	assert.NoError(t, err)
+	return path
+}
+
+func useKeySet(t *testing.T, paths ...string) *KeySet {
+	t.Setenv("JWT_SIGNING_KEYS", strings.Join(paths, ","))
+	ks, err := loadKeySetFromEnv()
+	assert.NoError(t, err)
+
+	useKeys(t, ks)
+	return ks
+}
+
+// useKeys makes ks the active key set until the test ends.
+func useKeys(t *testing.T, ks *KeySet) {
+	prev := jwtKeys
+	jwtKeys = ks
+	t.Cleanup(func() { jwtKeys = prev })
+}
+
+func TestKeySet(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	edPath := writeKeyFile(t, edKey)
+	rsaPath := writeKeyFile(t, rsaKey)
+	account := &Account{ID: 1, Email: "john@example.com", Role: RoleCustomer}
+
+	t.Run("HS256 without signing keys", func(t *testing.T) {
+		t.Setenv("JWT_SECRET", testJWTSecret)
+		t.Setenv("JWT_SIGNING_KEYS", "")
+
+		ks, err := loadKeySetFromEnv()
+		assert.NoError(t, err)
+		assert.Empty(t, ks.JWKS().Keys)
+		useKeys(t, ks)
+
+		token, err := createJWT(account, "session-1", nil)
+		assert.NoError(t, err)
+		parsed, err := validateJWT(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "HS256", parsed.Method.Alg())
+	})
+
+	t.Run("First key signs with its kid", func(t *testing.T) {
+		ks := useKeySet(t, edPath, rsaPath)
+
+		token, err := createJWT(account, "session-1", nil)
+		assert.NoError(t, err)
+
+		parsed, err := validateJWT(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "EdDSA", parsed.Method.Alg())
+		assert.Equal(t, ks.keys[0].ID, parsed.Header["kid"])
+	})
+
+	t.Run("Tokens from a rotated key stay valid", func(t *testing.T) {
+		useKeySet(t, rsaPath)
+		token, err := createJWT(account, "session-1", nil)
+		assert.NoError(t, err)
+
+		useKeySet(t, edPath, rsaPath)
+		parsed, err := validateJWT(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "RS256", parsed.Method.Alg())
+
+		useKeySet(t, edPath)
+		_, err = validateJWT(token)
+		assert.Error(t, err)
+	})
+
+	t.Run("HMAC token is rejected when asymmetric keys are configured", func(t *testing.T) {
+		ks := useKeySet(t, rsaPath)
+
+		forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": 1, "typ": tokenTypeAccess})
+		forged.Header["kid"] = ks.keys[0].ID
+		token, err := forged.SignedString([]byte("guessed-secret"))
+		assert.NoError(t, err)
+
+		_, err = validateJWT(token)
+		assert.Error(t, err)
+	})
+
+	t.Run("Empty or short HMAC secrets are refused", func(t *testing.T) {
+		t.Setenv("JWT_SIGNING_KEYS", "")
+		for _, secret := range []string{"", "test-secret", testJWTSecret[:minHMACSecretSize-1]} {
+			t.Setenv("JWT_SECRET", secret)
+			_, err := loadKeySetFromEnv()
+			assert.Error(t, err, "secret %q", secret)
+		}
+	})
+
+	t.Run("No tokens without loaded keys", func(t *testing.T) {
+		useKeys(t, nil)
+		t.Setenv("JWT_SECRET", "")
+
+		_, err := createJWT(account, "session-1", nil)
+		assert.Error(t, err)
+
+		forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": 1, "typ": tokenTypeAccess}).SignedString([]byte(""))
+		assert.NoError(t, err)
+		_, err = validateJWT(forged)
+		assert.Error(t, err)
+	})
+
+	t.Run("Small RSA keys are refused", func(t *testing.T) {
+		weak, err := rsa.GenerateKey(rand.Reader, 1024)
+		assert.NoError(t, err)
+
+		t.Setenv("JWT_SIGNING_KEYS", writeKeyFile(t, weak))
+		_, err = loadKeySetFromEnv()
+		assert.Error(t, err)
+	})
+}
+
+func TestHandleJWKS(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	ks := useKeySet(t, writeKeyFile(t, edKey), writeKeyFile(t, rsaKey))
+	server := NewAPIServer(":8080", new(MockStorage), &MemoryMailer{})
+
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	rr := httptest.NewRecorder()
+
+	makeHTTPHandleFunc(server.handleJWKS, false)(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var set JWKSet
+	err = json.NewDecoder(rr.Body).Decode(&set)
+	assert.NoError(t, err)
+	assert.Len(t, set.Keys, 2)
+
+	assert.Equal(t, "OKP", set.Keys[0].KeyType)
+	assert.Equal(t, "Ed25519", set.Keys[0].Curve)
+	assert.Equal(t, ks.keys[0].ID, set.Keys[0].KeyID)
+	assert.NotEmpty(t, set.Keys[0].X)
+
+	assert.Equal(t, "RSA", set.Keys[1].KeyType)
+	assert.Equal(t, "RS256", set.Keys[1].Alg)
+	assert.Equal(t, "AQAB", set.Keys[1].E)
+	assert.NotEmpty(t, set.Keys[1].N)
+}
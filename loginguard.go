@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LoginEventSucceeded = "login_succeeded"
+	LoginEventFailed    = "login_failed"
+	LoginEventMFAFailed = "2fa_failed"
+	LoginEventThrottled = "login_throttled"
+	LoginEventLocked    = "account_locked"
+	LoginEventUnlocked  = "account_unlocked"
+
+	LoginEventResetRequested = "password_reset_requested"
+)
+
+// LoginPolicy controls how failed logins slow down and lock out further
+// attempts.
+type LoginPolicy struct {
+	// FreeAttempts is the number of consecutive failures allowed before
+	// each further attempt has to wait, doubling from one second up to
+	// MaxDelay.
+	FreeAttempts int
+	MaxDelay     time.Duration
+	// After LockoutThreshold consecutive failures the account is locked for
+	// LockoutDuration, or until an admin unlocks it.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// A client IP with IPMaxFailures failures within IPWindow is refused
+	// until the window moves on.
+	IPMaxFailures int
+	IPWindow      time.Duration
+	// Password reset links are mailed at most ResetMaxPerEmail times per
+	// email and ResetMaxPerIP times per client IP within ResetWindow, so
+	// that nobody can flood an inbox.
+	ResetMaxPerEmail int
+	ResetMaxPerIP    int
+	ResetWindow      time.Duration
+}
+
+func loginPolicyFromEnv() *LoginPolicy {
+	return &LoginPolicy{
+		FreeAttempts:     getEnvInt("LOGIN_FREE_ATTEMPTS", 3),
+		MaxDelay:         getEnvDuration("LOGIN_MAX_DELAY", time.Minute),
+		LockoutThreshold: getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 10),
+		LockoutDuration:  getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		IPMaxFailures:    getEnvInt("LOGIN_IP_MAX_FAILURES", 50),
+		IPWindow:         getEnvDuration("LOGIN_IP_WINDOW", 15*time.Minute),
+		ResetMaxPerEmail: getEnvInt("PASSWORD_RESET_MAX_PER_EMAIL", 3),
+		ResetMaxPerIP:    getEnvInt("PASSWORD_RESET_MAX_PER_IP", 20),
+		ResetWindow:      getEnvDuration("PASSWORD_RESET_WINDOW", time.Hour),
+	}
+}
+
+// RetryAfter returns how long the account has to wait before it may try to
+// log in again, or zero if it may try now.
+func (p *LoginPolicy) RetryAfter(t *LoginThrottle, now time.Time) time.Duration {
+	if t.LockedUntil != nil && t.LockedUntil.After(now) {
+		return t.LockedUntil.Sub(now)
+	}
+	if t.Failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.MaxDelay
+	if exp := t.Failures - p.FreeAttempts - 1; exp < 16 {
+		if d := time.Second << exp; d < delay {
+			delay = d
+		}
+	}
+	if wait := t.LastFailureAt.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// trusted when TRUST_PROXY is set, since clients can send anything in it.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// reserveLoginAttempt reports whether a login attempt with email from the
+// client must be refused, and for how long. An attempt that may go ahead is
+// counted as a failure before the credentials are checked, so that parallel
+// requests cannot all slip through; recordLoginSuccess clears the count.
+// Unknown emails are throttled the same way, so that the responses do not
+// tell which emails are registered.
+func (s *APIServer) reserveLoginAttempt(r *http.Request, email string) (*LoginThrottle, time.Duration, error) {
+	now := time.Now().UTC()
+
+	failures, err := s.store.CountLoginFailuresByIP(r.Context(), clientIP(r), now.Add(-s.loginPolicy.IPWindow))
+	if err != nil {
+		return nil, 0, err
+	}
+	if failures >= s.loginPolicy.IPMaxFailures {
+		return nil, s.loginPolicy.IPWindow, nil
+	}
+
+	// Counters idle for longer than a lockout lasts are forgotten.
+	staleBefore := now.Add(-s.loginPolicy.LockoutDuration)
+	return s.store.ReserveLoginAttempt(r.Context(), email, now, staleBefore, func(t *LoginThrottle) time.Duration {
+		return s.loginPolicy.RetryAfter(t, now)
+	})
+}
+
+// recordLoginEvent keeps an audit trail for support. A failure to write it
+// must not break the login itself.
+func (s *APIServer) recordLoginEvent(r *http.Request, acc *Account, email, event string) {
+	e := &LoginEvent{
+		Email:     email,
+		IP:        clientIP(r),
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+	}
+	if acc != nil {
+		e.AccountID = acc.ID
+		e.Email = acc.Email
+	}
+
+	if err := s.store.RecordLoginEvent(r.Context(), e); err != nil {
+		log.Printf("Error recording login event: %v", err)
+	}
+}
+
+// recordLoginFailure logs a failed attempt, which reserveLoginAttempt has
+// already counted in throttle, and locks the email once the policy's
+// threshold is reached.
+func (s *APIServer) recordLoginFailure(r *http.Request, acc *Account, email, event string, throttle *LoginThrottle) error {
+	s.recordLoginEvent(r, acc, email, event)
+
+	if throttle.Failures >= s.loginPolicy.LockoutThreshold {
+		until := time.Now().UTC().Add(s.loginPolicy.LockoutDuration)
+		if err := s.store.LockLogin(r.Context(), email, until); err != nil {
+			return err
+		}
+		s.recordLoginEvent(r, acc, email, LoginEventLocked)
+	}
+	return nil
+}
+
+func (s *APIServer) recordLoginSuccess(r *http.Request, acc *Account) error {
+	s.recordLoginEvent(r, acc, acc.Email, LoginEventSucceeded)
+	return s.store.ResetLoginThrottle(r.Context(), acc.Email)
+}
+
+func tooManyAttempts(w http.ResponseWriter, retryAfter time.Duration) error {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return WriteJSON(w, http.StatusTooManyRequests, APIError{Code: errCodeTooManyAttempts, Error: "Too many failed login attempts, try again later"})
+}
+
+// handleUnlockAccount lets an admin lift a lockout before it expires.
+func (s *APIServer) handleUnlockAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	acc, err := s.store.GetAccountByID(id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.ResetLoginThrottle(r.Context(), acc.Email); err != nil {
+		return err
+	}
+	s.recordLoginEvent(r, acc, acc.Email, LoginEventUnlocked)
+
+	return WriteJSON(w, http.StatusOK, map[string]int{"unlocked": id})
+}
+
+// handleGetLoginEvents shows support the recent login activity of an
+// account, newest first.
+func (s *APIServer) handleGetLoginEvents(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return invalidRequestError("invalid limit: must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	events, err := s.store.GetLoginEvents(r.Context(), id, limit)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, events)
+}
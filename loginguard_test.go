@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginPolicyRetryAfter(t *testing.T) {
+	policy := &LoginPolicy{
+		FreeAttempts:     3,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  15 * time.Minute,
+	}
+	now := time.Now().UTC()
+
+	testCases := []struct {
+		name     string
+		failures int
+		expected time.Duration
+	}{
+		{"No failures", 0, 0},
+		{"Within free attempts", 3, 0},
+		{"First delay", 4, time.Second},
+		{"Delay doubles", 6, 4 * time.Second},
+		{"Delay is capped", 30, time.Minute},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			throttle := &LoginThrottle{Failures: tc.failures, LastFailureAt: now}
+			assert.Equal(t, tc.expected, policy.RetryAfter(throttle, now))
+		})
+	}
+
+	t.Run("Delay has passed", func(t *testing.T) {
+		throttle := &LoginThrottle{Failures: 4, LastFailureAt: now.Add(-2 * time.Second)}
+		assert.Equal(t, time.Duration(0), policy.RetryAfter(throttle, now))
+	})
+
+	t.Run("Locked account", func(t *testing.T) {
+		lockedUntil := now.Add(10 * time.Minute)
+		throttle := &LoginThrottle{Failures: 1, LastFailureAt: now, LockedUntil: &lockedUntil}
+		assert.Equal(t, 10*time.Minute, policy.RetryAfter(throttle, now))
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/login", nil)
+	req.RemoteAddr = "198.51.100.4:40000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.1")
+
+	assert.Equal(t, "198.51.100.4", clientIP(req))
+
+	t.Setenv("TRUST_PROXY", "true")
+	assert.Equal(t, "203.0.113.9", clientIP(req))
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // func seedAccount(store Storage) error {
@@ -16,17 +22,130 @@ import (
 // 	return store.DropTable()
 // }
 
-func main() {
-	store, err := NewPostgresStore()
-	if err != nil {
-		log.Fatalf("Error connecting to the database: %v", err)
+// openStore returns the store named by the scheme of DB_URL:
+// "sqlite://path" opens a SQLite file, "memory://" keeps all data in process
+// memory, which is lost on restart, and anything else is a Postgres
+// connection string.
+func openStore() (Storage, error) {
+	if err := loadDotEnv(); err != nil {
+		return nil, err
+	}
+
+	var store interface {
+		Storage
+		Init() error
+	}
+
+	switch dbURL := os.Getenv("DB_URL"); {
+	case strings.HasPrefix(dbURL, "memory:"):
+		log.Println("Using in-memory storage, data will be lost on restart")
+		return NewMemoryStore(), nil
+	case strings.HasPrefix(dbURL, "sqlite:"):
+		sqliteStore, err := NewSQLiteStore(dbURL)
+		if err != nil {
+			return nil, fmt.Errorf("error opening the SQLite database: %w", err)
+		}
+		store = sqliteStore
+	default:
+		pgStore, err := NewPostgresStore()
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to the database: %w", err)
+		}
+		store = pgStore
 	}
 	log.Println("Successfully connected to the database")
 
 	if err := store.Init(); err != nil {
-		log.Fatalf("Error initializing the database: %v", err)
+		return nil, fmt.Errorf("error initializing the database: %w", err)
 	}
 	log.Println("Successfully initialized the database")
+	return store, nil
+}
+
+// runMigrate implements "gomoni migrate up|down [steps]|status" for the
+// Postgres database named by DB_URL. SQLite and in-memory stores create
+// their schema on startup and have no versioned migrations.
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: gomoni migrate up|down [steps]|status")
+	}
+
+	if err := loadDotEnv(); err != nil {
+		return err
+	}
+	if dbURL := os.Getenv("DB_URL"); strings.HasPrefix(dbURL, "sqlite:") || strings.HasPrefix(dbURL, "memory:") {
+		scheme, _, _ := strings.Cut(dbURL, ":")
+		return fmt.Errorf("migrate only applies to Postgres, DB_URL uses %s, whose schema is created on startup", scheme)
+	}
+
+	store, err := NewPostgresStore()
+	if err != nil {
+		return fmt.Errorf("error connecting to the database: %w", err)
+	}
+	migrator := NewMigrator(store.db, postgresMigrations)
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		n, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("Applied %d migrations", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		n, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		log.Printf("Reverted %d migrations", n)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, st := range statuses {
+			applied := "pending"
+			if st.AppliedAt != nil {
+				applied = "applied " + st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%3d  %-30s %s\n", st.Version, st.Name, applied)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	store, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report, err := store.CheckLedger(context.Background())
+	if err != nil {
+		log.Fatalf("Error checking the ledger: %v", err)
+	}
+	for _, m := range report.Mismatches {
+		log.Printf("Ledger mismatch: account %d has balance %d but postings sum to %d", m.AccountID, m.Balance, m.LedgerBalance)
+	}
+	for _, id := range report.UnbalancedEntries {
+		log.Printf("Ledger mismatch: journal entry %d does not balance", id)
+	}
 
 	// if err := dropDatabase(store); err != nil {
 	// 	log.Fatalf("Error dropping the database: %v", err)
@@ -38,6 +157,12 @@ func main() {
 	// }
 	// log.Println("Successfully seeded the database")
 
-	server := NewAPIServer(":8008", store)
+	keys, err := loadKeySetFromEnv()
+	if err != nil {
+		log.Fatalf("Error loading JWT signing keys: %v", err)
+	}
+	jwtKeys = keys
+
+	server := NewAPIServer(":8008", store, mailerFromEnv())
 	server.Run()
 }
@@ -0,0 +1,981 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Storage that keeps everything in process memory, for
+// development and tests without a database. It follows the semantics of
+// PostgresStore, including its errors, and hands out copies so callers
+// cannot change stored records behind its back. All data is lost when the
+// process exits.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	accounts  map[int]*Account
+	entries   []*JournalEntry
+	postings  []*Posting
+	entryByID map[int]*JournalEntry
+
+	idempotencyKeys map[idempotencyKeyID]*IdempotencyRecord
+
+	refreshTokens map[string]*RefreshToken // by token hash
+	sessions      map[string]*Session      // by session ID
+	revokedTokens map[string]time.Time     // jti to expiry
+
+	totps         map[int]*TOTP
+	recoveryCodes map[int]map[string]bool // account to code hash to used
+
+	loginThrottles map[string]*LoginThrottle // by email
+	loginEvents    []*LoginEvent
+
+	passwordResets []*PasswordReset
+	apiKeys        []*APIKey
+
+	lastID map[string]int
+}
+
+type idempotencyKeyID struct {
+	accountID int
+	key       string
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{}
+	s.reset()
+	return s
+}
+
+func (s *MemoryStore) reset() {
+	s.accounts = map[int]*Account{}
+	s.entries = nil
+	s.postings = nil
+	s.entryByID = map[int]*JournalEntry{}
+	s.idempotencyKeys = map[idempotencyKeyID]*IdempotencyRecord{}
+	s.refreshTokens = map[string]*RefreshToken{}
+	s.sessions = map[string]*Session{}
+	s.revokedTokens = map[string]time.Time{}
+	s.totps = map[int]*TOTP{}
+	s.recoveryCodes = map[int]map[string]bool{}
+	s.loginThrottles = map[string]*LoginThrottle{}
+	s.loginEvents = nil
+	s.passwordResets = nil
+	s.apiKeys = nil
+	s.lastID = map[string]int{}
+}
+
+// nextID plays the role of a serial column: IDs start at 1 and are never
+// reused within a table.
+func (s *MemoryStore) nextID(table string) int {
+	s.lastID[table]++
+	return s.lastID[table]
+}
+
+// DropTable deletes all data.
+func (s *MemoryStore) DropTable() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reset()
+	return nil
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func copyAccount(acc *Account) *Account {
+	c := *acc
+	return &c
+}
+
+func (s *MemoryStore) CreateAccount(acc *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.emailTaken(acc.Email, 0) {
+		return conflictError("email %s is already registered", acc.Email)
+	}
+	if acc.Role == "" {
+		acc.Role = RoleCustomer
+	}
+	acc.ID = s.nextID("account")
+
+	stored := copyAccount(acc)
+	stored.Balance = 0
+	stored.TokenVersion = 0
+	s.accounts[acc.ID] = stored
+
+	if acc.Balance != 0 {
+		_, err := s.postEntry(EntryKindOpening, acc.CreatedAt,
+			&Posting{AccountID: acc.ID, Amount: acc.Balance},
+			&Posting{AccountID: ExternalAccountID, Amount: -acc.Balance},
+		)
+		if err != nil {
+			delete(s.accounts, acc.ID)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteAccount(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acc, ok := s.accounts[id]; ok && acc.Balance != 0 {
+		return conflictError("account %d still has a balance of %d", id, acc.Balance)
+	}
+	delete(s.accounts, id)
+	return nil
+}
+
+// UpdateAccount saves the account's profile fields. The balance is ignored,
+// as in PostgresStore.
+func (s *MemoryStore) UpdateAccount(account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.accounts[account.ID]
+	if !ok {
+		return notFoundError("account %d not found", account.ID)
+	}
+	if s.emailTaken(account.Email, account.ID) {
+		return conflictError("email %s is already registered", account.Email)
+	}
+
+	stored.FirstName = account.FirstName
+	stored.LastName = account.LastName
+	stored.Email = account.Email
+	stored.EncryptedPassword = account.EncryptedPassword
+	stored.Phone = account.Phone
+	stored.Role = account.Role
+	stored.EmailVerified = account.EmailVerified
+	return nil
+}
+
+func (s *MemoryStore) UpdatePassword(ctx context.Context, accountID int, encryptedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.accounts[accountID]
+	if !ok {
+		return notFoundError("account %d not found", accountID)
+	}
+	stored.EncryptedPassword = encryptedPassword
+	return nil
+}
+
+func (s *MemoryStore) UpdateEmail(ctx context.Context, accountID int, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.accounts[accountID]
+	if !ok {
+		return notFoundError("account %d not found", accountID)
+	}
+	if s.emailTaken(email, accountID) {
+		return conflictError("email %s is already registered", email)
+	}
+	stored.Email = email
+	stored.EmailVerified = false
+	return nil
+}
+
+// emailTaken reports whether an account other than exceptID uses email, like
+// the unique constraint on account.email in the SQL stores.
+func (s *MemoryStore) emailTaken(email string, exceptID int) bool {
+	for _, acc := range s.accounts {
+		if acc.Email == email && acc.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedAccounts returns copies of the accounts for which keep returns true,
+// in ID order.
+func (s *MemoryStore) sortedAccounts(keep func(*Account) bool) []*Account {
+	accounts := []*Account{}
+	for _, acc := range s.accounts {
+		if keep(acc) {
+			accounts = append(accounts, copyAccount(acc))
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+	return accounts
+}
+
+func (s *MemoryStore) GetAccounts() ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedAccounts(func(*Account) bool { return true }), nil
+}
+
+// SearchAccounts returns the accounts whose name or email contains query,
+// ignoring case.
+func (s *MemoryStore) SearchAccounts(query string) ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query = strings.ToLower(query)
+	return s.sortedAccounts(func(acc *Account) bool {
+		for _, field := range []string{acc.FirstName, acc.LastName, acc.Email} {
+			if strings.Contains(strings.ToLower(field), query) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (s *MemoryStore) GetAccountByID(id int) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return nil, notFoundError("account %d not found", id)
+	}
+	return copyAccount(acc), nil
+}
+
+func (s *MemoryStore) GetAccountByEmail(email string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := s.sortedAccounts(func(acc *Account) bool { return acc.Email == email })
+	if len(accounts) == 0 {
+		return nil, notFoundError("account %s not found", email)
+	}
+	return accounts[0], nil
+}
+
+func (s *MemoryStore) VerifyEmail(ctx context.Context, accountID int, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[accountID]
+	if !ok || acc.Email != email {
+		return notFoundError("account %d with email [%s] not found", accountID, email)
+	}
+	acc.EmailVerified = true
+	return nil
+}
+
+func (s *MemoryStore) Transfer(ctx context.Context, from, to int, amount int64) error {
+	if amount <= 0 {
+		return validationError("transfer amount must be positive")
+	}
+	if from == to {
+		return validationError("cannot transfer to the same account")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fromAccount, ok := s.accounts[from]
+	if !ok {
+		return notFoundError("account %d not found", from)
+	}
+	if _, ok := s.accounts[to]; !ok {
+		return notFoundError("account %d not found", to)
+	}
+	if fromAccount.Balance < amount {
+		return ErrInsufficientFunds
+	}
+
+	_, err := s.postEntry(EntryKindTransfer, time.Now().UTC(),
+		&Posting{AccountID: from, Amount: -amount},
+		&Posting{AccountID: to, Amount: amount},
+	)
+	return err
+}
+
+// postEntry records a balanced journal entry and applies each posting to the
+// balance of its account. The caller must hold s.mu.
+func (s *MemoryStore) postEntry(kind string, createdAt time.Time, postings ...*Posting) (*JournalEntry, error) {
+	var sum int64
+	for _, p := range postings {
+		sum += p.Amount
+		if p.AccountID != ExternalAccountID {
+			if _, ok := s.accounts[p.AccountID]; !ok {
+				return nil, notFoundError("account %d not found", p.AccountID)
+			}
+		}
+	}
+	if sum != 0 {
+		return nil, fmt.Errorf("unbalanced journal entry: postings sum to %d", sum)
+	}
+
+	entry := &JournalEntry{
+		ID:        s.nextID("journal_entry"),
+		Kind:      kind,
+		CreatedAt: createdAt,
+	}
+
+	for _, p := range postings {
+		p.ID = s.nextID("posting")
+		p.EntryID = entry.ID
+		if acc, ok := s.accounts[p.AccountID]; ok {
+			acc.Balance += p.Amount
+			p.BalanceAfter = acc.Balance
+		}
+
+		stored := *p
+		entry.Postings = append(entry.Postings, &stored)
+		s.postings = append(s.postings, &stored)
+	}
+
+	s.entries = append(s.entries, entry)
+	s.entryByID[entry.ID] = entry
+	return entry, nil
+}
+
+func (s *MemoryStore) GetAccountTransactions(ctx context.Context, q *TransactionQuery) ([]*AccountTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transactions := []*AccountTransaction{}
+	for i := len(s.postings) - 1; i >= 0 && len(transactions) < q.Limit; i-- {
+		p := s.postings[i]
+		if p.AccountID != q.AccountID {
+			continue
+		}
+		entry := s.entryByID[p.EntryID]
+		if q.Before > 0 && p.ID >= q.Before {
+			continue
+		}
+		if !q.From.IsZero() && entry.CreatedAt.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && !entry.CreatedAt.Before(q.To) {
+			continue
+		}
+
+		t := &AccountTransaction{
+			ID:           p.ID,
+			EntryID:      p.EntryID,
+			Kind:         entry.Kind,
+			Amount:       p.Amount,
+			BalanceAfter: p.BalanceAfter,
+			CreatedAt:    entry.CreatedAt,
+		}
+		for _, o := range entry.Postings {
+			if o.ID != p.ID {
+				t.Counterparty = o.AccountID
+				break
+			}
+		}
+
+		t.Direction = DirectionCredit
+		if t.Amount < 0 {
+			t.Direction = DirectionDebit
+			t.Amount = -t.Amount
+		}
+
+		transactions = append(transactions, t)
+	}
+
+	return transactions, nil
+}
+
+// CheckLedger compares every cached account balance with the sum of its
+// postings and looks for journal entries that do not balance.
+func (s *MemoryStore) CheckLedger(ctx context.Context) (*LedgerReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := &LedgerReport{
+		Mismatches:        []*BalanceMismatch{},
+		UnbalancedEntries: []int{},
+	}
+
+	sums := map[int]int64{}
+	for _, p := range s.postings {
+		sums[p.AccountID] += p.Amount
+	}
+	for _, acc := range s.sortedAccounts(func(*Account) bool { return true }) {
+		if acc.Balance != sums[acc.ID] {
+			report.Mismatches = append(report.Mismatches, &BalanceMismatch{
+				AccountID:     acc.ID,
+				Balance:       acc.Balance,
+				LedgerBalance: sums[acc.ID],
+			})
+		}
+	}
+
+	for _, entry := range s.entries {
+		var sum int64
+		for _, p := range entry.Postings {
+			sum += p.Amount
+		}
+		if sum != 0 {
+			report.UnbalancedEntries = append(report.UnbalancedEntries, entry.ID)
+		}
+	}
+
+	return report, nil
+}
+
+// ReserveIdempotencyKey claims rec's key for a new request. If a live record
+// already holds the key it is returned instead and nothing is written; an
+// expired record is replaced.
+func (s *MemoryStore) ReserveIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, existing := range s.idempotencyKeys {
+		if !existing.ExpiresAt.After(rec.CreatedAt) {
+			delete(s.idempotencyKeys, id)
+		}
+	}
+
+	id := idempotencyKeyID{rec.AccountID, rec.Key}
+	if existing, ok := s.idempotencyKeys[id]; ok {
+		c := *existing
+		c.Response = slices.Clone(existing.Response)
+		return &c, nil
+	}
+
+	s.idempotencyKeys[id] = &IdempotencyRecord{
+		AccountID:   rec.AccountID,
+		Key:         rec.Key,
+		Fingerprint: rec.Fingerprint,
+		CreatedAt:   rec.CreatedAt,
+		ExpiresAt:   rec.ExpiresAt,
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) CompleteIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.idempotencyKeys[idempotencyKeyID{rec.AccountID, rec.Key}]; ok {
+		existing.StatusCode = rec.StatusCode
+		existing.Response = slices.Clone(rec.Response)
+	}
+	return nil
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(ctx context.Context, accountID int, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotencyKeys, idempotencyKeyID{accountID, key})
+	return nil
+}
+
+// storeRefreshToken saves a copy of token under a new ID. The caller must
+// hold s.mu.
+func (s *MemoryStore) storeRefreshToken(token *RefreshToken) error {
+	if _, ok := s.refreshTokens[token.TokenHash]; ok {
+		return conflictError("refresh token already exists")
+	}
+
+	token.ID = s.nextID("refresh_token")
+	stored := *token
+	stored.Scopes = slices.Clone(token.Scopes)
+	if len(stored.Scopes) == 0 {
+		stored.Scopes = nil
+	}
+	stored.RevokedAt = nil
+	s.refreshTokens[token.TokenHash] = &stored
+	return nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.storeRefreshToken(token)
+}
+
+// RotateRefreshToken spends the refresh token with the given hash and stores
+// next in its place. Presenting a token that was already rotated revokes the
+// whole session.
+func (s *MemoryStore) RotateRefreshToken(ctx context.Context, tokenHash string, next *RefreshToken) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return nil, notFoundError("refresh token not found")
+	}
+
+	if stored.RevokedAt != nil {
+		s.revokeSession(stored.SessionID, next.CreatedAt)
+		return nil, fmt.Errorf("refresh token reuse detected, session %s revoked", stored.SessionID)
+	}
+
+	if !stored.ExpiresAt.After(next.CreatedAt) {
+		return nil, fmt.Errorf("refresh token expired")
+	}
+
+	revokedAt := next.CreatedAt
+	stored.RevokedAt = &revokedAt
+
+	current := *stored
+	current.Scopes = slices.Clone(stored.Scopes)
+	current.RevokedAt = nil
+
+	next.AccountID = stored.AccountID
+	next.SessionID = stored.SessionID
+	next.Scopes = slices.Clone(stored.Scopes)
+	if err := s.storeRefreshToken(next); err != nil {
+		stored.RevokedAt = nil
+		return nil, err
+	}
+
+	return &current, nil
+}
+
+func (s *MemoryStore) CreateSession(ctx context.Context, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sessions[session.SessionID]; ok {
+		return conflictError("session %s already exists", session.SessionID)
+	}
+
+	session.ID = s.nextID("session")
+	stored := *session
+	stored.RevokedAt = nil
+	stored.Current = false
+	s.sessions[session.SessionID] = &stored
+	return nil
+}
+
+// GetSessions lists the account's sessions that were not signed out, most
+// recently used first.
+func (s *MemoryStore) GetSessions(ctx context.Context, accountID int) ([]*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := []*Session{}
+	for _, session := range s.sessions {
+		if session.AccountID == accountID && session.RevokedAt == nil {
+			c := *session
+			sessions = append(sessions, &c)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+	return sessions, nil
+}
+
+func (s *MemoryStore) UseSession(ctx context.Context, sessionID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[sessionID]
+	if !ok || session.RevokedAt != nil {
+		return notFoundError("session %s not found", sessionID)
+	}
+	session.LastUsedAt = at
+	return nil
+}
+
+func (s *MemoryStore) RevokeSession(ctx context.Context, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeSession(sessionID, time.Now().UTC())
+	return nil
+}
+
+func (s *MemoryStore) RevokeAccountSession(ctx context.Context, accountID, id int) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, session := range s.sessions {
+		if session.ID == id && session.AccountID == accountID && session.RevokedAt == nil {
+			s.revokeSession(session.SessionID, time.Now().UTC())
+			return &Session{ID: id, AccountID: accountID, SessionID: session.SessionID}, nil
+		}
+	}
+	return nil, notFoundError("session %d not found", id)
+}
+
+// revokeSession marks the session and its refresh tokens revoked. The
+// caller must hold s.mu.
+func (s *MemoryStore) revokeSession(sessionID string, at time.Time) {
+	if session, ok := s.sessions[sessionID]; ok && session.RevokedAt == nil {
+		session.RevokedAt = copyTime(&at)
+	}
+	for _, token := range s.refreshTokens {
+		if token.SessionID == sessionID && token.RevokedAt == nil {
+			token.RevokedAt = copyTime(&at)
+		}
+	}
+}
+
+func (s *MemoryStore) RevokeAllTokens(ctx context.Context, accountID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[accountID]
+	if !ok {
+		return notFoundError("account %d not found", accountID)
+	}
+	acc.TokenVersion++
+
+	now := time.Now().UTC()
+	for _, session := range s.sessions {
+		if session.AccountID == accountID && session.RevokedAt == nil {
+			session.RevokedAt = copyTime(&now)
+		}
+	}
+	for _, token := range s.refreshTokens {
+		if token.AccountID == accountID && token.RevokedAt == nil {
+			token.RevokedAt = copyTime(&now)
+		}
+	}
+	return nil
+}
+
+// RevokeToken adds an access token ID to the revocation list until the token
+// would have expired anyway. Entries past their expiry are pruned.
+func (s *MemoryStore) RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for jti, exp := range s.revokedTokens {
+		if exp.Before(now) {
+			delete(s.revokedTokens, jti)
+		}
+	}
+
+	if _, ok := s.revokedTokens[tokenID]; !ok {
+		s.revokedTokens[tokenID] = expiresAt
+	}
+	return nil
+}
+
+func (s *MemoryStore) IsTokenRevoked(ctx context.Context, tokenID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.revokedTokens[tokenID]
+	return ok, nil
+}
+
+func (s *MemoryStore) GetTOTP(ctx context.Context, accountID int) (*TOTP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totp, ok := s.totps[accountID]
+	if !ok {
+		return nil, nil
+	}
+	c := *totp
+	c.ConfirmedAt = copyTime(totp.ConfirmedAt)
+	return &c, nil
+}
+
+func (s *MemoryStore) SaveTOTP(ctx context.Context, totp *TOTP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.totps[totp.AccountID]; ok && existing.ConfirmedAt != nil {
+		return conflictError("two-factor authentication is already enabled")
+	}
+
+	s.totps[totp.AccountID] = &TOTP{
+		AccountID: totp.AccountID,
+		Secret:    totp.Secret,
+		CreatedAt: totp.CreatedAt,
+	}
+	return nil
+}
+
+func (s *MemoryStore) ConfirmTOTP(ctx context.Context, accountID int, step int64, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totp, ok := s.totps[accountID]
+	if !ok || totp.ConfirmedAt != nil {
+		return conflictError("no pending two-factor enrollment")
+	}
+
+	now := time.Now().UTC()
+	totp.ConfirmedAt = &now
+	totp.LastUsedStep = step
+
+	codes := map[string]bool{}
+	for _, hash := range recoveryCodeHashes {
+		if _, ok := codes[hash]; ok {
+			return conflictError("duplicate recovery code")
+		}
+		codes[hash] = false
+	}
+	s.recoveryCodes[accountID] = codes
+	return nil
+}
+
+func (s *MemoryStore) UseTOTPStep(ctx context.Context, accountID int, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totp, ok := s.totps[accountID]
+	if !ok || totp.LastUsedStep >= step {
+		return false, nil
+	}
+	totp.LastUsedStep = step
+	return true, nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(ctx context.Context, accountID int, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used, ok := s.recoveryCodes[accountID][codeHash]
+	if !ok || used {
+		return false, nil
+	}
+	s.recoveryCodes[accountID][codeHash] = true
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteTOTP(ctx context.Context, accountID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.recoveryCodes, accountID)
+	delete(s.totps, accountID)
+	return nil
+}
+
+func copyLoginThrottle(throttle *LoginThrottle) *LoginThrottle {
+	c := *throttle
+	c.LockedUntil = copyTime(throttle.LockedUntil)
+	return &c
+}
+
+func (s *MemoryStore) ReserveLoginAttempt(ctx context.Context, email string, at, staleBefore time.Time, retryAfter func(*LoginThrottle) time.Duration) (*LoginThrottle, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, t := range s.loginThrottles {
+		if t.LastFailureAt.Before(staleBefore) && (t.LockedUntil == nil || !t.LockedUntil.After(at)) {
+			delete(s.loginThrottles, key)
+		}
+	}
+
+	throttle, ok := s.loginThrottles[email]
+	if !ok {
+		throttle = &LoginThrottle{Email: email}
+	}
+	if wait := retryAfter(copyLoginThrottle(throttle)); wait > 0 {
+		return copyLoginThrottle(throttle), wait, nil
+	}
+
+	s.loginThrottles[email] = throttle
+	throttle.Failures++
+	throttle.LastFailureAt = at
+	return copyLoginThrottle(throttle), 0, nil
+}
+
+func (s *MemoryStore) LockLogin(ctx context.Context, email string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if throttle, ok := s.loginThrottles[email]; ok {
+		throttle.LockedUntil = copyTime(&until)
+	}
+	return nil
+}
+
+func (s *MemoryStore) ResetLoginThrottle(ctx context.Context, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginThrottles, email)
+	return nil
+}
+
+func (s *MemoryStore) RecordLoginEvent(ctx context.Context, event *LoginEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event.ID = s.nextID("login_event")
+	stored := *event
+	s.loginEvents = append(s.loginEvents, &stored)
+	return nil
+}
+
+func (s *MemoryStore) GetLoginEvents(ctx context.Context, accountID int, limit int) ([]*LoginEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []*LoginEvent{}
+	for i := len(s.loginEvents) - 1; i >= 0 && len(events) < limit; i-- {
+		if e := s.loginEvents[i]; e.AccountID == accountID {
+			c := *e
+			events = append(events, &c)
+		}
+	}
+	return events, nil
+}
+
+func (s *MemoryStore) CountLoginFailuresByIP(ctx context.Context, ip string, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for _, e := range s.loginEvents {
+		if e.IP == ip && (e.Event == LoginEventFailed || e.Event == LoginEventMFAFailed) && !e.CreatedAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) RecordPasswordResetRequest(ctx context.Context, event *LoginEvent, since time.Time, allow func(byEmail, byIP int) bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var byEmail, byIP int
+	for _, e := range s.loginEvents {
+		if e.Event != LoginEventResetRequested || e.CreatedAt.Before(since) {
+			continue
+		}
+		if e.Email == event.Email {
+			byEmail++
+		}
+		if e.IP == event.IP {
+			byIP++
+		}
+	}
+	if !allow(byEmail, byIP) {
+		return false, nil
+	}
+
+	event.ID = s.nextID("login_event")
+	stored := *event
+	s.loginEvents = append(s.loginEvents, &stored)
+	return true, nil
+}
+
+// CreatePasswordReset stores a new reset token for the account. Tokens the
+// account was sent earlier are spent, so only the latest email works.
+func (s *MemoryStore) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.passwordResets {
+		if r.TokenHash == reset.TokenHash {
+			return conflictError("password reset token already exists")
+		}
+	}
+	for _, r := range s.passwordResets {
+		if r.AccountID == reset.AccountID && r.UsedAt == nil {
+			r.UsedAt = copyTime(&reset.CreatedAt)
+		}
+	}
+
+	reset.ID = s.nextID("password_reset")
+	stored := *reset
+	stored.UsedAt = nil
+	s.passwordResets = append(s.passwordResets, &stored)
+	return nil
+}
+
+func (s *MemoryStore) ConsumePasswordReset(ctx context.Context, tokenHash string, at time.Time) (*PasswordReset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.passwordResets {
+		if r.TokenHash == tokenHash && r.UsedAt == nil && r.ExpiresAt.After(at) {
+			r.UsedAt = copyTime(&at)
+			c := *r
+			c.UsedAt = copyTime(r.UsedAt)
+			return &c, nil
+		}
+	}
+	return nil, notFoundError("password reset token not found")
+}
+
+func copyAPIKey(key *APIKey) *APIKey {
+	c := *key
+	c.Permissions = slices.Clone(key.Permissions)
+	c.LastUsedAt = copyTime(key.LastUsedAt)
+	c.RevokedAt = copyTime(key.RevokedAt)
+	return &c
+}
+
+func (s *MemoryStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.apiKeys {
+		if k.KeyHash == key.KeyHash {
+			return conflictError("api key already exists")
+		}
+	}
+
+	key.ID = s.nextID("api_key")
+	stored := copyAPIKey(key)
+	stored.LastUsedAt = nil
+	stored.RevokedAt = nil
+	s.apiKeys = append(s.apiKeys, stored)
+	return nil
+}
+
+// GetAPIKeys lists the account's keys, including revoked ones, newest first.
+func (s *MemoryStore) GetAPIKeys(ctx context.Context, accountID int) ([]*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []*APIKey{}
+	for i := len(s.apiKeys) - 1; i >= 0; i-- {
+		if k := s.apiKeys[i]; k.AccountID == accountID {
+			keys = append(keys, copyAPIKey(k))
+		}
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) UseAPIKey(ctx context.Context, keyHash string, at time.Time) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.apiKeys {
+		if k.KeyHash == keyHash && k.RevokedAt == nil {
+			k.LastUsedAt = copyTime(&at)
+			return copyAPIKey(k), nil
+		}
+	}
+	return nil, notFoundError("api key not found")
+}
+
+func (s *MemoryStore) RevokeAPIKey(ctx context.Context, accountID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.apiKeys {
+		if k.ID == id && k.AccountID == accountID && k.RevokedAt == nil {
+			now := time.Now().UTC()
+			k.RevokedAt = &now
+			return nil
+		}
+	}
+	return notFoundError("api key %d not found", id)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreReturnsCopies(t *testing.T) {
+	store := NewMemoryStore()
+
+	acc := &Account{FirstName: "John", LastName: "Doe", Email: "john@example.com", Balance: 100, CreatedAt: time.Now().UTC()}
+	assert.NoError(t, store.CreateAccount(acc))
+	assert.Equal(t, 1, acc.ID)
+
+	acc.Email = "changed@example.com"
+	fetched, err := store.GetAccountByID(acc.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "john@example.com", fetched.Email)
+
+	fetched.Balance = 1e6
+	fetched, err = store.GetAccountByID(acc.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), fetched.Balance)
+
+	key := &APIKey{AccountID: acc.ID, Name: "ci", KeyHash: "hash", Permissions: []Permission{PermAccountsRead}}
+	assert.NoError(t, store.CreateAPIKey(context.Background(), key))
+	key.Permissions[0] = PermAdmin
+	keys, err := store.GetAPIKeys(context.Background(), acc.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []Permission{PermAccountsRead}, keys[0].Permissions)
+}
+
+func TestMemoryStoreDropTable(t *testing.T) {
+	store := NewMemoryStore()
+	assert.NoError(t, store.CreateAccount(&Account{Email: "john@example.com"}))
+
+	assert.NoError(t, store.DropTable())
+
+	accounts, err := store.GetAccounts()
+	assert.NoError(t, err)
+	assert.Empty(t, accounts)
+	_, err = store.GetAccountByEmail("john@example.com")
+	assert.Error(t, err)
+}
+
+// TestHandlersWithMemoryStore runs a signup, an authenticated request and a
+// logout against a real store instead of mocks.
+func TestHandlersWithMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewAPIServer(":8080", store, &MemoryMailer{})
+
+	body := `{"firstName":"John","lastName":"Doe","email":"john@example.com","password":"password123"}`
+	req, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleSignup, false)(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	// Emails differing only in case belong to the same account.
+	body = `{"firstName":"John","lastName":"Doe","email":"John@Example.com","password":"password123"}`
+	req, _ = http.NewRequest("POST", "/signup", bytes.NewBufferString(body))
+	dup := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleSignup, false)(dup, req)
+	assert.Equal(t, http.StatusConflict, dup.Code)
+
+	req, _ = http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"JOHN@example.com ","password":"password123"}`))
+	login := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleLogin, false)(login, req)
+	assert.Equal(t, http.StatusOK, login.Code)
+
+	var accessToken string
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "token" {
+			accessToken = c.Value
+		}
+	}
+	assert.NotEmpty(t, accessToken)
+
+	acc, err := store.GetAccountByEmail("john@example.com")
+	assert.NoError(t, err)
+
+	getAccount := func() int {
+		req, _ := http.NewRequest("GET", "/account/1", nil)
+		req.SetPathValue("id", "1")
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rr := httptest.NewRecorder()
+		authWithJWT(requirePermission(PermAccountsRead, requireAccountOwner(makeHTTPHandleFunc(server.handleGetAccountByID, true))), store)(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, 1, acc.ID)
+	assert.Equal(t, http.StatusOK, getAccount())
+
+	req, _ = http.NewRequest("POST", "/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rr = httptest.NewRecorder()
+	authWithJWT(makeHTTPHandleFunc(server.handleLogout, true), store)(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, getAccount())
+}
+
+// TestLoginThrottleWithMemoryStore fires a burst of parallel logins with a
+// wrong password. Only the free attempts may reach the password check, and
+// an unknown email is throttled exactly like a registered one.
+func TestLoginThrottleWithMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewAPIServer(":8080", store, &MemoryMailer{})
+
+	body := `{"firstName":"John","lastName":"Doe","email":"john@example.com","password":"password123"}`
+	req, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleSignup, false)(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	burst := func(email string) map[int]int {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		codes := map[int]int{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"`+email+`","password":"wrongpassword1"}`))
+				rr := httptest.NewRecorder()
+				makeHTTPHandleFunc(server.handleLogin, false)(rr, req)
+				mu.Lock()
+				codes[rr.Code]++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		return codes
+	}
+
+	known := burst("john@example.com")
+	assert.Equal(t, server.loginPolicy.FreeAttempts+1, known[http.StatusUnauthorized])
+	assert.Equal(t, 10-server.loginPolicy.FreeAttempts-1, known[http.StatusTooManyRequests])
+
+	assert.Equal(t, known, burst("nobody@example.com"))
+}
+
+func TestMemoryStorePrunesExpiredIdempotencyKeys(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	for i, created := range []time.Time{now.Add(-2 * time.Hour), now} {
+		rec := &IdempotencyRecord{AccountID: i + 1, Key: "key", Fingerprint: "f", CreatedAt: created, ExpiresAt: created.Add(time.Hour)}
+		_, err := store.ReserveIdempotencyKey(ctx, rec)
+		assert.NoError(t, err)
+	}
+
+	assert.Len(t, store.idempotencyKeys, 1, "the expired key of the first account is gone")
+}
+
+func TestMemoryStoreUniqueEmail(t *testing.T) {
+	store := NewMemoryStore()
+	assert.NoError(t, store.CreateAccount(&Account{Email: "john@example.com"}))
+	assert.Error(t, store.CreateAccount(&Account{Email: "john@example.com"}))
+
+	jane := &Account{Email: "jane@example.com"}
+	assert.NoError(t, store.CreateAccount(jane))
+	jane.Email = "john@example.com"
+	assert.Error(t, store.UpdateAccount(jane))
+
+	fetched, err := store.GetAccountByID(jane.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane@example.com", fetched.Email)
+}
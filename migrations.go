@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migrationLockID is the Postgres advisory lock key held while migrations
+// run, so that several servers starting at once apply each migration once.
+const migrationLockID int64 = 0x676f6d6f6e69 // "gomoni"
+
+// Migration is one versioned change to the Postgres schema. Up and Down may
+// hold several statements and run in a transaction together with the
+// bookkeeping in schema_migrations.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Checksum identifies the Up script. A migration whose script changed after
+// it was applied is reported instead of leaving the schemas to diverge.
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationStatus tells whether a known migration has been applied.
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+// postgresMigrations is the schema history, oldest first. Never edit a
+// migration that has been released; add a new one instead.
+var postgresMigrations = []*Migration{
+	{
+		// The schema as Init used to create it. Every statement is
+		// idempotent, so databases created before migrations existed are
+		// adopted as they are.
+		Version: 1,
+		Name:    "initial_schema",
+		Up: `create table if not exists account (
+				id serial primary key,
+				first_name varchar(50),
+				last_name varchar(50),
+				email varchar(50),
+				encrypted_password varchar(255),
+				phone bigint,
+				balance serial,
+				created_at timestamp,
+				role varchar(20) not null default 'customer',
+				token_version integer not null default 0,
+				email_verified boolean not null default false
+			);
+			alter table account add column if not exists role varchar(20) not null default 'customer';
+			alter table account add column if not exists token_version integer not null default 0;
+			-- Accounts that existed before email verification count as verified.
+			alter table account add column if not exists email_verified boolean not null default true;
+			alter table account alter column email_verified set default false;
+			-- argon2id PHC strings can be longer than bcrypt hashes.
+			alter table account alter column encrypted_password type varchar(255);
+
+			create table if not exists journal_entry (
+				id serial primary key,
+				kind varchar(20) not null,
+				created_at timestamp not null
+			);
+			create table if not exists posting (
+				id serial primary key,
+				entry_id integer not null references journal_entry(id),
+				account_id integer not null,
+				amount bigint not null,
+				balance_after bigint not null
+			);
+			create index if not exists posting_account_id_idx on posting(account_id, id);
+
+			create table if not exists idempotency_key (
+				account_id integer not null,
+				key varchar(255) not null,
+				fingerprint varchar(64) not null,
+				status_code integer not null default 0,
+				response bytea,
+				created_at timestamp not null,
+				expires_at timestamp not null,
+				primary key (account_id, key)
+			);
+
+			create table if not exists refresh_token (
+				id serial primary key,
+				account_id integer not null,
+				session_id varchar(64) not null,
+				token_hash varchar(64) not null unique,
+				created_at timestamp not null,
+				expires_at timestamp not null,
+				revoked_at timestamp,
+				scope varchar(255) not null default ''
+			);
+			alter table refresh_token add column if not exists scope varchar(255) not null default '';
+			create index if not exists refresh_token_session_id_idx on refresh_token(session_id);
+			create table if not exists revoked_token (
+				jti varchar(64) primary key,
+				expires_at timestamp not null
+			);
+			create table if not exists session (
+				id serial primary key,
+				session_id varchar(64) not null unique,
+				account_id integer not null,
+				user_agent varchar(255) not null,
+				ip varchar(64) not null,
+				created_at timestamp not null,
+				last_used_at timestamp not null,
+				revoked_at timestamp
+			);
+			create index if not exists session_account_id_idx on session(account_id);
+			-- Sessions started before the session table existed are recorded
+			-- from their live refresh token, so their tokens keep working.
+			insert into session(session_id, account_id, user_agent, ip, created_at, last_used_at)
+				select session_id, account_id, '', '', min(created_at), max(created_at)
+				from refresh_token where revoked_at is null
+				group by session_id, account_id
+				on conflict (session_id) do nothing;
+
+			create table if not exists totp (
+				account_id integer primary key,
+				secret varchar(64) not null,
+				confirmed_at timestamp,
+				last_used_step bigint not null default 0,
+				created_at timestamp not null
+			);
+			create table if not exists recovery_code (
+				id serial primary key,
+				account_id integer not null,
+				code_hash varchar(64) not null,
+				used_at timestamp,
+				unique (account_id, code_hash)
+			);
+
+			create table if not exists login_throttle (
+				account_id integer primary key,
+				failures integer not null default 0,
+				last_failure_at timestamp,
+				locked_until timestamp
+			);
+			create table if not exists login_event (
+				id serial primary key,
+				account_id integer,
+				email varchar(255) not null,
+				ip varchar(64) not null,
+				event varchar(30) not null,
+				created_at timestamp not null
+			);
+			create index if not exists login_event_account_id_idx on login_event(account_id, id);
+			create index if not exists login_event_ip_idx on login_event(ip, created_at);
+
+			create table if not exists password_reset (
+				id serial primary key,
+				account_id integer not null,
+				token_hash varchar(64) not null unique,
+				created_at timestamp not null,
+				expires_at timestamp not null,
+				used_at timestamp
+			);
+			create index if not exists password_reset_account_id_idx on password_reset(account_id);
+
+			create table if not exists api_key (
+				id serial primary key,
+				account_id integer not null,
+				name varchar(100) not null,
+				prefix varchar(16) not null,
+				key_hash varchar(64) not null unique,
+				permissions varchar(255) not null,
+				created_at timestamp not null,
+				last_used_at timestamp,
+				revoked_at timestamp
+			);
+			create index if not exists api_key_account_id_idx on api_key(account_id);`,
+		Down: `drop table session, api_key, password_reset, login_event, login_throttle, recovery_code, totp,
+			revoked_token, refresh_token, idempotency_key, posting, journal_entry, account`,
+	},
+	{
+		// balance was declared serial, which gave new accounts the next
+		// value of a sequence as their stored balance until the opening
+		// entry overwrote it, and capped balances at 32 bits.
+		Version: 2,
+		Name:    "account_balance_bigint",
+		Up: `alter table account alter column balance drop default;
+			drop sequence if exists account_balance_seq;
+			alter table account alter column balance type bigint;
+			alter table account alter column balance set default 0`,
+		Down: `alter table account alter column balance type integer;
+			create sequence if not exists account_balance_seq owned by account.balance;
+			alter table account alter column balance set default nextval('account_balance_seq')`,
+	},
+	{
+		// Email addresses log in, so each may belong to one account only.
+		// Up fails if the database already holds duplicates; they have to
+		// be merged by hand first.
+		Version: 3,
+		Name:    "account_email_unique",
+		Up: `alter table account alter column email type varchar(255);
+			alter table account add constraint account_email_key unique (email)`,
+		// The column stays varchar(255), since narrowing it would fail for
+		// longer addresses.
+		Down: `alter table account drop constraint account_email_key`,
+	},
+	{
+		// Emails are looked up in lowercase, so accounts stored with other
+		// spellings could no longer log in. Up fails if two accounts differ
+		// only in case; they have to be merged by hand first.
+		Version: 4,
+		Name:    "account_email_lowercase",
+		Up: `update account set email = lower(trim(email)) where email <> lower(trim(email));
+			alter table account add constraint account_email_lowercase check (email = lower(email))`,
+		Down: `alter table account drop constraint account_email_lowercase`,
+	},
+	{
+		// Failed logins are counted per email, so that unknown emails are
+		// throttled like registered ones and responses do not reveal which
+		// emails have an account.
+		Version: 5,
+		Name:    "email_login_throttle",
+		Up: `create table email_login_throttle (
+				email varchar(255) primary key,
+				failures integer not null default 0,
+				last_failure_at timestamp,
+				locked_until timestamp
+			);
+			insert into email_login_throttle(email, failures, last_failure_at, locked_until)
+				select a.email, t.failures, t.last_failure_at, t.locked_until
+				from login_throttle t join account a on a.id = t.account_id;
+			drop table login_throttle`,
+		Down: `create table login_throttle (
+				account_id integer primary key,
+				failures integer not null default 0,
+				last_failure_at timestamp,
+				locked_until timestamp
+			);
+			insert into login_throttle(account_id, failures, last_failure_at, locked_until)
+				select a.id, t.failures, t.last_failure_at, t.locked_until
+				from email_login_throttle t join account a on a.email = t.email;
+			drop table email_login_throttle`,
+	},
+	{
+		// Accounts from before the ledger kept their stored balance but
+		// have no postings, so CheckLedger reported them all and their
+		// history started from nothing. Each account whose balance differs
+		// from its postings gets one opening entry for the difference,
+		// balanced against the external account.
+		Version: 6,
+		Name:    "ledger_opening_entries",
+		Up: `create temporary table ledger_opening on commit drop as
+				select nextval(pg_get_serial_sequence('journal_entry', 'id')) as entry_id,
+					a.id as account_id, a.balance, a.balance - coalesce(sum(p.amount), 0) as amount
+				from account a left join posting p on p.account_id = a.id
+				group by a.id
+				having a.balance <> coalesce(sum(p.amount), 0);
+			insert into journal_entry(id, kind, created_at)
+				select entry_id, 'opening', now() at time zone 'utc' from ledger_opening;
+			insert into posting(entry_id, account_id, amount, balance_after)
+				select entry_id, account_id, amount, balance from ledger_opening
+				union all
+				select entry_id, 0, -amount, 0 from ledger_opening`,
+		// The opening entries only record balances the accounts already
+		// had, so they are kept.
+		Down: `select 1`,
+	},
+	{
+		// Idle login counters are pruned by the time of their last failure.
+		Version: 7,
+		Name:    "email_login_throttle_last_failure_idx",
+		Up:      `create index email_login_throttle_last_failure_idx on email_login_throttle(last_failure_at)`,
+		Down:    `drop index email_login_throttle_last_failure_idx`,
+	},
+	{
+		// Expired idempotency keys are pruned when new ones are reserved.
+		Version: 8,
+		Name:    "idempotency_key_expires_at_idx",
+		Up:      `create index idempotency_key_expires_at_idx on idempotency_key(expires_at)`,
+		Down:    `drop index idempotency_key_expires_at_idx`,
+	},
+}
+
+// Migrator applies and reverts migrations on a Postgres database. Each run
+// holds an advisory lock and applies every migration in its own transaction.
+type Migrator struct {
+	db         *sql.DB
+	migrations []*Migration
+}
+
+func NewMigrator(db *sql.DB, migrations []*Migration) *Migrator {
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}
+}
+
+type appliedMigration struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// Up applies all pending migrations in order and returns how many ran.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	n := 0
+	err := m.withLock(ctx, func(conn *sql.Conn, applied map[int]*appliedMigration) error {
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			err := m.run(ctx, conn, mig.Up,
+				`insert into schema_migrations(version, name, checksum, applied_at) values($1, $2, $3, $4)`,
+				mig.Version, mig.Name, mig.Checksum(), time.Now().UTC())
+			if err != nil {
+				return fmt.Errorf("error applying migration %d %s: %w", mig.Version, mig.Name, err)
+			}
+			log.Printf("Applied migration %d %s", mig.Version, mig.Name)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Down reverts the latest steps applied migrations and returns how many ran.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	n := 0
+	err := m.withLock(ctx, func(conn *sql.Conn, applied map[int]*appliedMigration) error {
+		for i := len(m.migrations) - 1; i >= 0 && n < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+
+			err := m.run(ctx, conn, mig.Down, `delete from schema_migrations where version=$1`, mig.Version)
+			if err != nil {
+				return fmt.Errorf("error reverting migration %d %s: %w", mig.Version, mig.Name, err)
+			}
+			log.Printf("Reverted migration %d %s", mig.Version, mig.Name)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Status lists every known migration and when it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]*MigrationStatus, error) {
+	statuses := []*MigrationStatus{}
+	err := m.withLock(ctx, func(conn *sql.Conn, applied map[int]*appliedMigration) error {
+		for _, mig := range m.migrations {
+			status := &MigrationStatus{Version: mig.Version, Name: mig.Name}
+			if a, ok := applied[mig.Version]; ok {
+				status.AppliedAt = &a.appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// run executes script and the bookkeeping statement in one transaction.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, script, bookkeeping string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// withLock takes the migration lock on a dedicated connection, makes sure
+// schema_migrations exists and checks the applied migrations against the
+// known ones before calling fn.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn, applied map[int]*appliedMigration) error) error {
+	if err := validateMigrations(m.migrations); err != nil {
+		return err
+	}
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `select pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("error taking the migration lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, migrationLockID); err != nil {
+			log.Printf("Error releasing the migration lock: %v", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `create table if not exists schema_migrations (
+		version integer primary key,
+		name varchar(100) not null,
+		checksum varchar(64) not null,
+		applied_at timestamp not null
+	)`)
+	if err != nil {
+		return err
+	}
+
+	applied, err := loadAppliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if err := checkAppliedMigrations(m.migrations, applied); err != nil {
+		return err
+	}
+
+	return fn(conn, applied)
+}
+
+func loadAppliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]*appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, `select version, checksum, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]*appliedMigration{}
+	for rows.Next() {
+		var version int
+		a := &appliedMigration{}
+		if err := rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = a
+	}
+
+	return applied, rows.Err()
+}
+
+// validateMigrations checks that versions start at 1 and have no gaps.
+func validateMigrations(migrations []*Migration) error {
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			return fmt.Errorf("migration %s has version %d, expected %d", mig.Name, mig.Version, i+1)
+		}
+	}
+	return nil
+}
+
+// checkAppliedMigrations fails if the database was migrated by a newer build
+// or if an applied migration was edited since.
+func checkAppliedMigrations(migrations []*Migration, applied map[int]*appliedMigration) error {
+	for version, a := range applied {
+		if version < 1 || version > len(migrations) {
+			return fmt.Errorf("database has unknown migration %d, it was migrated by a newer version", version)
+		}
+		if mig := migrations[version-1]; a.checksum != mig.Checksum() {
+			return fmt.Errorf("migration %d %s was changed after it was applied", mig.Version, mig.Name)
+		}
+	}
+	return nil
+}
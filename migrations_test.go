@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgresMigrationsAreValid(t *testing.T) {
+	assert.NoError(t, validateMigrations(postgresMigrations))
+
+	for _, mig := range postgresMigrations {
+		assert.NotEmpty(t, mig.Name)
+		assert.NotEmpty(t, mig.Up, "migration %d has no up script", mig.Version)
+		assert.NotEmpty(t, mig.Down, "migration %d has no down script", mig.Version)
+	}
+}
+
+func TestValidateMigrations(t *testing.T) {
+	assert.NoError(t, validateMigrations(nil))
+	assert.Error(t, validateMigrations([]*Migration{{Version: 2, Name: "second"}}))
+	assert.Error(t, validateMigrations([]*Migration{{Version: 1, Name: "first"}, {Version: 1, Name: "again"}}))
+}
+
+func TestCheckAppliedMigrations(t *testing.T) {
+	migrations := []*Migration{
+		{Version: 1, Name: "first", Up: "create table a (id integer)"},
+		{Version: 2, Name: "second", Up: "create table b (id integer)"},
+	}
+	applied := func(checksums ...string) map[int]*appliedMigration {
+		m := map[int]*appliedMigration{}
+		for i, sum := range checksums {
+			m[i+1] = &appliedMigration{checksum: sum, appliedAt: time.Now()}
+		}
+		return m
+	}
+
+	assert.NoError(t, checkAppliedMigrations(migrations, applied()))
+	assert.NoError(t, checkAppliedMigrations(migrations, applied(migrations[0].Checksum())))
+	assert.NoError(t, checkAppliedMigrations(migrations, applied(migrations[0].Checksum(), migrations[1].Checksum())))
+
+	// An edited script no longer matches what the database ran.
+	assert.Error(t, checkAppliedMigrations(migrations, applied("0000")))
+
+	// A newer build applied a migration this one does not know.
+	newer := applied(migrations[0].Checksum(), migrations[1].Checksum(), "ffff")
+	assert.Error(t, checkAppliedMigrations(migrations, newer))
+}
+
+func TestMigrator(t *testing.T) {
+	pg := testPostgresStore(t)
+	assert.NoError(t, pg.DropTable())
+	migrator := NewMigrator(pg.db, postgresMigrations)
+	ctx := context.Background()
+
+	n, err := migrator.Up(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, len(postgresMigrations), n)
+
+	n, err = migrator.Up(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = migrator.Down(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	statuses, err := migrator.Status(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, len(postgresMigrations))
+	assert.NotNil(t, statuses[0].AppliedAt)
+	assert.Nil(t, statuses[len(statuses)-1].AppliedAt)
+
+	n, err = migrator.Up(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+// TestLedgerOpeningMigration upgrades a database whose accounts have stored
+// balances but no postings, as they had before the ledger existed.
+func TestLedgerOpeningMigration(t *testing.T) {
+	pg := testPostgresStore(t)
+	assert.NoError(t, pg.DropTable())
+	ctx := context.Background()
+
+	_, err := NewMigrator(pg.db, postgresMigrations[:5]).Up(ctx)
+	assert.NoError(t, err)
+	for i, balance := range []int64{2500, 0, 700} {
+		_, err := pg.db.Exec(`insert into account(first_name, last_name, email, encrypted_password, phone, balance, created_at)
+			values('Legacy', 'Account', $1, '', 0, $2, now())`, fmt.Sprintf("legacy%d@example.com", i), balance)
+		assert.NoError(t, err)
+	}
+
+	report, err := pg.CheckLedger(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, report.Mismatches, 2)
+
+	n, err := NewMigrator(pg.db, postgresMigrations).Up(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, len(postgresMigrations)-5, n)
+
+	report, err = pg.CheckLedger(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Mismatches)
+	assert.Empty(t, report.UnbalancedEntries)
+
+	accounts, err := pg.GetAccounts()
+	assert.NoError(t, err)
+	history, err := pg.GetAccountTransactions(ctx, &TransactionQuery{AccountID: accounts[0].ID, Limit: 10})
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, EntryKindOpening, history[0].Kind)
+		assert.Equal(t, int64(2500), history[0].Amount)
+		assert.Equal(t, int64(2500), history[0].BalanceAfter)
+	}
+}
+
+func TestRunMigrateNeedsPostgres(t *testing.T) {
+	for _, dbURL := range []string{"sqlite://gomoni.db", "memory://"} {
+		t.Setenv("DB_URL", dbURL)
+		err := runMigrate([]string{"status"})
+		if assert.Error(t, err, dbURL) {
+			assert.Contains(t, err.Error(), "only applies to Postgres")
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPasswordResetTTL = time.Hour
+	defaultAppBaseURL       = "http://localhost:8008"
+)
+
+func appBaseURL() string {
+	if base := os.Getenv("APP_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return defaultAppBaseURL
+}
+
+// handleForgotPassword mails a reset link to the account with the given
+// email. It answers the same way and in the same time whether or not the
+// email is registered, so it cannot be used to find out who banks here: the
+// link is created and mailed after the response. Requests are limited per
+// email and per client IP.
+func (s *APIServer) handleForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	var forgotReq ForgotPasswordRequest
+	if err := decodeJSON(r, &forgotReq); err != nil {
+		return err
+	}
+	email := normalizeEmail(forgotReq.Email)
+
+	acc, err := s.store.GetAccountByEmail(email)
+	if errors.Is(err, ErrNotFound) {
+		acc = nil
+	} else if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	event := &LoginEvent{Email: email, IP: clientIP(r), Event: LoginEventResetRequested, CreatedAt: now}
+	if acc != nil {
+		event.AccountID = acc.ID
+	}
+	policy := s.loginPolicy
+	allowed, err := s.store.RecordPasswordResetRequest(r.Context(), event, now.Add(-policy.ResetWindow), func(byEmail, byIP int) bool {
+		return byEmail < policy.ResetMaxPerEmail && byIP < policy.ResetMaxPerIP
+	})
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		s.recordLoginEvent(r, acc, email, LoginEventThrottled)
+		return tooManyAttempts(w, policy.ResetWindow)
+	}
+
+	if acc != nil {
+		ctx := context.WithoutCancel(r.Context())
+		s.runInBackground(func() {
+			if err := s.sendPasswordReset(ctx, acc); err != nil {
+				log.Printf("Error sending password reset email to account %d: %v", acc.ID, err)
+			}
+		})
+	}
+
+	return WriteJSON(w, http.StatusAccepted, struct {
+		Message string `json:"message"`
+	}{Message: "If the email is registered, a password reset link has been sent"})
+}
+
+// sendPasswordReset creates a reset token for acc and mails the link.
+func (s *APIServer) sendPasswordReset(ctx context.Context, acc *Account) error {
+	token, err := newRandomToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	ttl := getEnvDuration("PASSWORD_RESET_TTL", defaultPasswordResetTTL)
+	reset := &PasswordReset{
+		AccountID: acc.ID,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := s.store.CreatePasswordReset(ctx, reset); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", appBaseURL(), url.QueryEscape(token))
+	return s.mailer.Send(ctx, &Message{
+		To:      acc.Email,
+		Subject: "Reset your gomoni password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your gomoni account. "+
+			"If it was you, open this link within %s:\n\n%s\n\nIf it was not you, you can ignore this email.\n",
+			acc.FirstName, ttl, link),
+	})
+}
+
+// runInBackground runs f after the handler has returned. Tests wait for it
+// with s.background.
+func (s *APIServer) runInBackground(f func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		f()
+	}()
+}
+
+// handleResetPassword sets a new password with a token from
+// handleForgotPassword and signs the account out everywhere.
+func (s *APIServer) handleResetPassword(w http.ResponseWriter, r *http.Request) error {
+	var resetReq ResetPasswordRequest
+	if err := decodeJSON(r, &resetReq); err != nil {
+		return err
+	}
+	if err := validatePassword(resetReq.Password); err != nil {
+		return err
+	}
+
+	reset, err := s.store.ConsumePasswordReset(r.Context(), hashToken(resetReq.Token), time.Now().UTC())
+	if err != nil {
+		log.Printf("Password reset rejected: %v", err)
+		return WriteJSON(w, http.StatusBadRequest, APIError{Code: errCodeInvalidLink, Error: "Invalid or expired reset token"})
+	}
+
+	enpw, err := currentPasswordHasher().Hash(resetReq.Password)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.UpdatePassword(r.Context(), reset.AccountID, enpw); err != nil {
+		return err
+	}
+	if err := s.store.RevokeAllTokens(r.Context(), reset.AccountID); err != nil {
+		return err
+	}
+
+	clearTokenCookies(w)
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "Password has been reset"})
+}
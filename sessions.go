@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+)
+
+const maxUserAgentLength = 255
+
+func (s *APIServer) handleGetSessions(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+
+	sessions, err := s.store.GetSessions(r.Context(), authCtx.AccountID)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		session.Current = session.SessionID == authCtx.SessionID
+	}
+
+	return WriteJSON(w, http.StatusOK, sessions)
+}
+
+// handleRevokeSession signs out one of the caller's sessions, for example a
+// lost phone. Its tokens stop working on their next use.
+func (s *APIServer) handleRevokeSession(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	session, err := s.store.RevokeAccountSession(r.Context(), authCtx.AccountID, id)
+	if err != nil {
+		return err
+	}
+	if session.SessionID == authCtx.SessionID {
+		clearTokenCookies(w)
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]int{"revoked": id})
+}
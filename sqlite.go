@@ -0,0 +1,1109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteStore is a Storage backed by a single SQLite file, for small
+// deployments and demos that should not need a Postgres server.
+//
+// SQLite allows one writer at a time, so the store uses a single connection
+// and starts every transaction with BEGIN IMMEDIATE. Transfers and other
+// read-modify-write transactions are therefore serialized, which is what the
+// row locks do in PostgresStore. Timestamps are stored as UTC text and
+// compared as such.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// sqliteTables lists every table, children first, for DropTable.
+var sqliteTables = []string{
+	"session", "api_key", "password_reset", "login_event", "email_login_throttle", "recovery_code", "totp",
+	"revoked_token", "refresh_token", "idempotency_key", "posting", "journal_entry", "account",
+}
+
+// NewSQLiteStore opens the database named by a URL such as
+// "sqlite:///var/lib/gomoni/gomoni.db", "sqlite://gomoni.db" for a path
+// relative to the working directory, or "sqlite://:memory:".
+func NewSQLiteStore(dbURL string) (*SQLiteStore, error) {
+	path, ok := strings.CutPrefix(dbURL, "sqlite://")
+	if !ok || path == "" {
+		return nil, fmt.Errorf("invalid SQLite URL %q", dbURL)
+	}
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	dsn := "file:" + path + sep + "_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_time_format=sqlite&_txlock=immediate"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	// An in-memory database lives as long as its connection.
+	db.SetConnMaxIdleTime(0)
+	db.SetConnMaxLifetime(0)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+// Init creates the schema. It matches the Postgres tables column for column,
+// using SQLite types.
+func (s *SQLiteStore) Init() error {
+	queries := []string{
+		`create table if not exists account (
+			id integer primary key autoincrement,
+			first_name varchar(50),
+			last_name varchar(50),
+			email varchar(255),
+			encrypted_password varchar(255),
+			phone bigint,
+			balance bigint not null default 0,
+			created_at timestamp,
+			role varchar(20) not null default 'customer',
+			token_version integer not null default 0,
+			email_verified boolean not null default false
+		)`,
+		// Files created before emails were normalized and unique get both
+		// too. Creating the index fails if two accounts share an email.
+		`update account set email = lower(trim(email)) where email <> lower(trim(email))`,
+		`create unique index if not exists account_email_key on account(email)`,
+		`create table if not exists journal_entry (
+			id integer primary key autoincrement,
+			kind varchar(20) not null,
+			created_at timestamp not null
+		)`,
+		`create table if not exists posting (
+			id integer primary key autoincrement,
+			entry_id integer not null references journal_entry(id),
+			account_id integer not null,
+			amount bigint not null,
+			balance_after bigint not null
+		)`,
+		`create index if not exists posting_account_id_idx on posting(account_id, id)`,
+		`create table if not exists idempotency_key (
+			account_id integer not null,
+			key varchar(255) not null,
+			fingerprint varchar(64) not null,
+			status_code integer not null default 0,
+			response blob,
+			created_at timestamp not null,
+			expires_at timestamp not null,
+			primary key (account_id, key)
+		)`,
+		`create index if not exists idempotency_key_expires_at_idx on idempotency_key(expires_at)`,
+		`create table if not exists refresh_token (
+			id integer primary key autoincrement,
+			account_id integer not null,
+			session_id varchar(64) not null,
+			token_hash varchar(64) not null unique,
+			created_at timestamp not null,
+			expires_at timestamp not null,
+			revoked_at timestamp,
+			scope varchar(255) not null default ''
+		)`,
+		`create index if not exists refresh_token_session_id_idx on refresh_token(session_id)`,
+		`create table if not exists revoked_token (
+			jti varchar(64) primary key,
+			expires_at timestamp not null
+		)`,
+		`create table if not exists session (
+			id integer primary key autoincrement,
+			session_id varchar(64) not null unique,
+			account_id integer not null,
+			user_agent varchar(255) not null,
+			ip varchar(64) not null,
+			created_at timestamp not null,
+			last_used_at timestamp not null,
+			revoked_at timestamp
+		)`,
+		`create index if not exists session_account_id_idx on session(account_id)`,
+		`create table if not exists totp (
+			account_id integer primary key,
+			secret varchar(64) not null,
+			confirmed_at timestamp,
+			last_used_step bigint not null default 0,
+			created_at timestamp not null
+		)`,
+		`create table if not exists recovery_code (
+			id integer primary key autoincrement,
+			account_id integer not null,
+			code_hash varchar(64) not null,
+			used_at timestamp,
+			unique (account_id, code_hash)
+		)`,
+		// Failed logins used to be counted per account.
+		`drop table if exists login_throttle`,
+		`create table if not exists email_login_throttle (
+			email varchar(255) primary key,
+			failures integer not null default 0,
+			last_failure_at timestamp,
+			locked_until timestamp
+		)`,
+		`create index if not exists email_login_throttle_last_failure_idx on email_login_throttle(last_failure_at)`,
+		`create table if not exists login_event (
+			id integer primary key autoincrement,
+			account_id integer,
+			email varchar(255) not null,
+			ip varchar(64) not null,
+			event varchar(30) not null,
+			created_at timestamp not null
+		)`,
+		`create index if not exists login_event_account_id_idx on login_event(account_id, id)`,
+		`create index if not exists login_event_ip_idx on login_event(ip, created_at)`,
+		`create table if not exists password_reset (
+			id integer primary key autoincrement,
+			account_id integer not null,
+			token_hash varchar(64) not null unique,
+			created_at timestamp not null,
+			expires_at timestamp not null,
+			used_at timestamp
+		)`,
+		`create index if not exists password_reset_account_id_idx on password_reset(account_id)`,
+		`create table if not exists api_key (
+			id integer primary key autoincrement,
+			account_id integer not null,
+			name varchar(100) not null,
+			prefix varchar(16) not null,
+			key_hash varchar(64) not null unique,
+			permissions varchar(255) not null,
+			created_at timestamp not null,
+			last_used_at timestamp,
+			revoked_at timestamp
+		)`,
+		`create index if not exists api_key_account_id_idx on api_key(account_id)`,
+	}
+
+	for _, q := range queries {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) DropTable() error {
+	for _, table := range sqliteTables {
+		if _, err := s.db.Exec(`drop table if exists ` + table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSQLiteUniqueViolation reports whether err is a failed unique constraint,
+// such as a second account with the same email.
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// queryAccounts runs a query over accountColumns and scans every row.
+func (s *SQLiteStore) queryAccounts(query string, args ...any) ([]*Account, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts, rows.Err()
+}
+
+func (s *SQLiteStore) GetAccountByEmail(email string) (*Account, error) {
+	accounts, err := s.queryAccounts(`select `+accountColumns+` from account where email=$1 order by id limit 1`, email)
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, notFoundError("account %s not found", email)
+	}
+	return accounts[0], nil
+}
+
+func (s *SQLiteStore) GetAccountByID(id int) (*Account, error) {
+	accounts, err := s.queryAccounts(`select `+accountColumns+` from account where id=$1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, notFoundError("account %d not found", id)
+	}
+	return accounts[0], nil
+}
+
+func (s *SQLiteStore) GetAccounts() ([]*Account, error) {
+	return s.queryAccounts(`select ` + accountColumns + ` from account order by id`)
+}
+
+// SearchAccounts returns the accounts whose name or email contains query,
+// ignoring case. SQLite's like is case-insensitive for ASCII letters only.
+func (s *SQLiteStore) SearchAccounts(query string) ([]*Account, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+
+	return s.queryAccounts(`select `+accountColumns+` from account
+		where first_name like $1 escape '\' or last_name like $1 escape '\' or email like $1 escape '\'
+		order by id`, pattern)
+}
+
+func (s *SQLiteStore) CreateAccount(acc *Account) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `insert into
+		account(first_name, last_name, email, encrypted_password, phone, balance, created_at, role, email_verified)
+		values($1, $2, $3, $4, $5, 0, $6, $7, $8)
+		returning id`
+	if acc.Role == "" {
+		acc.Role = RoleCustomer
+	}
+	if err := tx.QueryRow(q, acc.FirstName, acc.LastName, acc.Email, acc.EncryptedPassword, acc.Phone, acc.CreatedAt.UTC(), acc.Role, acc.EmailVerified).Scan(&acc.ID); err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return conflictError("email %s is already registered", acc.Email)
+		}
+		return err
+	}
+
+	if acc.Balance != 0 {
+		_, err := postEntry(context.Background(), tx, EntryKindOpening, acc.CreatedAt.UTC(),
+			&Posting{AccountID: acc.ID, Amount: acc.Balance},
+			&Posting{AccountID: ExternalAccountID, Amount: -acc.Balance},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) VerifyEmail(ctx context.Context, accountID int, email string) error {
+	res, err := s.db.ExecContext(ctx, `update account set email_verified=true where id=$1 and email=$2`, accountID, email)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("account %d with email [%s] not found", accountID, email)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) DeleteAccount(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var balance int64
+	err = tx.QueryRow(`select balance from account where id=$1`, id).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if balance != 0 {
+		return conflictError("account %d still has a balance of %d", id, balance)
+	}
+
+	if _, err := tx.Exec(`delete from account where id=$1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UpdateAccount(account *Account) error {
+	q := `update account set first_name=$1, last_name=$2, email=$3, encrypted_password=$4, phone=$5, role=$6, email_verified=$7 where id=$8`
+
+	res, err := s.db.Exec(q, account.FirstName, account.LastName, account.Email, account.EncryptedPassword, account.Phone, account.Role, account.EmailVerified, account.ID)
+	if isSQLiteUniqueViolation(err) {
+		return conflictError("email %s is already registered", account.Email)
+	}
+	if err != nil {
+		return fmt.Errorf("error updating account: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("account %d not found", account.ID)
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) UpdatePassword(ctx context.Context, accountID int, encryptedPassword string) error {
+	res, err := s.db.ExecContext(ctx, `update account set encrypted_password=$1 where id=$2`, encryptedPassword, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("account %d not found", accountID)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) UpdateEmail(ctx context.Context, accountID int, email string) error {
+	res, err := s.db.ExecContext(ctx, `update account set email=$1, email_verified=false where id=$2`, email, accountID)
+	if isSQLiteUniqueViolation(err) {
+		return conflictError("email %s is already registered", email)
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("account %d not found", accountID)
+	}
+	return nil
+}
+
+// Transfer moves amount from one account to another inside a single
+// transaction. The transaction holds SQLite's write lock from its start, so
+// the balance check and both postings cannot interleave with another
+// transfer.
+func (s *SQLiteStore) Transfer(ctx context.Context, from, to int, amount int64) error {
+	if amount <= 0 {
+		return validationError("transfer amount must be positive")
+	}
+	if from == to {
+		return validationError("cannot transfer to the same account")
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `select id, balance from account where id in ($1, $2)`, from, to)
+	if err != nil {
+		return err
+	}
+
+	balances := map[int]int64{}
+	for rows.Next() {
+		var id int
+		var balance int64
+		if err := rows.Scan(&id, &balance); err != nil {
+			rows.Close()
+			return err
+		}
+		balances[id] = balance
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	fromBalance, ok := balances[from]
+	if !ok {
+		return notFoundError("account %d not found", from)
+	}
+	if _, ok := balances[to]; !ok {
+		return notFoundError("account %d not found", to)
+	}
+	if fromBalance < amount {
+		return ErrInsufficientFunds
+	}
+
+	_, err = postEntry(ctx, tx, EntryKindTransfer, time.Now().UTC(),
+		&Posting{AccountID: from, Amount: -amount},
+		&Posting{AccountID: to, Amount: amount},
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetAccountTransactions(ctx context.Context, q *TransactionQuery) ([]*AccountTransaction, error) {
+	query := `select p.id, p.entry_id, e.kind, p.amount, coalesce(o.account_id, 0), p.balance_after, e.created_at
+		from posting p
+		join journal_entry e on e.id = p.entry_id
+		left join posting o on o.entry_id = p.entry_id and o.id <> p.id
+		where p.account_id = $1`
+	args := []any{q.AccountID}
+
+	if q.Before > 0 {
+		args = append(args, q.Before)
+		query += fmt.Sprintf(" and p.id < $%d", len(args))
+	}
+	if !q.From.IsZero() {
+		args = append(args, q.From.UTC())
+		query += fmt.Sprintf(" and e.created_at >= $%d", len(args))
+	}
+	if !q.To.IsZero() {
+		args = append(args, q.To.UTC())
+		query += fmt.Sprintf(" and e.created_at < $%d", len(args))
+	}
+
+	args = append(args, q.Limit)
+	query += fmt.Sprintf(" order by p.id desc limit $%d", len(args))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []*AccountTransaction{}
+	for rows.Next() {
+		t := &AccountTransaction{}
+		if err := rows.Scan(&t.ID, &t.EntryID, &t.Kind, &t.Amount, &t.Counterparty, &t.BalanceAfter, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		t.Direction = DirectionCredit
+		if t.Amount < 0 {
+			t.Direction = DirectionDebit
+			t.Amount = -t.Amount
+		}
+
+		transactions = append(transactions, t)
+	}
+
+	return transactions, rows.Err()
+}
+
+func (s *SQLiteStore) CheckLedger(ctx context.Context) (*LedgerReport, error) {
+	report := &LedgerReport{
+		Mismatches:        []*BalanceMismatch{},
+		UnbalancedEntries: []int{},
+	}
+
+	rows, err := s.db.QueryContext(ctx, `select a.id, a.balance, coalesce(sum(p.amount), 0)
+		from account a left join posting p on p.account_id = a.id
+		group by a.id, a.balance
+		having a.balance <> coalesce(sum(p.amount), 0)
+		order by a.id`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		m := &BalanceMismatch{}
+		if err := rows.Scan(&m.AccountID, &m.Balance, &m.LedgerBalance); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report.Mismatches = append(report.Mismatches, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, `select entry_id from posting group by entry_id having sum(amount) <> 0 order by entry_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		report.UnbalancedEntries = append(report.UnbalancedEntries, id)
+	}
+
+	return report, rows.Err()
+}
+
+// ReserveIdempotencyKey claims rec's key for a new request. If a live record
+// already holds the key it is returned instead and nothing is written; an
+// expired record is replaced.
+func (s *SQLiteStore) ReserveIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `delete from idempotency_key where expires_at <= $1`, rec.CreatedAt.UTC()); err != nil {
+		return nil, err
+	}
+
+	existing := &IdempotencyRecord{AccountID: rec.AccountID, Key: rec.Key}
+	err = tx.QueryRowContext(ctx, `select fingerprint, status_code, response, created_at, expires_at
+		from idempotency_key where account_id=$1 and key=$2`, rec.AccountID, rec.Key).Scan(
+		&existing.Fingerprint,
+		&existing.StatusCode,
+		&existing.Response,
+		&existing.CreatedAt,
+		&existing.ExpiresAt,
+	)
+	if err == nil && existing.ExpiresAt.After(rec.CreatedAt) {
+		return existing, nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	q := `insert or replace into idempotency_key(account_id, key, fingerprint, status_code, response, created_at, expires_at)
+		values($1, $2, $3, 0, null, $4, $5)`
+	if _, err := tx.ExecContext(ctx, q, rec.AccountID, rec.Key, rec.Fingerprint, rec.CreatedAt.UTC(), rec.ExpiresAt.UTC()); err != nil {
+		return nil, err
+	}
+
+	return nil, tx.Commit()
+}
+
+func (s *SQLiteStore) CompleteIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) error {
+	q := `update idempotency_key set status_code=$1, response=$2 where account_id=$3 and key=$4`
+
+	_, err := s.db.ExecContext(ctx, q, rec.StatusCode, rec.Response, rec.AccountID, rec.Key)
+	return err
+}
+
+func (s *SQLiteStore) ReleaseIdempotencyKey(ctx context.Context, accountID int, key string) error {
+	_, err := s.db.ExecContext(ctx, `delete from idempotency_key where account_id=$1 and key=$2`, accountID, key)
+	return err
+}
+
+func (s *SQLiteStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	q := `insert into refresh_token(account_id, session_id, token_hash, created_at, expires_at, scope)
+		values($1, $2, $3, $4, $5, $6)
+		returning id`
+
+	return s.db.QueryRowContext(ctx, q, token.AccountID, token.SessionID, token.TokenHash, token.CreatedAt.UTC(), token.ExpiresAt.UTC(), joinPermissions(token.Scopes)).Scan(&token.ID)
+}
+
+// RotateRefreshToken spends the refresh token with the given hash and stores
+// next in its place. Presenting a token that was already rotated revokes the
+// whole session.
+func (s *SQLiteStore) RotateRefreshToken(ctx context.Context, tokenHash string, next *RefreshToken) (*RefreshToken, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current := &RefreshToken{TokenHash: tokenHash}
+	var revokedAt sql.NullTime
+	var scope string
+	err = tx.QueryRowContext(ctx, `select id, account_id, session_id, created_at, expires_at, revoked_at, scope
+		from refresh_token where token_hash=$1`, tokenHash).Scan(
+		&current.ID,
+		&current.AccountID,
+		&current.SessionID,
+		&current.CreatedAt,
+		&current.ExpiresAt,
+		&revokedAt,
+		&scope,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFoundError("refresh token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := next.CreatedAt.UTC()
+	if revokedAt.Valid {
+		if err := revokeSession(ctx, tx, current.SessionID, now); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("refresh token reuse detected, session %s revoked", current.SessionID)
+	}
+
+	if !current.ExpiresAt.After(now) {
+		return nil, fmt.Errorf("refresh token expired")
+	}
+
+	if _, err := tx.ExecContext(ctx, `update refresh_token set revoked_at=$1 where id=$2`, now, current.ID); err != nil {
+		return nil, err
+	}
+
+	if scope != "" {
+		current.Scopes = splitPermissions(scope)
+	}
+	next.AccountID = current.AccountID
+	next.SessionID = current.SessionID
+	next.Scopes = current.Scopes
+
+	q := `insert into refresh_token(account_id, session_id, token_hash, created_at, expires_at, scope)
+		values($1, $2, $3, $4, $5, $6)
+		returning id`
+	if err := tx.QueryRowContext(ctx, q, next.AccountID, next.SessionID, next.TokenHash, now, next.ExpiresAt.UTC(), scope).Scan(&next.ID); err != nil {
+		return nil, err
+	}
+
+	return current, tx.Commit()
+}
+
+func (s *SQLiteStore) CreateSession(ctx context.Context, session *Session) error {
+	q := `insert into session(session_id, account_id, user_agent, ip, created_at, last_used_at)
+		values($1, $2, $3, $4, $5, $6)
+		returning id`
+
+	return s.db.QueryRowContext(ctx, q, session.SessionID, session.AccountID, session.UserAgent, session.IP, session.CreatedAt.UTC(), session.LastUsedAt.UTC()).Scan(&session.ID)
+}
+
+func (s *SQLiteStore) GetSessions(ctx context.Context, accountID int) ([]*Session, error) {
+	rows, err := s.db.QueryContext(ctx, `select id, session_id, account_id, user_agent, ip, created_at, last_used_at
+		from session where account_id=$1 and revoked_at is null
+		order by last_used_at desc, id desc`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session := &Session{}
+		err := rows.Scan(
+			&session.ID,
+			&session.SessionID,
+			&session.AccountID,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (s *SQLiteStore) UseSession(ctx context.Context, sessionID string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `update session set last_used_at=$1
+		where session_id=$2 and revoked_at is null`, at.UTC(), sessionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("session %s not found", sessionID)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) RevokeSession(ctx context.Context, sessionID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeSession(ctx, tx, sessionID, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) RevokeAccountSession(ctx context.Context, accountID, id int) (*Session, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	session := &Session{ID: id, AccountID: accountID}
+	err = tx.QueryRowContext(ctx, `select session_id from session
+		where id=$1 and account_id=$2 and revoked_at is null`, id, accountID).Scan(&session.SessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFoundError("session %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := revokeSession(ctx, tx, session.SessionID, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return session, tx.Commit()
+}
+
+func (s *SQLiteStore) RevokeAllTokens(ctx context.Context, accountID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `update account set token_version = token_version + 1 where id=$1`, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("account %d not found", accountID)
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `update session set revoked_at=$1 where account_id=$2 and revoked_at is null`, now, accountID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `update refresh_token set revoked_at=$1 where account_id=$2 and revoked_at is null`, now, accountID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx, `delete from revoked_token where expires_at < $1`, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, `insert into revoked_token(jti, expires_at) values($1, $2) on conflict (jti) do nothing`, tokenID, expiresAt.UTC())
+	return err
+}
+
+func (s *SQLiteStore) IsTokenRevoked(ctx context.Context, tokenID string) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRowContext(ctx, `select exists(select 1 from revoked_token where jti=$1)`, tokenID).Scan(&revoked)
+	return revoked, err
+}
+
+func (s *SQLiteStore) GetTOTP(ctx context.Context, accountID int) (*TOTP, error) {
+	totp := &TOTP{AccountID: accountID}
+	var confirmedAt sql.NullTime
+
+	err := s.db.QueryRowContext(ctx, `select secret, confirmed_at, last_used_step, created_at from totp where account_id=$1`, accountID).Scan(
+		&totp.Secret,
+		&confirmedAt,
+		&totp.LastUsedStep,
+		&totp.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if confirmedAt.Valid {
+		totp.ConfirmedAt = &confirmedAt.Time
+	}
+	return totp, nil
+}
+
+func (s *SQLiteStore) SaveTOTP(ctx context.Context, totp *TOTP) error {
+	q := `insert into totp(account_id, secret, created_at) values($1, $2, $3)
+		on conflict (account_id) do update
+			set secret = excluded.secret, created_at = excluded.created_at, last_used_step = 0
+			where totp.confirmed_at is null`
+
+	res, err := s.db.ExecContext(ctx, q, totp.AccountID, totp.Secret, totp.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return conflictError("two-factor authentication is already enabled")
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ConfirmTOTP(ctx context.Context, accountID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `update totp set confirmed_at=$1, last_used_step=$2 where account_id=$3 and confirmed_at is null`, time.Now().UTC(), step, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return conflictError("no pending two-factor enrollment")
+	}
+
+	if _, err := tx.ExecContext(ctx, `delete from recovery_code where account_id=$1`, accountID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.ExecContext(ctx, `insert into recovery_code(account_id, code_hash) values($1, $2)`, accountID, hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UseTOTPStep(ctx context.Context, accountID int, step int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `update totp set last_used_step=$1 where account_id=$2 and last_used_step < $1`, step, accountID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *SQLiteStore) UseRecoveryCode(ctx context.Context, accountID int, codeHash string) (bool, error) {
+	q := `update recovery_code set used_at=$1 where account_id=$2 and code_hash=$3 and used_at is null`
+
+	res, err := s.db.ExecContext(ctx, q, time.Now().UTC(), accountID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *SQLiteStore) DeleteTOTP(ctx context.Context, accountID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `delete from recovery_code where account_id=$1`, accountID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `delete from totp where account_id=$1`, accountID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReserveLoginAttempt counts an attempt to log in with email before its
+// credentials are checked. The transaction holds the write lock from its
+// start, so the check and the count cannot interleave with another attempt.
+// Stale counters are dropped as in PostgresStore.ReserveLoginAttempt.
+func (s *SQLiteStore) ReserveLoginAttempt(ctx context.Context, email string, at, staleBefore time.Time, retryAfter func(*LoginThrottle) time.Duration) (*LoginThrottle, time.Duration, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	q := `delete from email_login_throttle
+		where last_failure_at < $1 and (locked_until is null or locked_until <= $2)`
+	if _, err := tx.ExecContext(ctx, q, staleBefore.UTC(), at.UTC()); err != nil {
+		return nil, 0, err
+	}
+	throttle, err := scanLoginThrottle(email, tx.QueryRowContext(ctx, `select failures, last_failure_at, locked_until from email_login_throttle where email=$1`, email))
+	if err != nil {
+		return nil, 0, err
+	}
+	if wait := retryAfter(throttle); wait > 0 {
+		return throttle, wait, nil
+	}
+
+	q = `insert into email_login_throttle(email, failures, last_failure_at) values($1, 1, $2)
+		on conflict (email) do update
+			set failures = email_login_throttle.failures + 1, last_failure_at = excluded.last_failure_at
+		returning failures, last_failure_at, locked_until`
+	throttle, err = scanLoginThrottle(email, tx.QueryRowContext(ctx, q, email, at.UTC()))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return throttle, 0, tx.Commit()
+}
+
+func (s *SQLiteStore) LockLogin(ctx context.Context, email string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, `update email_login_throttle set locked_until=$1 where email=$2`, until.UTC(), email)
+	return err
+}
+
+func (s *SQLiteStore) ResetLoginThrottle(ctx context.Context, email string) error {
+	_, err := s.db.ExecContext(ctx, `delete from email_login_throttle where email=$1`, email)
+	return err
+}
+
+func (s *SQLiteStore) RecordLoginEvent(ctx context.Context, event *LoginEvent) error {
+	q := `insert into login_event(account_id, email, ip, event, created_at)
+		values($1, $2, $3, $4, $5)
+		returning id`
+
+	var accountID sql.NullInt64
+	if event.AccountID != 0 {
+		accountID = sql.NullInt64{Int64: int64(event.AccountID), Valid: true}
+	}
+
+	return s.db.QueryRowContext(ctx, q, accountID, event.Email, event.IP, event.Event, event.CreatedAt.UTC()).Scan(&event.ID)
+}
+
+func (s *SQLiteStore) GetLoginEvents(ctx context.Context, accountID int, limit int) ([]*LoginEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `select id, account_id, email, ip, event, created_at
+		from login_event where account_id=$1
+		order by id desc limit $2`, accountID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*LoginEvent{}
+	for rows.Next() {
+		e := &LoginEvent{}
+		if err := rows.Scan(&e.ID, &e.AccountID, &e.Email, &e.IP, &e.Event, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *SQLiteStore) CountLoginFailuresByIP(ctx context.Context, ip string, since time.Time) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `select count(*) from login_event
+		where ip=$1 and event in ($2, $3) and created_at >= $4`, ip, LoginEventFailed, LoginEventMFAFailed, since.UTC()).Scan(&n)
+	return n, err
+}
+
+// RecordPasswordResetRequest counts the reset requests for the event's email
+// and from its IP since the given time, and records the event if allow
+// accepts the counts. Write transactions take the database lock up front, so
+// concurrent requests see each other's events.
+func (s *SQLiteStore) RecordPasswordResetRequest(ctx context.Context, event *LoginEvent, since time.Time, allow func(byEmail, byIP int) bool) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var byEmail, byIP int
+	err = tx.QueryRowContext(ctx, `select count(*) filter (where email=$1), count(*) filter (where ip=$2)
+		from login_event
+		where event=$3 and created_at >= $4 and (email=$1 or ip=$2)`, event.Email, event.IP, LoginEventResetRequested, since.UTC()).Scan(&byEmail, &byIP)
+	if err != nil {
+		return false, err
+	}
+	if !allow(byEmail, byIP) {
+		return false, nil
+	}
+
+	var accountID sql.NullInt64
+	if event.AccountID != 0 {
+		accountID = sql.NullInt64{Int64: int64(event.AccountID), Valid: true}
+	}
+	q := `insert into login_event(account_id, email, ip, event, created_at)
+		values($1, $2, $3, $4, $5)
+		returning id`
+	if err := tx.QueryRowContext(ctx, q, accountID, event.Email, event.IP, event.Event, event.CreatedAt.UTC()).Scan(&event.ID); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (s *SQLiteStore) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `update password_reset set used_at=$1 where account_id=$2 and used_at is null`, reset.CreatedAt.UTC(), reset.AccountID); err != nil {
+		return err
+	}
+
+	q := `insert into password_reset(account_id, token_hash, created_at, expires_at)
+		values($1, $2, $3, $4)
+		returning id`
+	if err := tx.QueryRowContext(ctx, q, reset.AccountID, reset.TokenHash, reset.CreatedAt.UTC(), reset.ExpiresAt.UTC()).Scan(&reset.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ConsumePasswordReset(ctx context.Context, tokenHash string, at time.Time) (*PasswordReset, error) {
+	q := `update password_reset set used_at=$1
+		where token_hash=$2 and used_at is null and expires_at > $1
+		returning id, account_id, created_at, expires_at, used_at`
+
+	reset := &PasswordReset{TokenHash: tokenHash}
+	err := s.db.QueryRowContext(ctx, q, at.UTC(), tokenHash).Scan(
+		&reset.ID,
+		&reset.AccountID,
+		&reset.CreatedAt,
+		&reset.ExpiresAt,
+		&reset.UsedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFoundError("password reset token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reset, nil
+}
+
+func (s *SQLiteStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	q := `insert into api_key(account_id, name, prefix, key_hash, permissions, created_at)
+		values($1, $2, $3, $4, $5, $6)
+		returning id`
+
+	return s.db.QueryRowContext(ctx, q, key.AccountID, key.Name, key.Prefix, key.KeyHash, joinPermissions(key.Permissions), key.CreatedAt.UTC()).Scan(&key.ID)
+}
+
+func (s *SQLiteStore) GetAPIKeys(ctx context.Context, accountID int) ([]*APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `select id, account_id, name, prefix, key_hash, permissions, created_at, last_used_at, revoked_at
+		from api_key where account_id=$1
+		order by id desc`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *SQLiteStore) UseAPIKey(ctx context.Context, keyHash string, at time.Time) (*APIKey, error) {
+	row := s.db.QueryRowContext(ctx, `update api_key set last_used_at=$1
+		where key_hash=$2 and revoked_at is null
+		returning id, account_id, name, prefix, key_hash, permissions, created_at, last_used_at, revoked_at`, at.UTC(), keyHash)
+
+	key, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFoundError("api key not found")
+	}
+	return key, err
+}
+
+func (s *SQLiteStore) RevokeAPIKey(ctx context.Context, accountID, id int) error {
+	res, err := s.db.ExecContext(ctx, `update api_key set revoked_at=$1
+		where id=$2 and account_id=$3 and revoked_at is null`, time.Now().UTC(), id, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("api key %d not found", id)
+	}
+	return nil
+}
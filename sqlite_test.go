@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	store, err := NewSQLiteStore("sqlite://" + filepath.Join(t.TempDir(), "gomoni.db"))
+	if err != nil {
+		t.Fatalf("Error opening SQLite store: %v", err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+
+	if err := store.Init(); err != nil {
+		t.Fatalf("Error initializing SQLite store: %v", err)
+	}
+	return store
+}
+
+func TestNewSQLiteStore(t *testing.T) {
+	_, err := NewSQLiteStore("postgres://localhost/gomoni")
+	assert.Error(t, err)
+	_, err = NewSQLiteStore("sqlite://")
+	assert.Error(t, err)
+
+	store, err := NewSQLiteStore("sqlite://:memory:")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Init())
+	// Init is safe to run on every start.
+	assert.NoError(t, store.Init())
+	assert.NoError(t, store.DropTable())
+	assert.NoError(t, store.Init())
+}
+
+func TestSQLiteStoreNormalizesExistingEmails(t *testing.T) {
+	// A file created before emails were unique.
+	path := filepath.Join(t.TempDir(), "gomoni.db")
+	store, err := NewSQLiteStore("sqlite://" + path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { store.db.Close() })
+	_, err = store.db.Exec(`create table account (
+		id integer primary key autoincrement,
+		first_name varchar(50),
+		last_name varchar(50),
+		email varchar(255),
+		encrypted_password varchar(255),
+		phone bigint,
+		balance bigint not null default 0,
+		created_at timestamp,
+		role varchar(20) not null default 'customer',
+		token_version integer not null default 0,
+		email_verified boolean not null default false
+	)`)
+	assert.NoError(t, err)
+	_, err = store.db.Exec(`insert into account(first_name, last_name, email, encrypted_password, phone, created_at) values('Jane', 'Doe', ' Jane@Example.com', '', 0, $1)`, time.Now().UTC())
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Init())
+	assert.NoError(t, store.CreateAccount(&Account{Email: "john@example.com", CreatedAt: time.Now()}))
+	assert.ErrorIs(t, store.CreateAccount(&Account{Email: "john@example.com", CreatedAt: time.Now()}), ErrConflict)
+
+	jane, err := store.GetAccountByEmail("jane@example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, jane.ID)
+	}
+}
+
+func TestSQLiteStoreAccounts(t *testing.T) {
+	store := newTestSQLiteStore(t)
+
+	acc := &Account{FirstName: "John", LastName: "Doe", Email: "john@example.com", Balance: 100, CreatedAt: time.Now()}
+	assert.NoError(t, store.CreateAccount(acc))
+	assert.Equal(t, 1, acc.ID)
+	assert.Error(t, store.CreateAccount(&Account{Email: "john@example.com", CreatedAt: time.Now()}))
+
+	fetched, err := store.GetAccountByEmail("john@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), fetched.Balance)
+	assert.Equal(t, RoleCustomer, fetched.Role)
+	assert.WithinDuration(t, acc.CreatedAt, fetched.CreatedAt, time.Microsecond)
+
+	found, err := store.SearchAccounts("JOHN")
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+	found, err = store.SearchAccounts("_")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+
+	assert.ErrorIs(t, store.DeleteAccount(acc.ID), ErrConflict)
+	_, err = store.GetAccountByID(acc.ID)
+	assert.NoError(t, err)
+}
+
+func TestSQLiteStorePrunesExpiredIdempotencyKeys(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	for i, created := range []time.Time{now.Add(-2 * time.Hour), now} {
+		rec := &IdempotencyRecord{AccountID: i + 1, Key: "key", Fingerprint: "f", CreatedAt: created, ExpiresAt: created.Add(time.Hour)}
+		_, err := store.ReserveIdempotencyKey(ctx, rec)
+		assert.NoError(t, err)
+	}
+
+	var n int
+	assert.NoError(t, store.db.QueryRow(`select count(*) from idempotency_key`).Scan(&n))
+	assert.Equal(t, 1, n, "the expired key of the first account is gone")
+}
+
+func TestSQLiteStoreConcurrentTransfers(t *testing.T) {
+	store := newTestSQLiteStore(t)
+
+	from := &Account{Email: "bob@example.com", Balance: 100, CreatedAt: time.Now()}
+	to := &Account{Email: "carol@example.com", CreatedAt: time.Now()}
+	assert.NoError(t, store.CreateAccount(from))
+	assert.NoError(t, store.CreateAccount(to))
+
+	// Twenty transfers of 10 race in both directions; none may lose money.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%4 == 0 {
+				store.Transfer(context.Background(), to.ID, from.ID, 10)
+			} else {
+				store.Transfer(context.Background(), from.ID, to.ID, 10)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	fromAcc, err := store.GetAccountByID(from.ID)
+	assert.NoError(t, err)
+	toAcc, err := store.GetAccountByID(to.ID)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, fromAcc.Balance, int64(0))
+	assert.GreaterOrEqual(t, toAcc.Balance, int64(0))
+	assert.Equal(t, int64(100), fromAcc.Balance+toAcc.Balance)
+
+	report, err := store.CheckLedger(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), "ledger report: %+v", report)
+}
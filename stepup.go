@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	stepUpTokenHeader = "X-Step-Up-Token"
+	tokenTypeStepUp   = "step_up"
+
+	defaultStepUpTTL               = 5 * time.Minute
+	defaultStepUpTransferThreshold = 100000
+)
+
+// StepUpPolicy decides when a logged-in caller has to confirm their identity
+// again before a sensitive action.
+type StepUpPolicy struct {
+	// TransferThreshold is the largest amount that can be transferred
+	// without step-up authentication.
+	TransferThreshold int64
+	// TTL is how long an elevated token stays valid.
+	TTL time.Duration
+}
+
+func stepUpPolicyFromEnv() *StepUpPolicy {
+	return &StepUpPolicy{
+		TransferThreshold: int64(getEnvInt("STEP_UP_TRANSFER_THRESHOLD", defaultStepUpTransferThreshold)),
+		TTL:               getEnvDuration("STEP_UP_TTL", defaultStepUpTTL),
+	}
+}
+
+// createStepUpToken issues an elevated token bound to the caller's session,
+// so it is useless together with any other access token.
+func createStepUpToken(authCtx *AuthContext, ttl time.Duration) (string, error) {
+	return signJWT(jwt.MapClaims{
+		"id":  authCtx.AccountID,
+		"sid": authCtx.SessionID,
+		"typ": tokenTypeStepUp,
+		"exp": time.Now().Add(ttl).Unix(),
+	})
+}
+
+// hasStepUp reports whether the request carries a valid elevated token for
+// the caller's session.
+func hasStepUp(r *http.Request) bool {
+	authCtx, ok := GetAuthContext(r.Context())
+	if !ok || authCtx.SessionID == "" {
+		return false
+	}
+
+	claims, err := parseJWT(r.Header.Get(stepUpTokenHeader), tokenTypeStepUp)
+	if err != nil {
+		return false
+	}
+	accountID, _ := claims["id"].(float64)
+	sessionID, _ := claims["sid"].(string)
+	return int(accountID) == authCtx.AccountID && sessionID == authCtx.SessionID
+}
+
+// requireStepUp answers with a step-up challenge unless the request carries
+// an elevated token. When needed is nil every request needs one; otherwise
+// only those for which needed returns true. It must run after authWithJWT.
+func requireStepUp(needed func(*http.Request) bool, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if (needed == nil || needed(r)) && !hasStepUp(r) {
+			WriteJSON(w, http.StatusForbidden, &StepUpChallenge{
+				Code:           errCodeStepUpRequired,
+				Error:          "Step-up authentication required",
+				StepUpRequired: true,
+				Methods:        []string{"password", "totp"},
+			})
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+// isHighValueTransfer reports whether the transfer in the request body is
+// above the step-up threshold. The body is restored for the handler.
+func (s *APIServer) isHighValueTransfer(r *http.Request) bool {
+	transferReq, err := peekTransferRequest(r)
+	if err != nil {
+		// A body that cannot be checked needs step-up too.
+		return true
+	}
+	return transferReq.Amount > s.stepUpPolicy.TransferThreshold
+}
+
+// handleStepUp re-confirms the caller with their password or a second factor
+// and returns a short-lived elevated token for the X-Step-Up-Token header.
+// Failures count towards the login lockout.
+func (s *APIServer) handleStepUp(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+	if authCtx.SessionID == "" {
+		return WriteJSON(w, http.StatusForbidden, APIError{Code: errCodeSessionRequired, Error: "Step-up authentication requires a login session"})
+	}
+
+	var stepUpReq StepUpRequest
+	if err := decodeJSON(r, &stepUpReq); err != nil {
+		return err
+	}
+
+	acc, err := s.store.GetAccountByID(authCtx.AccountID)
+	if err != nil {
+		return err
+	}
+
+	throttle, retryAfter, err := s.reserveLoginAttempt(r, acc.Email)
+	if err != nil {
+		return err
+	}
+	if retryAfter > 0 {
+		s.recordLoginEvent(r, acc, acc.Email, LoginEventThrottled)
+		return tooManyAttempts(w, retryAfter)
+	}
+
+	var ok bool
+	event := LoginEventFailed
+	switch {
+	case stepUpReq.Password != "":
+		ok, err = currentPasswordHasher().Verify(stepUpReq.Password, acc.EncryptedPassword)
+		if err != nil {
+			log.Printf("Error verifying password of account %d: %v", acc.ID, err)
+		}
+	case strings.TrimSpace(stepUpReq.Code) != "" || strings.TrimSpace(stepUpReq.RecoveryCode) != "":
+		event = LoginEventMFAFailed
+		totp, err := s.store.GetTOTP(r.Context(), acc.ID)
+		if err != nil {
+			return err
+		}
+		if totp != nil && totp.Enabled() {
+			ok, err = s.checkSecondFactor(r, totp, stepUpReq.Code, stepUpReq.RecoveryCode)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !ok {
+		if err := s.recordLoginFailure(r, acc, acc.Email, event, throttle); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidCredentials, Error: "Invalid credentials"})
+	}
+	if err := s.store.ResetLoginThrottle(r.Context(), acc.Email); err != nil {
+		return err
+	}
+
+	token, err := createStepUpToken(authCtx, s.stepUpPolicy.TTL)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, &StepUpResponse{
+		StepUpToken: token,
+		ExpiresIn:   int(s.stepUpPolicy.TTL.Seconds()),
+	})
+}
@@ -1,21 +1,63 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Storage interface {
 	CreateAccount(*Account) error
 	DeleteAccount(int) error
 	UpdateAccount(*Account) error
+	UpdatePassword(ctx context.Context, accountID int, encryptedPassword string) error
+	UpdateEmail(ctx context.Context, accountID int, email string) error
 	GetAccounts() ([]*Account, error)
+	SearchAccounts(query string) ([]*Account, error)
 	GetAccountByID(int) (*Account, error)
 	GetAccountByEmail(string) (*Account, error)
+	VerifyEmail(ctx context.Context, accountID int, email string) error
+	Transfer(ctx context.Context, from, to int, amount int64) error
+	GetAccountTransactions(ctx context.Context, q *TransactionQuery) ([]*AccountTransaction, error)
+	CheckLedger(ctx context.Context) (*LedgerReport, error)
+	ReserveIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error)
+	CompleteIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) error
+	ReleaseIdempotencyKey(ctx context.Context, accountID int, key string) error
+	CreateRefreshToken(ctx context.Context, token *RefreshToken) error
+	RotateRefreshToken(ctx context.Context, tokenHash string, next *RefreshToken) (*RefreshToken, error)
+	CreateSession(ctx context.Context, session *Session) error
+	GetSessions(ctx context.Context, accountID int) ([]*Session, error)
+	UseSession(ctx context.Context, sessionID string, at time.Time) error
+	RevokeSession(ctx context.Context, sessionID string) error
+	RevokeAccountSession(ctx context.Context, accountID, id int) (*Session, error)
+	RevokeAllTokens(ctx context.Context, accountID int) error
+	RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, tokenID string) (bool, error)
+	GetTOTP(ctx context.Context, accountID int) (*TOTP, error)
+	SaveTOTP(ctx context.Context, totp *TOTP) error
+	ConfirmTOTP(ctx context.Context, accountID int, step int64, recoveryCodeHashes []string) error
+	UseTOTPStep(ctx context.Context, accountID int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, accountID int, codeHash string) (bool, error)
+	DeleteTOTP(ctx context.Context, accountID int) error
+	ReserveLoginAttempt(ctx context.Context, email string, at, staleBefore time.Time, retryAfter func(*LoginThrottle) time.Duration) (*LoginThrottle, time.Duration, error)
+	LockLogin(ctx context.Context, email string, until time.Time) error
+	ResetLoginThrottle(ctx context.Context, email string) error
+	RecordLoginEvent(ctx context.Context, event *LoginEvent) error
+	GetLoginEvents(ctx context.Context, accountID int, limit int) ([]*LoginEvent, error)
+	CountLoginFailuresByIP(ctx context.Context, ip string, since time.Time) (int, error)
+	RecordPasswordResetRequest(ctx context.Context, event *LoginEvent, since time.Time, allow func(byEmail, byIP int) bool) (bool, error)
+	CreatePasswordReset(ctx context.Context, reset *PasswordReset) error
+	ConsumePasswordReset(ctx context.Context, tokenHash string, at time.Time) (*PasswordReset, error)
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+	GetAPIKeys(ctx context.Context, accountID int) ([]*APIKey, error)
+	UseAPIKey(ctx context.Context, keyHash string, at time.Time) (*APIKey, error)
+	RevokeAPIKey(ctx context.Context, accountID, id int) error
 	DropTable() error
 }
 
@@ -24,17 +66,19 @@ type PostgresStore struct {
 }
 
 func (s *PostgresStore) DropTable() error {
-	_, err := s.db.Exec("DROP TABLE account")
+	_, err := s.db.Exec("DROP TABLE IF EXISTS session, api_key, password_reset, login_event, email_login_throttle, recovery_code, totp, revoked_token, refresh_token, idempotency_key, posting, journal_entry, account, schema_migrations")
 	return err
 }
 
 func NewPostgresStore() (*PostgresStore, error) {
-	if err := godotenv.Load(); err != nil {
+	if err := loadDotEnv(); err != nil {
 		return nil, err
 	}
 
-	connStr := os.Getenv("DB_URL")
+	return newPostgresStore(os.Getenv("DB_URL"))
+}
 
+func newPostgresStore(connStr string) (*PostgresStore, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
@@ -49,100 +93,398 @@ func NewPostgresStore() (*PostgresStore, error) {
 	}, nil
 }
 
+// Init brings the schema up to date by applying pending migrations.
 func (s *PostgresStore) Init() error {
-	return s.CreateAccountTable()
-}
-
-func (s *PostgresStore) CreateAccountTable() error {
-	query := `create table if not exists account (
-		id serial primary key,
-		first_name varchar(50),
-		last_name varchar(50),
-		email varchar(50),
-		encrypted_password varchar(100),
-		phone bigint,
-		balance serial,
-		created_at timestamp
-	)`
-
-	_, err := s.db.Exec(query)
-
+	_, err := NewMigrator(s.db, postgresMigrations).Up(context.Background())
 	return err
 }
 
 func (s *PostgresStore) GetAccountByEmail(email string) (*Account, error) {
-	rows, err := s.db.Query(`select * from account where email=$1`, email)
+	accounts, err := s.queryAccounts(`select `+accountColumns+` from account where email=$1`, email)
 	if err != nil {
 		return nil, err
 	}
-
-	for rows.Next() {
-		return scanIntoAccount(rows)
+	if len(accounts) == 0 {
+		return nil, notFoundError("account %s not found", email)
 	}
-	return nil, fmt.Errorf("account %s not found", email)
+	return accounts[0], nil
 }
 
 func (s *PostgresStore) CreateAccount(acc *Account) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	q := `insert into 
-		account(first_name, last_name, email, encrypted_password, phone, balance, created_at)
-		values($1, $2, $3, $4, $5, $6, $7)
+		account(first_name, last_name, email, encrypted_password, phone, balance, created_at, role, email_verified)
+		values($1, $2, $3, $4, $5, 0, $6, $7, $8)
 		returning id
 	`
-	err := s.db.QueryRow(q, acc.FirstName, acc.LastName, acc.Email, acc.EncryptedPassword, acc.Phone, acc.Balance, acc.CreatedAt).Scan(&acc.ID)
+	if acc.Role == "" {
+		acc.Role = RoleCustomer
+	}
+	if err := tx.QueryRow(q, acc.FirstName, acc.LastName, acc.Email, acc.EncryptedPassword, acc.Phone, acc.CreatedAt, acc.Role, acc.EmailVerified).Scan(&acc.ID); err != nil {
+		if isUniqueViolation(err) {
+			return conflictError("email %s is already registered", acc.Email)
+		}
+		return err
+	}
 
-	return err
+	if acc.Balance != 0 {
+		_, err := postEntry(context.Background(), tx, EntryKindOpening, acc.CreatedAt,
+			&Posting{AccountID: acc.ID, Amount: acc.Balance},
+			&Posting{AccountID: ExternalAccountID, Amount: -acc.Balance},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// VerifyEmail marks the account's email as verified, provided it is still the
+// address the verification link was sent to.
+func (s *PostgresStore) VerifyEmail(ctx context.Context, accountID int, email string) error {
+	res, err := s.db.ExecContext(ctx, `update account set email_verified=true where id=$1 and email=$2`, accountID, email)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("account %d with email [%s] not found", accountID, email)
+	}
+	return nil
 }
 
 func (s *PostgresStore) DeleteAccount(id int) error {
-	q := `delete from account where id=$1`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err := s.db.Query(q, id)
-	return err
+	var balance int64
+	err = tx.QueryRow(`select balance from account where id=$1 for update`, id).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if balance != 0 {
+		return conflictError("account %d still has a balance of %d", id, balance)
+	}
+
+	if _, err := tx.Exec(`delete from account where id=$1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
+// UpdateAccount saves the account's profile fields. The balance is ignored:
+// it only changes through ledger entries such as transfers.
 func (s *PostgresStore) UpdateAccount(account *Account) error {
-	q := `UPDATE account SET first_name=$1, last_name=$2, email=$3, encrypted_password=$4, phone=$5, balance=$6 WHERE id=$7`
+	q := `UPDATE account SET first_name=$1, last_name=$2, email=$3, encrypted_password=$4, phone=$5, role=$6, email_verified=$7 WHERE id=$8`
 
-	_, err := s.db.Exec(q, account.FirstName, account.LastName, account.Email, account.EncryptedPassword, account.Phone, account.Balance, account.ID)
+	res, err := s.db.Exec(q, account.FirstName, account.LastName, account.Email, account.EncryptedPassword, account.Phone, account.Role, account.EmailVerified, account.ID)
+	if isUniqueViolation(err) {
+		return conflictError("email %s is already registered", account.Email)
+	}
 	if err != nil {
-		return fmt.Errorf("error updating account: %v", err)
+		return fmt.Errorf("error updating account: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("account %d not found", account.ID)
 	}
 
 	return nil
 }
 
-func (s *PostgresStore) GetAccounts() ([]*Account, error) {
-	rows, err := s.db.Query(`select * from account`)
+// UpdatePassword replaces the account's password hash and leaves every other
+// field as it is.
+func (s *PostgresStore) UpdatePassword(ctx context.Context, accountID int, encryptedPassword string) error {
+	res, err := s.db.ExecContext(ctx, `update account set encrypted_password=$1 where id=$2`, encryptedPassword, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("account %d not found", accountID)
+	}
+	return nil
+}
+
+// UpdateEmail changes the account's email and marks it unverified.
+func (s *PostgresStore) UpdateEmail(ctx context.Context, accountID int, email string) error {
+	res, err := s.db.ExecContext(ctx, `update account set email=$1, email_verified=false where id=$2`, email, accountID)
+	if isUniqueViolation(err) {
+		return conflictError("email %s is already registered", email)
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("account %d not found", accountID)
+	}
+	return nil
+}
+
+// Transfer moves amount from one account to another inside a single
+// transaction. Both rows are locked in ascending id order so that concurrent
+// transfers between the same accounts cannot deadlock or overdraw.
+func (s *PostgresStore) Transfer(ctx context.Context, from, to int, amount int64) error {
+	if amount <= 0 {
+		return validationError("transfer amount must be positive")
+	}
+	if from == to {
+		return validationError("cannot transfer to the same account")
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `select id, balance from account where id in ($1, $2) order by id for update`, from, to)
+	if err != nil {
+		return err
+	}
+
+	balances := map[int]int64{}
+	for rows.Next() {
+		var id int
+		var balance int64
+		if err := rows.Scan(&id, &balance); err != nil {
+			rows.Close()
+			return err
+		}
+		balances[id] = balance
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	fromBalance, ok := balances[from]
+	if !ok {
+		return notFoundError("account %d not found", from)
+	}
+	if _, ok := balances[to]; !ok {
+		return notFoundError("account %d not found", to)
+	}
+	if fromBalance < amount {
+		return ErrInsufficientFunds
+	}
+
+	_, err = postEntry(ctx, tx, EntryKindTransfer, time.Now().UTC(),
+		&Posting{AccountID: from, Amount: -amount},
+		&Posting{AccountID: to, Amount: amount},
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// postEntry records a balanced journal entry and applies each posting to the
+// balance of its account. It must run inside tx after the affected account
+// rows have been locked.
+func postEntry(ctx context.Context, tx *sql.Tx, kind string, createdAt time.Time, postings ...*Posting) (*JournalEntry, error) {
+	var sum int64
+	for _, p := range postings {
+		sum += p.Amount
+	}
+	if sum != 0 {
+		return nil, fmt.Errorf("unbalanced journal entry: postings sum to %d", sum)
+	}
+
+	entry := &JournalEntry{
+		Kind:      kind,
+		Postings:  postings,
+		CreatedAt: createdAt,
+	}
+
+	err := tx.QueryRowContext(ctx, `insert into journal_entry(kind, created_at) values($1, $2) returning id`, kind, createdAt).Scan(&entry.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	accounts := []*Account{}
+	for _, p := range postings {
+		p.EntryID = entry.ID
+
+		if p.AccountID != ExternalAccountID {
+			err := tx.QueryRowContext(ctx, `update account set balance = balance + $1 where id=$2 returning balance`, p.Amount, p.AccountID).Scan(&p.BalanceAfter)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, notFoundError("account %d not found", p.AccountID)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
 
+		q := `insert into posting(entry_id, account_id, amount, balance_after) values($1, $2, $3, $4) returning id`
+		if err := tx.QueryRowContext(ctx, q, p.EntryID, p.AccountID, p.Amount, p.BalanceAfter).Scan(&p.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+func (s *PostgresStore) GetAccountTransactions(ctx context.Context, q *TransactionQuery) ([]*AccountTransaction, error) {
+	query := `select p.id, p.entry_id, e.kind, p.amount, coalesce(o.account_id, 0), p.balance_after, e.created_at
+		from posting p
+		join journal_entry e on e.id = p.entry_id
+		left join posting o on o.entry_id = p.entry_id and o.id <> p.id
+		where p.account_id = $1`
+	args := []any{q.AccountID}
+
+	if q.Before > 0 {
+		args = append(args, q.Before)
+		query += fmt.Sprintf(" and p.id < $%d", len(args))
+	}
+	if !q.From.IsZero() {
+		args = append(args, q.From)
+		query += fmt.Sprintf(" and e.created_at >= $%d", len(args))
+	}
+	if !q.To.IsZero() {
+		args = append(args, q.To)
+		query += fmt.Sprintf(" and e.created_at < $%d", len(args))
+	}
+
+	args = append(args, q.Limit)
+	query += fmt.Sprintf(" order by p.id desc limit $%d", len(args))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []*AccountTransaction{}
 	for rows.Next() {
-		account, err := scanIntoAccount(rows)
-		if err != nil {
+		t := &AccountTransaction{}
+		if err := rows.Scan(&t.ID, &t.EntryID, &t.Kind, &t.Amount, &t.Counterparty, &t.BalanceAfter, &t.CreatedAt); err != nil {
 			return nil, err
 		}
 
-		accounts = append(accounts, account)
+		t.Direction = DirectionCredit
+		if t.Amount < 0 {
+			t.Direction = DirectionDebit
+			t.Amount = -t.Amount
+		}
+
+		transactions = append(transactions, t)
 	}
 
-	return accounts, nil
+	return transactions, rows.Err()
+}
+
+// CheckLedger compares every cached account balance with the sum of its
+// postings and looks for journal entries that do not balance.
+func (s *PostgresStore) CheckLedger(ctx context.Context) (*LedgerReport, error) {
+	report := &LedgerReport{
+		Mismatches:        []*BalanceMismatch{},
+		UnbalancedEntries: []int{},
+	}
+
+	rows, err := s.db.QueryContext(ctx, `select a.id, a.balance, coalesce(sum(p.amount), 0)
+		from account a left join posting p on p.account_id = a.id
+		group by a.id, a.balance
+		having a.balance <> coalesce(sum(p.amount), 0)
+		order by a.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := &BalanceMismatch{}
+		if err := rows.Scan(&m.AccountID, &m.Balance, &m.LedgerBalance); err != nil {
+			return nil, err
+		}
+		report.Mismatches = append(report.Mismatches, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, `select entry_id from posting group by entry_id having sum(amount) <> 0 order by entry_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		report.UnbalancedEntries = append(report.UnbalancedEntries, id)
+	}
+
+	return report, rows.Err()
+}
+
+func (s *PostgresStore) GetAccounts() ([]*Account, error) {
+	return s.queryAccounts(`select ` + accountColumns + ` from account order by id`)
+}
+
+// SearchAccounts returns the accounts whose name or email contains query,
+// ignoring case.
+func (s *PostgresStore) SearchAccounts(query string) ([]*Account, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+
+	return s.queryAccounts(`select `+accountColumns+` from account
+		where first_name ilike $1 or last_name ilike $1 or email ilike $1
+		order by id`, pattern)
 }
 
 func (s *PostgresStore) GetAccountByID(id int) (*Account, error) {
-	rows, err := s.db.Query(`select * from account where id=$1`, id)
+	accounts, err := s.queryAccounts(`select `+accountColumns+` from account where id=$1`, id)
 	if err != nil {
 		return nil, err
 	}
+	if len(accounts) == 0 {
+		return nil, notFoundError("account %d not found", id)
+	}
+	return accounts[0], nil
+}
 
+// queryAccounts runs a query over accountColumns and scans every row.
+func (s *PostgresStore) queryAccounts(query string, args ...any) ([]*Account, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
 	for rows.Next() {
-		return scanIntoAccount(rows)
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
 	}
-	return nil, fmt.Errorf("account %d not found", id)
+
+	return accounts, rows.Err()
+}
+
+// isUniqueViolation reports whether err is a Postgres unique_violation, such
+// as a second account with the same email.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
 }
 
+// accountColumns lists the account columns in the order scanIntoAccount
+// reads them.
+const accountColumns = `id, first_name, last_name, email, encrypted_password, phone, balance, created_at, role, token_version, email_verified`
+
 func scanIntoAccount(rows *sql.Rows) (*Account, error) {
 	account := &Account{}
 
@@ -155,7 +497,693 @@ func scanIntoAccount(rows *sql.Rows) (*Account, error) {
 		&account.Phone,
 		&account.Balance,
 		&account.CreatedAt,
+		&account.Role,
+		&account.TokenVersion,
+		&account.EmailVerified,
 	)
 
 	return account, err
 }
+
+// ReserveIdempotencyKey claims rec's key for a new request. If a live record
+// already holds the key it is returned instead and nothing is written; an
+// expired record is replaced. Records of any account past their expiry are
+// pruned.
+func (s *PostgresStore) ReserveIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	if _, err := s.db.ExecContext(ctx, `delete from idempotency_key where expires_at <= $1`, rec.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	insert := `insert into idempotency_key(account_id, key, fingerprint, created_at, expires_at)
+		values($1, $2, $3, $4, $5)
+		on conflict (account_id, key) do update
+			set fingerprint = excluded.fingerprint, status_code = 0, response = null,
+				created_at = excluded.created_at, expires_at = excluded.expires_at
+			where idempotency_key.expires_at <= excluded.created_at
+		returning account_id`
+
+	// The existing record can expire or be released between the two
+	// statements, so try again once before giving up.
+	for attempt := 0; attempt < 2; attempt++ {
+		var id int
+		err := s.db.QueryRowContext(ctx, insert, rec.AccountID, rec.Key, rec.Fingerprint, rec.CreatedAt, rec.ExpiresAt).Scan(&id)
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		existing := &IdempotencyRecord{AccountID: rec.AccountID, Key: rec.Key}
+		err = s.db.QueryRowContext(ctx, `select fingerprint, status_code, response, created_at, expires_at
+			from idempotency_key where account_id=$1 and key=$2`, rec.AccountID, rec.Key).Scan(
+			&existing.Fingerprint,
+			&existing.StatusCode,
+			&existing.Response,
+			&existing.CreatedAt,
+			&existing.ExpiresAt,
+		)
+		if err == nil {
+			return existing, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	return nil, conflictError("idempotency key %q is busy, try again", rec.Key)
+}
+
+func (s *PostgresStore) CompleteIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) error {
+	q := `update idempotency_key set status_code=$1, response=$2 where account_id=$3 and key=$4`
+
+	_, err := s.db.ExecContext(ctx, q, rec.StatusCode, rec.Response, rec.AccountID, rec.Key)
+	return err
+}
+
+func (s *PostgresStore) ReleaseIdempotencyKey(ctx context.Context, accountID int, key string) error {
+	_, err := s.db.ExecContext(ctx, `delete from idempotency_key where account_id=$1 and key=$2`, accountID, key)
+	return err
+}
+
+func (s *PostgresStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	q := `insert into refresh_token(account_id, session_id, token_hash, created_at, expires_at, scope)
+		values($1, $2, $3, $4, $5, $6)
+		returning id`
+
+	return s.db.QueryRowContext(ctx, q, token.AccountID, token.SessionID, token.TokenHash, token.CreatedAt, token.ExpiresAt, joinPermissions(token.Scopes)).Scan(&token.ID)
+}
+
+// RotateRefreshToken spends the refresh token with the given hash and stores
+// next in its place, in the same session and with the same scopes. It
+// returns the spent token.
+// Presenting a token that was already rotated revokes the whole session,
+// since only a stolen copy can be replayed.
+func (s *PostgresStore) RotateRefreshToken(ctx context.Context, tokenHash string, next *RefreshToken) (*RefreshToken, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current := &RefreshToken{TokenHash: tokenHash}
+	var revokedAt sql.NullTime
+	var scope string
+	err = tx.QueryRowContext(ctx, `select id, account_id, session_id, created_at, expires_at, revoked_at, scope
+		from refresh_token where token_hash=$1 for update`, tokenHash).Scan(
+		&current.ID,
+		&current.AccountID,
+		&current.SessionID,
+		&current.CreatedAt,
+		&current.ExpiresAt,
+		&revokedAt,
+		&scope,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFoundError("refresh token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid {
+		if err := revokeSession(ctx, tx, current.SessionID, next.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("refresh token reuse detected, session %s revoked", current.SessionID)
+	}
+
+	if !current.ExpiresAt.After(next.CreatedAt) {
+		return nil, fmt.Errorf("refresh token expired")
+	}
+
+	if _, err := tx.ExecContext(ctx, `update refresh_token set revoked_at=$1 where id=$2`, next.CreatedAt, current.ID); err != nil {
+		return nil, err
+	}
+
+	if scope != "" {
+		current.Scopes = splitPermissions(scope)
+	}
+	next.AccountID = current.AccountID
+	next.SessionID = current.SessionID
+	next.Scopes = current.Scopes
+
+	q := `insert into refresh_token(account_id, session_id, token_hash, created_at, expires_at, scope)
+		values($1, $2, $3, $4, $5, $6)
+		returning id`
+	if err := tx.QueryRowContext(ctx, q, next.AccountID, next.SessionID, next.TokenHash, next.CreatedAt, next.ExpiresAt, scope).Scan(&next.ID); err != nil {
+		return nil, err
+	}
+
+	return current, tx.Commit()
+}
+
+func (s *PostgresStore) CreateSession(ctx context.Context, session *Session) error {
+	q := `insert into session(session_id, account_id, user_agent, ip, created_at, last_used_at)
+		values($1, $2, $3, $4, $5, $6)
+		returning id`
+
+	return s.db.QueryRowContext(ctx, q, session.SessionID, session.AccountID, session.UserAgent, session.IP, session.CreatedAt, session.LastUsedAt).Scan(&session.ID)
+}
+
+// GetSessions lists the account's sessions that were not signed out, most
+// recently used first.
+func (s *PostgresStore) GetSessions(ctx context.Context, accountID int) ([]*Session, error) {
+	rows, err := s.db.QueryContext(ctx, `select id, session_id, account_id, user_agent, ip, created_at, last_used_at
+		from session where account_id=$1 and revoked_at is null
+		order by last_used_at desc, id desc`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session := &Session{}
+		err := rows.Scan(
+			&session.ID,
+			&session.SessionID,
+			&session.AccountID,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// UseSession records that the session was used. It fails if the session
+// does not exist or was signed out.
+func (s *PostgresStore) UseSession(ctx context.Context, sessionID string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `update session set last_used_at=$1
+		where session_id=$2 and revoked_at is null`, at, sessionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("session %s not found", sessionID)
+	}
+	return nil
+}
+
+// RevokeSession signs a session out and revokes its refresh tokens.
+func (s *PostgresStore) RevokeSession(ctx context.Context, sessionID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeSession(ctx, tx, sessionID, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RevokeAccountSession signs out the account's session with the given public
+// ID and returns it.
+func (s *PostgresStore) RevokeAccountSession(ctx context.Context, accountID, id int) (*Session, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	session := &Session{ID: id, AccountID: accountID}
+	err = tx.QueryRowContext(ctx, `select session_id from session
+		where id=$1 and account_id=$2 and revoked_at is null for update`, id, accountID).Scan(&session.SessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFoundError("session %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := revokeSession(ctx, tx, session.SessionID, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return session, tx.Commit()
+}
+
+func revokeSession(ctx context.Context, tx *sql.Tx, sessionID string, at time.Time) error {
+	if _, err := tx.ExecContext(ctx, `update session set revoked_at=$1 where session_id=$2 and revoked_at is null`, at, sessionID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `update refresh_token set revoked_at=$1 where session_id=$2 and revoked_at is null`, at, sessionID)
+	return err
+}
+
+// RevokeAllTokens ends every session of an account: its refresh tokens are
+// revoked and the token version bump invalidates outstanding access tokens.
+func (s *PostgresStore) RevokeAllTokens(ctx context.Context, accountID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `update account set token_version = token_version + 1 where id=$1`, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("account %d not found", accountID)
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `update session set revoked_at=$1 where account_id=$2 and revoked_at is null`, now, accountID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `update refresh_token set revoked_at=$1 where account_id=$2 and revoked_at is null`, now, accountID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RevokeToken adds an access token ID to the revocation list until the token
+// would have expired anyway. Entries past their expiry are pruned.
+func (s *PostgresStore) RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx, `delete from revoked_token where expires_at < $1`, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, `insert into revoked_token(jti, expires_at) values($1, $2) on conflict (jti) do nothing`, tokenID, expiresAt)
+	return err
+}
+
+func (s *PostgresStore) IsTokenRevoked(ctx context.Context, tokenID string) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRowContext(ctx, `select exists(select 1 from revoked_token where jti=$1)`, tokenID).Scan(&revoked)
+	return revoked, err
+}
+
+// GetTOTP returns the account's two-factor enrollment, or nil if it has
+// none.
+func (s *PostgresStore) GetTOTP(ctx context.Context, accountID int) (*TOTP, error) {
+	totp := &TOTP{AccountID: accountID}
+	var confirmedAt sql.NullTime
+
+	err := s.db.QueryRowContext(ctx, `select secret, confirmed_at, last_used_step, created_at from totp where account_id=$1`, accountID).Scan(
+		&totp.Secret,
+		&confirmedAt,
+		&totp.LastUsedStep,
+		&totp.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if confirmedAt.Valid {
+		totp.ConfirmedAt = &confirmedAt.Time
+	}
+	return totp, nil
+}
+
+// SaveTOTP stores a new, unconfirmed secret, replacing any earlier
+// enrollment that was never confirmed.
+func (s *PostgresStore) SaveTOTP(ctx context.Context, totp *TOTP) error {
+	q := `insert into totp(account_id, secret, created_at) values($1, $2, $3)
+		on conflict (account_id) do update
+			set secret = excluded.secret, created_at = excluded.created_at, last_used_step = 0
+			where totp.confirmed_at is null`
+
+	res, err := s.db.ExecContext(ctx, q, totp.AccountID, totp.Secret, totp.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return conflictError("two-factor authentication is already enabled")
+	}
+	return nil
+}
+
+// ConfirmTOTP enables the pending enrollment and replaces the account's
+// recovery codes.
+func (s *PostgresStore) ConfirmTOTP(ctx context.Context, accountID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `update totp set confirmed_at=$1, last_used_step=$2 where account_id=$3 and confirmed_at is null`, time.Now().UTC(), step, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return conflictError("no pending two-factor enrollment")
+	}
+
+	if _, err := tx.ExecContext(ctx, `delete from recovery_code where account_id=$1`, accountID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.ExecContext(ctx, `insert into recovery_code(account_id, code_hash) values($1, $2)`, accountID, hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code for step was used. It reports false if
+// that step or a later one was already used.
+func (s *PostgresStore) UseTOTPStep(ctx context.Context, accountID int, step int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `update totp set last_used_step=$1 where account_id=$2 and last_used_step < $1`, step, accountID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStore) UseRecoveryCode(ctx context.Context, accountID int, codeHash string) (bool, error) {
+	q := `update recovery_code set used_at=$1 where account_id=$2 and code_hash=$3 and used_at is null`
+
+	res, err := s.db.ExecContext(ctx, q, time.Now().UTC(), accountID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStore) DeleteTOTP(ctx context.Context, accountID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `delete from recovery_code where account_id=$1`, accountID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `delete from totp where account_id=$1`, accountID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReserveLoginAttempt counts an attempt to log in with email as a failure
+// before its credentials are checked. The row stays locked between the check
+// and the count, so parallel attempts cannot all pass the throttle. When
+// retryAfter refuses the attempt, nothing is counted and the wait is
+// returned. Counters of any email whose last failure is before staleBefore
+// and that is not locked are dropped, so that guessed emails do not pile up.
+func (s *PostgresStore) ReserveLoginAttempt(ctx context.Context, email string, at, staleBefore time.Time, retryAfter func(*LoginThrottle) time.Duration) (*LoginThrottle, time.Duration, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	q := `delete from email_login_throttle
+		where last_failure_at < $1 and (locked_until is null or locked_until <= $2)`
+	if _, err := tx.ExecContext(ctx, q, staleBefore, at); err != nil {
+		return nil, 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `insert into email_login_throttle(email) values($1) on conflict (email) do nothing`, email); err != nil {
+		return nil, 0, err
+	}
+	throttle, err := scanLoginThrottle(email, tx.QueryRowContext(ctx, `select failures, last_failure_at, locked_until from email_login_throttle where email=$1 for update`, email))
+	if err != nil {
+		return nil, 0, err
+	}
+	if wait := retryAfter(throttle); wait > 0 {
+		return throttle, wait, nil
+	}
+
+	q = `update email_login_throttle set failures = failures + 1, last_failure_at = $2 where email=$1
+		returning failures, last_failure_at, locked_until`
+	throttle, err = scanLoginThrottle(email, tx.QueryRowContext(ctx, q, email, at))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return throttle, 0, tx.Commit()
+}
+
+func (s *PostgresStore) LockLogin(ctx context.Context, email string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, `update email_login_throttle set locked_until=$1 where email=$2`, until, email)
+	return err
+}
+
+// ResetLoginThrottle clears the failure count and any lockout, after a
+// successful login or when an admin unlocks the account.
+func (s *PostgresStore) ResetLoginThrottle(ctx context.Context, email string) error {
+	_, err := s.db.ExecContext(ctx, `delete from email_login_throttle where email=$1`, email)
+	return err
+}
+
+func scanLoginThrottle(email string, row *sql.Row) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{Email: email}
+	var lastFailureAt, lockedUntil sql.NullTime
+
+	err := row.Scan(&throttle.Failures, &lastFailureAt, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return throttle, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	throttle.LastFailureAt = lastFailureAt.Time
+	if lockedUntil.Valid {
+		throttle.LockedUntil = &lockedUntil.Time
+	}
+	return throttle, nil
+}
+
+func (s *PostgresStore) RecordLoginEvent(ctx context.Context, event *LoginEvent) error {
+	q := `insert into login_event(account_id, email, ip, event, created_at)
+		values($1, $2, $3, $4, $5)
+		returning id`
+
+	var accountID sql.NullInt64
+	if event.AccountID != 0 {
+		accountID = sql.NullInt64{Int64: int64(event.AccountID), Valid: true}
+	}
+
+	return s.db.QueryRowContext(ctx, q, accountID, event.Email, event.IP, event.Event, event.CreatedAt).Scan(&event.ID)
+}
+
+func (s *PostgresStore) GetLoginEvents(ctx context.Context, accountID int, limit int) ([]*LoginEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `select id, account_id, email, ip, event, created_at
+		from login_event where account_id=$1
+		order by id desc limit $2`, accountID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*LoginEvent{}
+	for rows.Next() {
+		e := &LoginEvent{}
+		if err := rows.Scan(&e.ID, &e.AccountID, &e.Email, &e.IP, &e.Event, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// CountLoginFailuresByIP counts failed password and code attempts from ip
+// since the given time.
+func (s *PostgresStore) CountLoginFailuresByIP(ctx context.Context, ip string, since time.Time) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `select count(*) from login_event
+		where ip=$1 and event in ($2, $3) and created_at >= $4`, ip, LoginEventFailed, LoginEventMFAFailed, since).Scan(&n)
+	return n, err
+}
+
+// RecordPasswordResetRequest counts the reset requests for the event's email
+// and from its IP since the given time, and records the event if allow
+// accepts the counts. Requests for the same email or from the same IP wait
+// for each other, so that a burst cannot all see the same counts.
+func (s *PostgresStore) RecordPasswordResetRequest(ctx context.Context, event *LoginEvent, since time.Time, allow func(byEmail, byIP int) bool) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Emails and IPs are locked in separate key spaces and always in this
+	// order, so that two requests cannot deadlock.
+	if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock(1, hashtext($1))`, event.Email); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock(2, hashtext($1))`, event.IP); err != nil {
+		return false, err
+	}
+
+	var byEmail, byIP int
+	err = tx.QueryRowContext(ctx, `select count(*) filter (where email=$1), count(*) filter (where ip=$2)
+		from login_event
+		where event=$3 and created_at >= $4 and (email=$1 or ip=$2)`, event.Email, event.IP, LoginEventResetRequested, since).Scan(&byEmail, &byIP)
+	if err != nil {
+		return false, err
+	}
+	if !allow(byEmail, byIP) {
+		return false, nil
+	}
+
+	var accountID sql.NullInt64
+	if event.AccountID != 0 {
+		accountID = sql.NullInt64{Int64: int64(event.AccountID), Valid: true}
+	}
+	q := `insert into login_event(account_id, email, ip, event, created_at)
+		values($1, $2, $3, $4, $5)
+		returning id`
+	if err := tx.QueryRowContext(ctx, q, accountID, event.Email, event.IP, event.Event, event.CreatedAt).Scan(&event.ID); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// CreatePasswordReset stores a new reset token for the account. Tokens the
+// account was sent earlier are spent, so only the latest email works.
+func (s *PostgresStore) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `update password_reset set used_at=$1 where account_id=$2 and used_at is null`, reset.CreatedAt, reset.AccountID); err != nil {
+		return err
+	}
+
+	q := `insert into password_reset(account_id, token_hash, created_at, expires_at)
+		values($1, $2, $3, $4)
+		returning id`
+	if err := tx.QueryRowContext(ctx, q, reset.AccountID, reset.TokenHash, reset.CreatedAt, reset.ExpiresAt).Scan(&reset.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ConsumePasswordReset marks the reset token with the given hash as used and
+// returns it. Unknown, used and expired tokens are rejected.
+func (s *PostgresStore) ConsumePasswordReset(ctx context.Context, tokenHash string, at time.Time) (*PasswordReset, error) {
+	q := `update password_reset set used_at=$1
+		where token_hash=$2 and used_at is null and expires_at > $1
+		returning id, account_id, created_at, expires_at, used_at`
+
+	reset := &PasswordReset{TokenHash: tokenHash}
+	err := s.db.QueryRowContext(ctx, q, at, tokenHash).Scan(
+		&reset.ID,
+		&reset.AccountID,
+		&reset.CreatedAt,
+		&reset.ExpiresAt,
+		&reset.UsedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFoundError("password reset token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reset, nil
+}
+
+func (s *PostgresStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	q := `insert into api_key(account_id, name, prefix, key_hash, permissions, created_at)
+		values($1, $2, $3, $4, $5, $6)
+		returning id`
+
+	return s.db.QueryRowContext(ctx, q, key.AccountID, key.Name, key.Prefix, key.KeyHash, joinPermissions(key.Permissions), key.CreatedAt).Scan(&key.ID)
+}
+
+// GetAPIKeys lists the account's keys, including revoked ones, newest first.
+func (s *PostgresStore) GetAPIKeys(ctx context.Context, accountID int) ([]*APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `select id, account_id, name, prefix, key_hash, permissions, created_at, last_used_at, revoked_at
+		from api_key where account_id=$1
+		order by id desc`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// UseAPIKey looks up a live key by its hash and records that it was used.
+func (s *PostgresStore) UseAPIKey(ctx context.Context, keyHash string, at time.Time) (*APIKey, error) {
+	row := s.db.QueryRowContext(ctx, `update api_key set last_used_at=$1
+		where key_hash=$2 and revoked_at is null
+		returning id, account_id, name, prefix, key_hash, permissions, created_at, last_used_at, revoked_at`, at, keyHash)
+
+	key, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFoundError("api key not found")
+	}
+	return key, err
+}
+
+func (s *PostgresStore) RevokeAPIKey(ctx context.Context, accountID, id int) error {
+	res, err := s.db.ExecContext(ctx, `update api_key set revoked_at=$1
+		where id=$2 and account_id=$3 and revoked_at is null`, time.Now().UTC(), id, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFoundError("api key %d not found", id)
+	}
+	return nil
+}
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	key := &APIKey{}
+	var permissions string
+	var lastUsedAt, revokedAt sql.NullTime
+
+	err := row.Scan(
+		&key.ID,
+		&key.AccountID,
+		&key.Name,
+		&key.Prefix,
+		&key.KeyHash,
+		&permissions,
+		&key.CreatedAt,
+		&lastUsedAt,
+		&revokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Permissions = splitPermissions(permissions)
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
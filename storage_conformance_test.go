@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStorageConformance checks the behavior every Storage must share.
+// newStore returns an empty, initialized store for each subtest.
+func testStorageConformance(t *testing.T, newStore func(t *testing.T) Storage) {
+	newAccount := func(email string, balance int64) *Account {
+		return &Account{
+			FirstName:         "Test",
+			LastName:          "User",
+			Email:             email,
+			EncryptedPassword: "encrypted_password",
+			Phone:             1234567890,
+			Balance:           balance,
+			CreatedAt:         time.Now().UTC().Truncate(time.Microsecond),
+		}
+	}
+
+	t.Run("Create and get", func(t *testing.T) {
+		store := newStore(t)
+
+		acc := newAccount("john@example.com", 1000)
+		acc.FirstName, acc.LastName = "John", "Doe"
+		assert.NoError(t, store.CreateAccount(acc))
+		assert.NotEqual(t, 0, acc.ID)
+		assert.Equal(t, RoleCustomer, acc.Role)
+
+		for _, get := range []func() (*Account, error){
+			func() (*Account, error) { return store.GetAccountByID(acc.ID) },
+			func() (*Account, error) { return store.GetAccountByEmail(acc.Email) },
+		} {
+			fetched, err := get()
+			if !assert.NoError(t, err) {
+				continue
+			}
+			assert.Equal(t, acc.ID, fetched.ID)
+			assert.Equal(t, "John", fetched.FirstName)
+			assert.Equal(t, "Doe", fetched.LastName)
+			assert.Equal(t, acc.Email, fetched.Email)
+			assert.Equal(t, acc.EncryptedPassword, fetched.EncryptedPassword)
+			assert.Equal(t, acc.Phone, fetched.Phone)
+			assert.Equal(t, int64(1000), fetched.Balance)
+			assert.Equal(t, RoleCustomer, fetched.Role)
+			assert.False(t, fetched.EmailVerified)
+			assert.WithinDuration(t, acc.CreatedAt, fetched.CreatedAt, time.Millisecond)
+		}
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		store := newStore(t)
+		acc := newAccount("john@example.com", 100)
+		assert.NoError(t, store.CreateAccount(acc))
+
+		_, err := store.GetAccountByID(acc.ID + 1000)
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = store.GetAccountByEmail("nobody@example.com")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		missing := newAccount("missing@example.com", 0)
+		missing.ID = acc.ID + 1000
+		assert.ErrorIs(t, store.UpdateAccount(missing), ErrNotFound)
+		assert.ErrorIs(t, store.Transfer(context.Background(), acc.ID, missing.ID, 10), ErrNotFound)
+		assert.ErrorIs(t, store.Transfer(context.Background(), missing.ID, acc.ID, 10), ErrNotFound)
+
+		fetched, err := store.GetAccountByID(acc.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(100), fetched.Balance)
+	})
+
+	t.Run("Email lookup", func(t *testing.T) {
+		store := newStore(t)
+		john := newAccount("john@example.com", 0)
+		jane := newAccount("jane@example.com", 0)
+		assert.NoError(t, store.CreateAccount(john))
+		assert.NoError(t, store.CreateAccount(jane))
+
+		fetched, err := store.GetAccountByEmail("jane@example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, jane.ID, fetched.ID)
+
+		// Email addresses are unique.
+		assert.ErrorIs(t, store.CreateAccount(newAccount("jane@example.com", 0)), ErrConflict)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t)
+		acc := newAccount("john@example.com", 500)
+		other := newAccount("jane@example.com", 0)
+		assert.NoError(t, store.CreateAccount(acc))
+		assert.NoError(t, store.CreateAccount(other))
+
+		acc.FirstName = "Johnny"
+		acc.Email = "johnny@example.com"
+		acc.EncryptedPassword = "new_password"
+		acc.Role = RoleAdmin
+		acc.EmailVerified = true
+		acc.Balance = 750 // ignored: balances only change through the ledger
+		assert.NoError(t, store.UpdateAccount(acc))
+
+		fetched, err := store.GetAccountByID(acc.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "Johnny", fetched.FirstName)
+		assert.Equal(t, "johnny@example.com", fetched.Email)
+		assert.Equal(t, "new_password", fetched.EncryptedPassword)
+		assert.Equal(t, RoleAdmin, fetched.Role)
+		assert.True(t, fetched.EmailVerified)
+		assert.Equal(t, int64(500), fetched.Balance)
+
+		_, err = store.GetAccountByEmail("john@example.com")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		// Taking another account's email fails.
+		other.Email = "johnny@example.com"
+		assert.ErrorIs(t, store.UpdateAccount(other), ErrConflict)
+		assert.ErrorIs(t, store.UpdateEmail(context.Background(), other.ID, "johnny@example.com"), ErrConflict)
+
+		assert.NoError(t, store.UpdatePassword(context.Background(), acc.ID, "newer_password"))
+		assert.NoError(t, store.UpdateEmail(context.Background(), acc.ID, "john@example.com"))
+		assert.ErrorIs(t, store.UpdatePassword(context.Background(), acc.ID+1000, "x"), ErrNotFound)
+		assert.ErrorIs(t, store.UpdateEmail(context.Background(), acc.ID+1000, "x@example.com"), ErrNotFound)
+
+		fetched, err = store.GetAccountByID(acc.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "newer_password", fetched.EncryptedPassword)
+		assert.Equal(t, "john@example.com", fetched.Email)
+		assert.False(t, fetched.EmailVerified)
+		assert.Equal(t, "Johnny", fetched.FirstName)
+		assert.Equal(t, int64(500), fetched.Balance)
+
+		report, err := store.CheckLedger(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, report.OK(), "ledger report: %+v", report)
+	})
+
+	t.Run("Update after a transfer", func(t *testing.T) {
+		store := newStore(t)
+		acc := newAccount("john@example.com", 100)
+		other := newAccount("jane@example.com", 0)
+		assert.NoError(t, store.CreateAccount(acc))
+		assert.NoError(t, store.CreateAccount(other))
+
+		// A transfer commits between loading the account and saving it; the
+		// stale balance must not undo it.
+		loaded, err := store.GetAccountByID(acc.ID)
+		assert.NoError(t, err)
+		assert.NoError(t, store.Transfer(context.Background(), acc.ID, other.ID, 40))
+		loaded.FirstName = "Johnny"
+		assert.NoError(t, store.UpdateAccount(loaded))
+		assert.NoError(t, store.UpdatePassword(context.Background(), loaded.ID, "new_password"))
+		assert.NoError(t, store.UpdateEmail(context.Background(), loaded.ID, "johnny@example.com"))
+
+		fetched, err := store.GetAccountByID(acc.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "Johnny", fetched.FirstName)
+		assert.Equal(t, int64(60), fetched.Balance)
+		fetched, err = store.GetAccountByID(other.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(40), fetched.Balance)
+
+		report, err := store.CheckLedger(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, report.OK(), "ledger report: %+v", report)
+
+		transactions, err := store.GetAccountTransactions(context.Background(), &TransactionQuery{AccountID: acc.ID, Limit: 10})
+		assert.NoError(t, err)
+		for _, tx := range transactions {
+			assert.NotEqual(t, EntryKindAdjustment, tx.Kind)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(t)
+		acc := newAccount("john@example.com", 0)
+		kept := newAccount("jane@example.com", 0)
+		assert.NoError(t, store.CreateAccount(acc))
+		assert.NoError(t, store.CreateAccount(kept))
+
+		// An account holding money cannot be deleted.
+		funded := newAccount("bob@example.com", 50)
+		assert.NoError(t, store.CreateAccount(funded))
+		assert.ErrorIs(t, store.DeleteAccount(funded.ID), ErrConflict)
+		assert.NoError(t, store.Transfer(context.Background(), funded.ID, kept.ID, 50))
+		assert.NoError(t, store.DeleteAccount(funded.ID))
+
+		assert.NoError(t, store.DeleteAccount(acc.ID))
+
+		_, err := store.GetAccountByID(acc.ID)
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = store.GetAccountByEmail(acc.Email)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		accounts, err := store.GetAccounts()
+		assert.NoError(t, err)
+		if assert.Len(t, accounts, 1) {
+			assert.Equal(t, kept.ID, accounts[0].ID)
+			assert.Equal(t, int64(50), accounts[0].Balance)
+		}
+	})
+
+	t.Run("Listing order", func(t *testing.T) {
+		store := newStore(t)
+
+		accounts, err := store.GetAccounts()
+		assert.NoError(t, err)
+		assert.NotNil(t, accounts)
+		assert.Empty(t, accounts)
+
+		ids := []int{}
+		for _, name := range []string{"carol", "alice", "bob"} {
+			acc := newAccount(name+"@example.com", 0)
+			acc.FirstName = name
+			assert.NoError(t, store.CreateAccount(acc))
+			ids = append(ids, acc.ID)
+		}
+		assert.IsIncreasing(t, ids)
+
+		accounts, err = store.GetAccounts()
+		assert.NoError(t, err)
+		listed := []int{}
+		for _, acc := range accounts {
+			listed = append(listed, acc.ID)
+		}
+		assert.Equal(t, ids, listed)
+
+		found, err := store.SearchAccounts("example.com")
+		assert.NoError(t, err)
+		listed = []int{}
+		for _, acc := range found {
+			listed = append(listed, acc.ID)
+		}
+		assert.Equal(t, ids, listed)
+	})
+
+	t.Run("Transfer", func(t *testing.T) {
+		store := newStore(t)
+		from := newAccount("bob@example.com", 100)
+		to := newAccount("carol@example.com", 0)
+		assert.NoError(t, store.CreateAccount(from))
+		assert.NoError(t, store.CreateAccount(to))
+
+		ctx := context.Background()
+		assert.ErrorIs(t, store.Transfer(ctx, from.ID, to.ID, 0), ErrValidation)
+		assert.ErrorIs(t, store.Transfer(ctx, from.ID, to.ID, -10), ErrValidation)
+		assert.ErrorIs(t, store.Transfer(ctx, from.ID, from.ID, 10), ErrValidation)
+		assert.ErrorIs(t, store.Transfer(ctx, from.ID, to.ID, 101), ErrInsufficientFunds)
+		assert.NoError(t, store.Transfer(ctx, from.ID, to.ID, 30))
+
+		fromAcc, err := store.GetAccountByID(from.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(70), fromAcc.Balance)
+		toAcc, err := store.GetAccountByID(to.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(30), toAcc.Balance)
+	})
+
+	t.Run("Concurrent transfers", func(t *testing.T) {
+		store := newStore(t)
+
+		// Ten transfers of 20 from a balance of 100: exactly five may succeed.
+		from := newAccount("bob@example.com", 100)
+		to := newAccount("carol@example.com", 0)
+		assert.NoError(t, store.CreateAccount(from))
+		assert.NoError(t, store.CreateAccount(to))
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		succeeded := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := store.Transfer(context.Background(), from.ID, to.ID, 20); err == nil {
+					mu.Lock()
+					succeeded++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 5, succeeded)
+
+		// Transfers in every direction between three accounts never create
+		// or lose money and never overdraw.
+		accounts := []*Account{from, to, newAccount("dave@example.com", 50)}
+		assert.NoError(t, store.CreateAccount(accounts[2]))
+
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				a, b := r.Intn(3), r.Intn(2)
+				if b >= a {
+					b++
+				}
+				store.Transfer(context.Background(), accounts[a].ID, accounts[b].ID, int64(r.Intn(40)+1))
+			}(int64(i))
+		}
+		wg.Wait()
+
+		var total int64
+		for _, acc := range accounts {
+			fetched, err := store.GetAccountByID(acc.ID)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			assert.GreaterOrEqual(t, fetched.Balance, int64(0))
+			total += fetched.Balance
+		}
+		assert.Equal(t, int64(150), total)
+
+		report, err := store.CheckLedger(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, report.OK(), "ledger report: %+v", report)
+	})
+
+	t.Run("Stale login counters are pruned", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		allow := func(*LoginThrottle) time.Duration { return 0 }
+		failures := func(email string, at time.Time) int {
+			var seen *LoginThrottle
+			_, _, err := store.ReserveLoginAttempt(ctx, email, at, at.Add(-time.Hour), func(t *LoginThrottle) time.Duration {
+				seen = t
+				return time.Second
+			})
+			assert.NoError(t, err)
+			return seen.Failures
+		}
+
+		for _, email := range []string{"idle@example.com", "locked@example.com"} {
+			_, _, err := store.ReserveLoginAttempt(ctx, email, now, now.Add(-time.Hour), allow)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, store.LockLogin(ctx, "locked@example.com", now.Add(3*time.Hour)))
+
+		later := now.Add(2 * time.Hour)
+		assert.Equal(t, 0, failures("idle@example.com", later))
+		assert.Equal(t, 1, failures("locked@example.com", later))
+	})
+
+	t.Run("Password reset requests", func(t *testing.T) {
+		store := newStore(t)
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		since := now.Add(-time.Hour)
+		request := func(email, ip string, allow func(byEmail, byIP int) bool) (bool, error) {
+			event := &LoginEvent{Email: email, IP: ip, Event: LoginEventResetRequested, CreatedAt: now}
+			return store.RecordPasswordResetRequest(context.Background(), event, since, allow)
+		}
+
+		// A burst for one email: exactly three requests may go through.
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := request("john@example.com", "192.0.2.1", func(byEmail, byIP int) bool { return byEmail < 3 })
+				assert.NoError(t, err)
+				if ok {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 3, allowed)
+
+		var counts [2]int
+		ok, err := request("jane@example.com", "192.0.2.1", func(byEmail, byIP int) bool {
+			counts = [2]int{byEmail, byIP}
+			return true
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, [2]int{0, 3}, counts, "only recorded requests count")
+	})
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return NewMemoryStore()
+	})
+}
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return newTestSQLiteStore(t)
+	})
+}
+
+// testPostgresStore connects to the database named by TEST_DATABASE_URL and
+// skips the test when it is not set. Tests drop every table of it, so it
+// must be a throwaway database and never the one from .env.
+func testPostgresStore(t *testing.T) *PostgresStore {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	pg, err := newPostgresStore(dbURL)
+	if err != nil {
+		t.Fatalf("Error connecting to the test database: %v", err)
+	}
+	t.Cleanup(func() { pg.db.Close() })
+	return pg
+}
+
+// TestPostgresStoreConformance drops every table of the test database before
+// each subtest.
+func TestPostgresStoreConformance(t *testing.T) {
+	pg := testPostgresStore(t)
+
+	testStorageConformance(t, func(t *testing.T) Storage {
+		if err := pg.DropTable(); err != nil {
+			t.Fatalf("Error dropping tables: %v", err)
+		}
+		if err := pg.Init(); err != nil {
+			t.Fatalf("Error initializing database: %v", err)
+		}
+		return pg
+	})
+}
@@ -1,33 +1,42 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"testing"
 	"time"
 	"fmt"
+	"sync"
 
-	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
-var testStore *PostgresStore
+// testStore is the Postgres database named by TEST_DATABASE_URL, or a
+// MemoryStore when it is not set, so that the tests also run without
+// Postgres. .env is never loaded: the tables are dropped at the end.
+var testStore Storage
+
+// testJWTSecret signs the tokens of all tests that do not load their own keys.
+const testJWTSecret = "test-secret-of-at-least-32-bytes"
 
 func TestMain(m *testing.M) {
 	// Set up
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-
-	testStore, err = NewPostgresStore()
-	if err != nil {
-		log.Fatalf("Error creating test store: %v", err)
-	}
+	jwtKeys = hmacKeySet(testJWTSecret)
+	testStore = NewMemoryStore()
+	if dbURL := os.Getenv("TEST_DATABASE_URL"); dbURL == "" {
+		log.Printf("TEST_DATABASE_URL is not set, running storage tests against MemoryStore")
+	} else {
+		store, err := newPostgresStore(dbURL)
+		if err != nil {
+			log.Fatalf("Error creating test store: %v", err)
+		}
 
-	if err := testStore.Init(); err != nil {
-		log.Fatalf("Error initializing test database: %v", err)
+		if err := store.Init(); err != nil {
+			log.Fatalf("Error initializing test database: %v", err)
+		}
+		testStore = store
 	}
 
 	// Run tests
@@ -100,11 +109,12 @@ func TestDeleteAccount(t *testing.T) {
 	err := testStore.CreateAccount(acc)
 	assert.NoError(t, err)
 
+	// An account holding money cannot be deleted.
 	err = testStore.DeleteAccount(acc.ID)
-	assert.NoError(t, err)
+	assert.ErrorIs(t, err, ErrConflict)
 
 	_, err = testStore.GetAccountByID(acc.ID)
-	assert.Error(t, err)
+	assert.NoError(t, err)
 }
 
 func TestUpdateAccount(t *testing.T) {
@@ -121,11 +131,504 @@ func TestUpdateAccount(t *testing.T) {
 	err := testStore.CreateAccount(acc)
 	assert.NoError(t, err)
 
+	// The balance only changes through the ledger.
 	acc.Balance = 3500
     err = testStore.UpdateAccount(acc)
     assert.NoError(t, err)
 
     updatedAcc, err := testStore.GetAccountByID(acc.ID)
     assert.NoError(t, err)
-    assert.Equal(t, int64(3500), updatedAcc.Balance)
+    assert.Equal(t, int64(3000), updatedAcc.Balance)
+}
+
+func TestTransfer(t *testing.T) {
+	from := &Account{
+		FirstName:         "Bob",
+		LastName:          "Sender",
+		Email:             "bob@example.com",
+		EncryptedPassword: "password",
+		Phone:             5550001111,
+		Balance:           100,
+		CreatedAt:         time.Now().UTC(),
+	}
+	to := &Account{
+		FirstName:         "Carol",
+		LastName:          "Receiver",
+		Email:             "carol@example.com",
+		EncryptedPassword: "password",
+		Phone:             5550002222,
+		Balance:           0,
+		CreatedAt:         time.Now().UTC(),
+	}
+	assert.NoError(t, testStore.CreateAccount(from))
+	assert.NoError(t, testStore.CreateAccount(to))
+
+	err := testStore.Transfer(context.Background(), from.ID, to.ID, 1000)
+	assert.Error(t, err)
+
+	// Ten concurrent transfers of 20 from a balance of 100: exactly five may succeed.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := testStore.Transfer(context.Background(), from.ID, to.ID, 20); err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 5, succeeded)
+
+	fromAcc, err := testStore.GetAccountByID(from.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), fromAcc.Balance)
+
+	toAcc, err := testStore.GetAccountByID(to.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), toAcc.Balance)
+}
+
+func TestLedger(t *testing.T) {
+	acc := &Account{
+		FirstName:         "Dave",
+		LastName:          "Ledger",
+		Email:             "dave@example.com",
+		EncryptedPassword: "password",
+		Phone:             5550003333,
+		Balance:           700,
+		CreatedAt:         time.Now().UTC(),
+	}
+	assert.NoError(t, testStore.CreateAccount(acc))
+
+	other := &Account{
+		FirstName:         "Erin",
+		LastName:          "Ledger",
+		Email:             "erin@example.com",
+		EncryptedPassword: "password",
+		Phone:             5550004444,
+		CreatedAt:         time.Now().UTC(),
+	}
+	assert.NoError(t, testStore.CreateAccount(other))
+
+	assert.NoError(t, testStore.Transfer(context.Background(), acc.ID, other.ID, 200))
+
+	acc.Balance = 600
+	assert.NoError(t, testStore.UpdateAccount(acc))
+
+	report, err := testStore.CheckLedger(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), "ledger report: %+v", report)
+
+	fetched, err := testStore.GetAccountByID(acc.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(500), fetched.Balance)
+}
+
+func TestGetAccountTransactions(t *testing.T) {
+	acc := &Account{
+		FirstName:         "Frank",
+		LastName:          "History",
+		Email:             "frank@example.com",
+		EncryptedPassword: "password",
+		Phone:             5550005555,
+		Balance:           300,
+		CreatedAt:         time.Now().UTC(),
+	}
+	assert.NoError(t, testStore.CreateAccount(acc))
+
+	other := &Account{
+		FirstName:         "Grace",
+		LastName:          "History",
+		Email:             "grace@example.com",
+		EncryptedPassword: "password",
+		Phone:             5550006666,
+		CreatedAt:         time.Now().UTC(),
+	}
+	assert.NoError(t, testStore.CreateAccount(other))
+
+	assert.NoError(t, testStore.Transfer(context.Background(), acc.ID, other.ID, 100))
+	assert.NoError(t, testStore.Transfer(context.Background(), other.ID, acc.ID, 40))
+
+	transactions, err := testStore.GetAccountTransactions(context.Background(), &TransactionQuery{AccountID: acc.ID, Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, transactions, 3)
+
+	assert.Equal(t, DirectionCredit, transactions[0].Direction)
+	assert.Equal(t, int64(40), transactions[0].Amount)
+	assert.Equal(t, other.ID, transactions[0].Counterparty)
+	assert.Equal(t, int64(240), transactions[0].BalanceAfter)
+
+	assert.Equal(t, DirectionDebit, transactions[1].Direction)
+	assert.Equal(t, int64(100), transactions[1].Amount)
+	assert.Equal(t, int64(200), transactions[1].BalanceAfter)
+
+	assert.Equal(t, EntryKindOpening, transactions[2].Kind)
+	assert.Equal(t, ExternalAccountID, transactions[2].Counterparty)
+
+	older, err := testStore.GetAccountTransactions(context.Background(), &TransactionQuery{AccountID: acc.ID, Before: transactions[0].ID, Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, older, 2)
+
+	future, err := testStore.GetAccountTransactions(context.Background(), &TransactionQuery{AccountID: acc.ID, From: time.Now().UTC().Add(time.Hour), Limit: 10})
+	assert.NoError(t, err)
+	assert.Empty(t, future)
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	rec := &IdempotencyRecord{
+		AccountID:   1,
+		Key:         "test-key",
+		Fingerprint: "fingerprint",
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(time.Hour),
+	}
+
+	existing, err := testStore.ReserveIdempotencyKey(ctx, rec)
+	assert.NoError(t, err)
+	assert.Nil(t, existing)
+
+	existing, err = testStore.ReserveIdempotencyKey(ctx, rec)
+	assert.NoError(t, err)
+	assert.NotNil(t, existing)
+	assert.Equal(t, 0, existing.StatusCode)
+
+	rec.StatusCode = 200
+	rec.Response = []byte(`{"ok":true}`)
+	assert.NoError(t, testStore.CompleteIdempotencyKey(ctx, rec))
+
+	existing, err = testStore.ReserveIdempotencyKey(ctx, rec)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, existing.StatusCode)
+	assert.Equal(t, rec.Response, existing.Response)
+
+	// An expired key can be claimed again.
+	later := &IdempotencyRecord{
+		AccountID:   1,
+		Key:         "test-key",
+		Fingerprint: "other",
+		CreatedAt:   now.Add(2 * time.Hour),
+		ExpiresAt:   now.Add(3 * time.Hour),
+	}
+	existing, err = testStore.ReserveIdempotencyKey(ctx, later)
+	assert.NoError(t, err)
+	assert.Nil(t, existing)
+
+	assert.NoError(t, testStore.ReleaseIdempotencyKey(ctx, 1, "test-key"))
+}
+
+func TestSearchAccounts(t *testing.T) {
+	acc := &Account{
+		FirstName:         "Heidi",
+		LastName:          "Searchable",
+		Email:             "heidi_search@example.com",
+		EncryptedPassword: "password",
+		Phone:             5550007777,
+		CreatedAt:         time.Now().UTC(),
+		Role:              RoleAdmin,
+	}
+	assert.NoError(t, testStore.CreateAccount(acc))
+
+	found, err := testStore.SearchAccounts("SEARCHABLE")
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+	assert.Equal(t, acc.ID, found[0].ID)
+	assert.Equal(t, RoleAdmin, found[0].Role)
+
+	found, err = testStore.SearchAccounts("%")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	ctx := context.Background()
+	acc := &Account{
+		FirstName:         "Ivan",
+		LastName:          "Tokens",
+		Email:             "ivan@example.com",
+		EncryptedPassword: "password",
+		Phone:             5550008888,
+		CreatedAt:         time.Now().UTC(),
+	}
+	assert.NoError(t, testStore.CreateAccount(acc))
+
+	now := time.Now().UTC()
+	first := &RefreshToken{AccountID: acc.ID, SessionID: "session-rotation", TokenHash: hashToken("first"), Scopes: []Permission{PermAccountsRead}, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.NoError(t, testStore.CreateRefreshToken(ctx, first))
+
+	second := &RefreshToken{TokenHash: hashToken("second"), CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	spent, err := testStore.RotateRefreshToken(ctx, hashToken("first"), second)
+	assert.NoError(t, err)
+	assert.Equal(t, acc.ID, spent.AccountID)
+	assert.Equal(t, "session-rotation", second.SessionID)
+	assert.Equal(t, []Permission{PermAccountsRead}, second.Scopes)
+
+	// Replaying the spent token revokes the whole session, including the
+	// token it was rotated into.
+	_, err = testStore.RotateRefreshToken(ctx, hashToken("first"), &RefreshToken{TokenHash: hashToken("third"), CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	assert.Error(t, err)
+
+	_, err = testStore.RotateRefreshToken(ctx, hashToken("second"), &RefreshToken{TokenHash: hashToken("fourth"), CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	assert.Error(t, err)
+}
+
+func TestRevokeTokens(t *testing.T) {
+	ctx := context.Background()
+	acc := &Account{
+		FirstName:         "Judy",
+		LastName:          "Tokens",
+		Email:             "judy@example.com",
+		EncryptedPassword: "password",
+		Phone:             5550009999,
+		CreatedAt:         time.Now().UTC(),
+	}
+	assert.NoError(t, testStore.CreateAccount(acc))
+
+	assert.NoError(t, testStore.RevokeToken(ctx, "revoked-jti", time.Now().UTC().Add(time.Hour)))
+	revoked, err := testStore.IsTokenRevoked(ctx, "revoked-jti")
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+
+	revoked, err = testStore.IsTokenRevoked(ctx, "live-jti")
+	assert.NoError(t, err)
+	assert.False(t, revoked)
+
+	assert.NoError(t, testStore.RevokeAllTokens(ctx, acc.ID))
+	fetched, err := testStore.GetAccountByID(acc.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetched.TokenVersion)
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	ctx := context.Background()
+	accountID := 4242
+
+	totp, err := testStore.GetTOTP(ctx, accountID)
+	assert.NoError(t, err)
+	assert.Nil(t, totp)
+
+	assert.NoError(t, testStore.SaveTOTP(ctx, &TOTP{AccountID: accountID, Secret: "JBSWY3DPEHPK3PXP", CreatedAt: time.Now().UTC()}))
+
+	totp, err = testStore.GetTOTP(ctx, accountID)
+	assert.NoError(t, err)
+	assert.False(t, totp.Enabled())
+
+	assert.NoError(t, testStore.ConfirmTOTP(ctx, accountID, 100, []string{hashRecoveryCode("aaaaa-bbbbb")}))
+
+	totp, err = testStore.GetTOTP(ctx, accountID)
+	assert.NoError(t, err)
+	assert.True(t, totp.Enabled())
+	assert.Equal(t, int64(100), totp.LastUsedStep)
+
+	// A confirmed enrollment cannot be overwritten.
+	assert.Error(t, testStore.SaveTOTP(ctx, &TOTP{AccountID: accountID, Secret: "OTHER", CreatedAt: time.Now().UTC()}))
+
+	ok, err := testStore.UseTOTPStep(ctx, accountID, 100)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = testStore.UseTOTPStep(ctx, accountID, 101)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = testStore.UseRecoveryCode(ctx, accountID, hashRecoveryCode("aaaaa-bbbbb"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = testStore.UseRecoveryCode(ctx, accountID, hashRecoveryCode("aaaaa-bbbbb"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, testStore.DeleteTOTP(ctx, accountID))
+	totp, err = testStore.GetTOTP(ctx, accountID)
+	assert.NoError(t, err)
+	assert.Nil(t, totp)
+}
+
+func TestLoginThrottle(t *testing.T) {
+	ctx := context.Background()
+	email := "throttle@example.com"
+	now := time.Now().UTC()
+	stale := now.Add(-time.Hour)
+	allow := func(*LoginThrottle) time.Duration { return 0 }
+
+	// peek reads the counter through a refused attempt.
+	peek := func() *LoginThrottle {
+		var seen *LoginThrottle
+		_, _, err := testStore.ReserveLoginAttempt(ctx, email, now, stale, func(t *LoginThrottle) time.Duration {
+			seen = t
+			return time.Second
+		})
+		assert.NoError(t, err)
+		return seen
+	}
+
+	assert.Equal(t, 0, peek().Failures)
+
+	for i := 1; i <= 3; i++ {
+		throttle, wait, err := testStore.ReserveLoginAttempt(ctx, email, now, stale, allow)
+		assert.NoError(t, err)
+		assert.Zero(t, wait)
+		assert.Equal(t, i, throttle.Failures)
+	}
+
+	throttle, wait, err := testStore.ReserveLoginAttempt(ctx, email, now, stale, func(*LoginThrottle) time.Duration { return time.Minute })
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, wait)
+	assert.Equal(t, 3, throttle.Failures, "a refused attempt is not counted")
+
+	assert.NoError(t, testStore.LockLogin(ctx, email, now.Add(time.Hour)))
+	assert.NotNil(t, peek().LockedUntil)
+
+	assert.NoError(t, testStore.ResetLoginThrottle(ctx, email))
+	throttle = peek()
+	assert.Equal(t, 0, throttle.Failures)
+	assert.Nil(t, throttle.LockedUntil)
+}
+
+func TestLoginEvents(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	events := []*LoginEvent{
+		{AccountID: 4444, Email: "events@example.com", IP: "192.0.2.10", Event: LoginEventFailed, CreatedAt: now},
+		{AccountID: 4444, Email: "events@example.com", IP: "192.0.2.10", Event: LoginEventSucceeded, CreatedAt: now},
+		{Email: "nobody@example.com", IP: "192.0.2.10", Event: LoginEventFailed, CreatedAt: now},
+	}
+	for _, e := range events {
+		assert.NoError(t, testStore.RecordLoginEvent(ctx, e))
+	}
+
+	fetched, err := testStore.GetLoginEvents(ctx, 4444, 10)
+	assert.NoError(t, err)
+	assert.Len(t, fetched, 2)
+	assert.Equal(t, LoginEventSucceeded, fetched[0].Event)
+
+	failures, err := testStore.CountLoginFailuresByIP(ctx, "192.0.2.10", now.Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, failures)
+}
+
+func TestPasswordResetTokens(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	first := &PasswordReset{AccountID: 4545, TokenHash: hashToken("first-reset"), CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.NoError(t, testStore.CreatePasswordReset(ctx, first))
+
+	second := &PasswordReset{AccountID: 4545, TokenHash: hashToken("second-reset"), CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.NoError(t, testStore.CreatePasswordReset(ctx, second))
+
+	// A newer email replaces the older link
+	_, err := testStore.ConsumePasswordReset(ctx, first.TokenHash, now)
+	assert.Error(t, err)
+
+	reset, err := testStore.ConsumePasswordReset(ctx, second.TokenHash, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 4545, reset.AccountID)
+	assert.NotNil(t, reset.UsedAt)
+
+	// Tokens are single-use
+	_, err = testStore.ConsumePasswordReset(ctx, second.TokenHash, now)
+	assert.Error(t, err)
+
+	expired := &PasswordReset{AccountID: 4546, TokenHash: hashToken("expired-reset"), CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)}
+	assert.NoError(t, testStore.CreatePasswordReset(ctx, expired))
+	_, err = testStore.ConsumePasswordReset(ctx, expired.TokenHash, now)
+	assert.Error(t, err)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	ctx := context.Background()
+
+	acc, err := GenerateNewAccount("Verify", "Me", "verify@example.com", "password123")
+	assert.NoError(t, err)
+	assert.NoError(t, testStore.CreateAccount(acc))
+
+	fetched, err := testStore.GetAccountByID(acc.ID)
+	assert.NoError(t, err)
+	assert.False(t, fetched.EmailVerified)
+
+	// A link for an address the account no longer has is rejected
+	assert.Error(t, testStore.VerifyEmail(ctx, acc.ID, "old@example.com"))
+
+	assert.NoError(t, testStore.VerifyEmail(ctx, acc.ID, "verify@example.com"))
+	fetched, err = testStore.GetAccountByID(acc.ID)
+	assert.NoError(t, err)
+	assert.True(t, fetched.EmailVerified)
+}
+
+func TestAPIKeyStorage(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	key := &APIKey{
+		AccountID:   4747,
+		Name:        "reporting",
+		Prefix:      "gmk_abcdefgh",
+		KeyHash:     hashToken("gmk_abcdefgh-secret"),
+		Permissions: []Permission{PermAccountsRead, PermTransfersWrite},
+		CreatedAt:   now,
+	}
+	assert.NoError(t, testStore.CreateAPIKey(ctx, key))
+	assert.NotZero(t, key.ID)
+
+	used, err := testStore.UseAPIKey(ctx, key.KeyHash, now)
+	assert.NoError(t, err)
+	assert.Equal(t, key.ID, used.ID)
+	assert.Equal(t, key.Permissions, used.Permissions)
+	assert.NotNil(t, used.LastUsedAt)
+
+	// Only the owner can revoke a key
+	assert.Error(t, testStore.RevokeAPIKey(ctx, 4748, key.ID))
+	assert.NoError(t, testStore.RevokeAPIKey(ctx, 4747, key.ID))
+
+	_, err = testStore.UseAPIKey(ctx, key.KeyHash, now)
+	assert.Error(t, err)
+
+	keys, err := testStore.GetAPIKeys(ctx, 4747)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.NotNil(t, keys[0].RevokedAt)
+}
+
+func TestSessionStorage(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	laptop := &Session{AccountID: 4848, SessionID: "session-laptop", UserAgent: "Laptop", IP: "192.0.2.1", CreatedAt: now, LastUsedAt: now}
+	phone := &Session{AccountID: 4848, SessionID: "session-phone", UserAgent: "Phone", IP: "192.0.2.2", CreatedAt: now, LastUsedAt: now}
+	assert.NoError(t, testStore.CreateSession(ctx, laptop))
+	assert.NoError(t, testStore.CreateSession(ctx, phone))
+	assert.NoError(t, testStore.CreateRefreshToken(ctx, &RefreshToken{AccountID: 4848, SessionID: "session-phone", TokenHash: hashToken("phone-refresh"), CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	assert.NoError(t, testStore.UseSession(ctx, "session-laptop", now.Add(time.Minute)))
+
+	sessions, err := testStore.GetSessions(ctx, 4848)
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, "session-laptop", sessions[0].SessionID)
+
+	// Only the owner can sign a session out
+	_, err = testStore.RevokeAccountSession(ctx, 4849, phone.ID)
+	assert.Error(t, err)
+
+	revoked, err := testStore.RevokeAccountSession(ctx, 4848, phone.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "session-phone", revoked.SessionID)
+
+	assert.Error(t, testStore.UseSession(ctx, "session-phone", now))
+	_, err = testStore.RotateRefreshToken(ctx, hashToken("phone-refresh"), &RefreshToken{TokenHash: hashToken("phone-refresh-2"), CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	assert.Error(t, err)
+
+	sessions, err = testStore.GetSessions(ctx, 4848)
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
 }
\ No newline at end of file
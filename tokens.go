@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+	refreshTokenCookie = "refresh_token"
+
+	// The typ claim separates access tokens from other JWTs we sign.
+	tokenTypeAccess = "access"
+)
+
+func accessTokenTTL() time.Duration {
+	return getEnvDuration("ACCESS_TOKEN_TTL", defaultAccessTokenTTL)
+}
+
+func refreshTokenTTL() time.Duration {
+	return getEnvDuration("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL)
+}
+
+// newRandomToken returns 32 random bytes, base64url encoded.
+func newRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how opaque tokens are stored, so that a database leak does
+// not hand out working credentials.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens starts a new session for acc, limited to the given scopes, and
+// sets the access and refresh token cookies.
+func (s *APIServer) issueTokens(w http.ResponseWriter, r *http.Request, acc *Account, scopes []Permission) (*TokenResponse, error) {
+	sessionID, err := newRandomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := newRandomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	err = s.store.CreateSession(r.Context(), &Session{
+		AccountID:  acc.ID,
+		SessionID:  sessionID,
+		UserAgent:  userAgent,
+		IP:         clientIP(r),
+		CreatedAt:  now,
+		LastUsedAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.CreateRefreshToken(r.Context(), &RefreshToken{
+		AccountID: acc.ID,
+		SessionID: sessionID,
+		TokenHash: hashToken(refreshToken),
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return writeTokens(w, acc, sessionID, refreshToken, scopes)
+}
+
+func writeTokens(w http.ResponseWriter, acc *Account, sessionID, refreshToken string, scopes []Permission) (*TokenResponse, error) {
+	if scopes == nil {
+		scopes = rolePermissions[acc.Role]
+	}
+
+	accessToken, err := createJWT(acc, sessionID, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	setTokenCookie(w, accessToken)
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    refreshToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // true if using HTTPS
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(refreshTokenTTL().Seconds()),
+	})
+	if err := setCSRFCookie(w); err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL().Seconds()),
+		Scope:        formatScope(scopes),
+	}, nil
+}
+
+func clearTokenCookies(w http.ResponseWriter) {
+	for _, name := range []string{"token", refreshTokenCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+			MaxAge:   -1,
+		})
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    "",
+		Path:     "/",
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   -1,
+	})
+}
+
+// handleRefreshToken exchanges a refresh token, from the request body or the
+// refresh_token cookie, for a new access token and a new refresh token.
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	var refreshReq RefreshRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &refreshReq); err != nil {
+			return err
+		}
+	}
+	if refreshReq.RefreshToken == "" {
+		if cookie, err := r.Cookie(refreshTokenCookie); err == nil {
+			if !validCSRF(r) {
+				csrfFailed(w)
+				return nil
+			}
+			refreshReq.RefreshToken = cookie.Value
+		}
+	}
+	if refreshReq.RefreshToken == "" {
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidToken, Error: "Invalid refresh token"})
+	}
+
+	refreshToken, err := newRandomToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	next := &RefreshToken{
+		TokenHash: hashToken(refreshToken),
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL()),
+	}
+
+	if _, err := s.store.RotateRefreshToken(r.Context(), hashToken(refreshReq.RefreshToken), next); err != nil {
+		log.Printf("Refresh token rejected: %v", err)
+		clearTokenCookies(w)
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidToken, Error: "Invalid refresh token"})
+	}
+
+	acc, err := s.store.GetAccountByID(next.AccountID)
+	if err != nil {
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidToken, Error: "Invalid refresh token"})
+	}
+
+	resp, err := writeTokens(w, acc, next.SessionID, refreshToken, next.Scopes)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleLogout ends the caller's session: its refresh tokens are revoked and
+// the current access token is put on the revocation list.
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+	if authCtx.SessionID == "" {
+		return WriteJSON(w, http.StatusBadRequest, APIError{Code: errCodeSessionRequired, Error: "Not logged in with a session"})
+	}
+
+	if err := s.store.RevokeSession(r.Context(), authCtx.SessionID); err != nil {
+		return err
+	}
+	if err := s.store.RevokeToken(r.Context(), authCtx.TokenID, authCtx.TokenExpiresAt); err != nil {
+		return err
+	}
+
+	clearTokenCookies(w)
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "Logout successful"})
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	totpIssuer = "Gomoni"
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of periods either side of now that are accepted
+	// to allow for clock drift.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	mfaChallengeTTL   = 5 * time.Minute
+	tokenTypeMFA      = "mfa"
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+func totpURI(secret, email string) string {
+	label := url.PathEscape(totpIssuer + ":" + email)
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// hotp implements RFC 4226 with HMAC-SHA1.
+func hotp(key []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// verifyTOTP checks code against the secret around time now and returns the
+// time step it matched. Steps at or before lastUsedStep are refused so that
+// a code cannot be used twice.
+func verifyTOTP(secret, code string, now time.Time, lastUsedStep int64) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, uint64(step), totpDigits)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateRecoveryCodes returns single-use codes such as "k3x9p-7qm2d" and
+// the hashes to store for them.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(base32NoPadding.EncodeToString(b))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(code)
+}
+
+// createMFAChallenge carries the scopes asked for at /login over to the
+// tokens issued by /login/2fa.
+func createMFAChallenge(account *Account, scopes []Permission) (string, error) {
+	return signJWT(jwt.MapClaims{
+		"id":    account.ID,
+		"typ":   tokenTypeMFA,
+		"scope": formatScope(scopes),
+		"exp":   time.Now().Add(mfaChallengeTTL).Unix(),
+	})
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code for the account. Each code only works once.
+func (s *APIServer) checkSecondFactor(r *http.Request, totp *TOTP, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		step, ok := verifyTOTP(totp.Secret, code, time.Now(), totp.LastUsedStep)
+		if !ok {
+			return false, nil
+		}
+		return s.store.UseTOTPStep(r.Context(), totp.AccountID, step)
+	}
+	if recoveryCode != "" {
+		return s.store.UseRecoveryCode(r.Context(), totp.AccountID, hashRecoveryCode(recoveryCode))
+	}
+	return false, nil
+}
+
+// handleLoginTOTP completes a login that /login answered with a challenge.
+func (s *APIServer) handleLoginTOTP(w http.ResponseWriter, r *http.Request) error {
+	var loginReq TOTPLoginRequest
+	if err := decodeJSON(r, &loginReq); err != nil {
+		return err
+	}
+
+	claims, err := parseJWT(loginReq.Challenge, tokenTypeMFA)
+	if err != nil {
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidChallenge, Error: "Invalid or expired challenge"})
+	}
+	accountID, _ := claims["id"].(float64)
+
+	acc, err := s.store.GetAccountByID(int(accountID))
+	if err != nil {
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidChallenge, Error: "Invalid or expired challenge"})
+	}
+
+	// Codes are guessable too, so they share the password's lockout.
+	throttle, retryAfter, err := s.reserveLoginAttempt(r, acc.Email)
+	if err != nil {
+		return err
+	}
+	if retryAfter > 0 {
+		s.recordLoginEvent(r, acc, acc.Email, LoginEventThrottled)
+		return tooManyAttempts(w, retryAfter)
+	}
+
+	totp, err := s.store.GetTOTP(r.Context(), acc.ID)
+	if err != nil {
+		return err
+	}
+	if totp == nil || !totp.Enabled() {
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidChallenge, Error: "Invalid or expired challenge"})
+	}
+
+	ok, err := s.checkSecondFactor(r, totp, loginReq.Code, loginReq.RecoveryCode)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := s.recordLoginFailure(r, acc, acc.Email, LoginEventMFAFailed, throttle); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidCode, Error: "Invalid code"})
+	}
+
+	if err := s.recordLoginSuccess(r, acc); err != nil {
+		return err
+	}
+
+	scope, _ := claims["scope"].(string)
+	scopes, err := parseScope(acc.Role, scope)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.issueTokens(w, r, acc, scopes)
+	if err != nil {
+		return err
+	}
+	resp.Message = "Login successful"
+
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleEnrollTOTP starts two-factor enrollment by generating a new secret.
+// It only takes effect once confirmed with a code from the authenticator.
+func (s *APIServer) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+
+	existing, err := s.store.GetTOTP(r.Context(), authCtx.AccountID)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Enabled() {
+		return conflictError("Two-factor authentication is already enabled")
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	totp := &TOTP{
+		AccountID: authCtx.AccountID,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.store.SaveTOTP(r.Context(), totp); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, &TOTPEnrollment{
+		Secret: secret,
+		URI:    totpURI(secret, authCtx.Email),
+	})
+}
+
+// handleConfirmTOTP enables two-factor authentication and returns the
+// recovery codes. They are only ever shown here.
+func (s *APIServer) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+
+	var confirmReq TOTPCodeRequest
+	if err := decodeJSON(r, &confirmReq); err != nil {
+		return err
+	}
+
+	totp, err := s.store.GetTOTP(r.Context(), authCtx.AccountID)
+	if err != nil {
+		return err
+	}
+	if totp == nil || totp.Enabled() {
+		return conflictError("no pending two-factor enrollment")
+	}
+
+	acc, err := s.store.GetAccountByID(authCtx.AccountID)
+	if err != nil {
+		return err
+	}
+
+	// A stolen session must not be able to guess codes either, so they
+	// share the login lockout.
+	throttle, retryAfter, err := s.reserveLoginAttempt(r, acc.Email)
+	if err != nil {
+		return err
+	}
+	if retryAfter > 0 {
+		s.recordLoginEvent(r, acc, acc.Email, LoginEventThrottled)
+		return tooManyAttempts(w, retryAfter)
+	}
+
+	step, ok := verifyTOTP(totp.Secret, confirmReq.Code, time.Now(), totp.LastUsedStep)
+	if !ok {
+		if err := s.recordLoginFailure(r, acc, acc.Email, LoginEventMFAFailed, throttle); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidCode, Error: "Invalid code"})
+	}
+	if err := s.store.ResetLoginThrottle(r.Context(), acc.Email); err != nil {
+		return err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.ConfirmTOTP(r.Context(), authCtx.AccountID, step, hashes); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, &RecoveryCodes{RecoveryCodes: codes})
+}
+
+// handleDisableTOTP turns two-factor authentication off. It requires a
+// current code or a recovery code.
+func (s *APIServer) handleDisableTOTP(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+
+	var disableReq TOTPCodeRequest
+	if err := decodeJSON(r, &disableReq); err != nil {
+		return err
+	}
+
+	totp, err := s.store.GetTOTP(r.Context(), authCtx.AccountID)
+	if err != nil {
+		return err
+	}
+	if totp == nil || !totp.Enabled() {
+		return conflictError("two-factor authentication is not enabled")
+	}
+
+	acc, err := s.store.GetAccountByID(authCtx.AccountID)
+	if err != nil {
+		return err
+	}
+
+	// Codes are checked against the login lockout, as in handleConfirmTOTP.
+	throttle, retryAfter, err := s.reserveLoginAttempt(r, acc.Email)
+	if err != nil {
+		return err
+	}
+	if retryAfter > 0 {
+		s.recordLoginEvent(r, acc, acc.Email, LoginEventThrottled)
+		return tooManyAttempts(w, retryAfter)
+	}
+
+	ok, err := s.checkSecondFactor(r, totp, disableReq.Code, disableReq.RecoveryCode)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := s.recordLoginFailure(r, acc, acc.Email, LoginEventMFAFailed, throttle); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusUnauthorized, APIError{Code: errCodeInvalidCode, Error: "Invalid code"})
+	}
+	if err := s.store.ResetLoginThrottle(r.Context(), acc.Email); err != nil {
+		return err
+	}
+
+	if err := s.store.DeleteTOTP(r.Context(), authCtx.AccountID); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "Two-factor authentication disabled"})
+}
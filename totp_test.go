@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHOTPVectors(t *testing.T) {
+	// Test vectors from RFC 6238, appendix B, truncated to six digits.
+	key := []byte("12345678901234567890")
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tc := range testCases {
+		step := totpStep(time.Unix(tc.unix, 0))
+		assert.Equal(t, tc.code, hotp(key, uint64(step), totpDigits))
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	assert.NoError(t, err)
+
+	key, _ := base32NoPadding.DecodeString(secret)
+	now := time.Now()
+	code := hotp(key, uint64(totpStep(now)), totpDigits)
+
+	step, ok := verifyTOTP(secret, code, now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, totpStep(now), step)
+
+	// A code from the previous period is accepted for clock drift.
+	_, ok = verifyTOTP(secret, code, now.Add(totpPeriod*time.Second), 0)
+	assert.True(t, ok)
+
+	// A code that was already used is refused.
+	_, ok = verifyTOTP(secret, code, now, step)
+	assert.False(t, ok)
+
+	_, ok = verifyTOTP(secret, "000000", now.Add(time.Hour), 0)
+	assert.False(t, ok)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	assert.NoError(t, err)
+	assert.Len(t, codes, recoveryCodeCount)
+	assert.Len(t, hashes, recoveryCodeCount)
+
+	assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, codes[0])
+	assert.Equal(t, hashes[0], hashRecoveryCode(codes[0]))
+	assert.Equal(t, hashes[0], hashRecoveryCode(" "+codes[0][:5]+codes[0][6:]))
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("JBSWY3DPEHPK3PXP", "john@example.com")
+	assert.Equal(t, "otpauth://totp/Gomoni:john@example.com?algorithm=SHA1&digits=6&issuer=Gomoni&period=30&secret=JBSWY3DPEHPK3PXP", uri)
+}
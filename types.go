@@ -1,16 +1,19 @@
 package main
 
 import (
-	"errors"
 	"math/rand"
+	"net/mail"
+	"strings"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
+	"unicode"
 )
 
 type LoginRequest struct {
 	Email             string `json:"email"`
 	EncryptedPassword string `json:"password"`
+	// Scope optionally narrows the tokens, e.g. "accounts:read" for a
+	// dashboard that must not move money.
+	Scope string `json:"scope,omitempty"`
 }
 
 type TransferRequest struct {
@@ -19,6 +22,13 @@ type TransferRequest struct {
 	Amount      int64 `json:"amount"`
 }
 
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleAdmin    Role = "admin"
+)
+
 type Account struct {
 	ID                int       `json:"id"`
 	FirstName         string    `json:"firstName"`
@@ -28,24 +38,380 @@ type Account struct {
 	EncryptedPassword string    `json:"-"`
 	Balance           int64     `json:"balance"`
 	CreatedAt         time.Time `json:"createdAt"`
+	Role              Role      `json:"role"`
+	EmailVerified     bool      `json:"emailVerified"`
+	// TokenVersion is embedded in every access token; bumping it revokes
+	// all tokens issued before.
+	TokenVersion int `json:"-"`
+}
+
+// ExternalAccountID is the ledger account for money entering or leaving the
+// bank, such as opening balances and manual adjustments. It has no row in the
+// account table.
+const ExternalAccountID = 0
+
+const (
+	EntryKindOpening    = "opening"
+	EntryKindTransfer   = "transfer"
+	EntryKindAdjustment = "adjustment"
+)
+
+type JournalEntry struct {
+	ID        int        `json:"id"`
+	Kind      string     `json:"kind"`
+	Postings  []*Posting `json:"postings"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// Posting is one side of a journal entry. A positive amount credits the
+// account and a negative amount debits it; the postings of an entry always
+// sum to zero.
+type Posting struct {
+	ID           int   `json:"id"`
+	EntryID      int   `json:"entryId"`
+	AccountID    int   `json:"accountId"`
+	Amount       int64 `json:"amount"`
+	BalanceAfter int64 `json:"balanceAfter"`
+}
+
+// AccountTransaction is a posting seen from the side of one account.
+// Counterparty is ExternalAccountID for opening balances and adjustments.
+type AccountTransaction struct {
+	ID           int       `json:"id"`
+	EntryID      int       `json:"entryId"`
+	Kind         string    `json:"kind"`
+	Direction    string    `json:"direction"`
+	Amount       int64     `json:"amount"`
+	Counterparty int       `json:"counterparty"`
+	BalanceAfter int64     `json:"balanceAfter"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+const (
+	DirectionDebit  = "debit"
+	DirectionCredit = "credit"
+)
+
+// TransactionQuery selects a page of an account's transactions, newest
+// first. Before is a transaction ID cursor; zero values leave a filter unset.
+type TransactionQuery struct {
+	AccountID int
+	Before    int
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+type TransactionPage struct {
+	Transactions []*AccountTransaction `json:"transactions"`
+	NextCursor   string                `json:"nextCursor,omitempty"`
+}
+
+type BalanceMismatch struct {
+	AccountID     int   `json:"accountId"`
+	Balance       int64 `json:"balance"`
+	LedgerBalance int64 `json:"ledgerBalance"`
+}
+
+type LedgerReport struct {
+	Mismatches        []*BalanceMismatch `json:"mismatches"`
+	UnbalancedEntries []int              `json:"unbalancedEntries"`
+}
+
+func (r *LedgerReport) OK() bool {
+	return len(r.Mismatches) == 0 && len(r.UnbalancedEntries) == 0
+}
+
+// RefreshToken is a long-lived credential exchanged at /token/refresh for a
+// new access token. Only a hash of the token is stored. Each refresh rotates
+// the token within its session.
+type RefreshToken struct {
+	ID        int
+	AccountID int
+	SessionID string
+	TokenHash string
+	Scopes    []Permission
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+// Session is a login as shown to its owner. SessionID is the sid claim of the
+// session's tokens; ID is the public handle used to sign it out.
+type Session struct {
+	ID         int        `json:"id"`
+	AccountID  int        `json:"-"`
+	SessionID  string     `json:"-"`
+	UserAgent  string     `json:"userAgent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt time.Time  `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"-"`
+	Current    bool       `json:"current"`
+}
+
+type TokenResponse struct {
+	Message      string `json:"message,omitempty"`
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int    `json:"expiresIn"`
+	Scope        string `json:"scope"`
+}
+
+// JWK is a public signing key as published at /.well-known/jwks.json.
+type JWK struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Alg     string `json:"alg"`
+	N       string `json:"n,omitempty"`
+	E       string `json:"e,omitempty"`
+	Curve   string `json:"crv,omitempty"`
+	X       string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// LoginChallenge is returned by /login instead of tokens when the account
+// has two-factor authentication enabled.
+type LoginChallenge struct {
+	MFARequired bool   `json:"mfaRequired"`
+	Challenge   string `json:"challenge"`
+}
+
+type TOTPLoginRequest struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// StepUpRequest re-confirms a logged-in caller with either their password or
+// a second factor.
+type StepUpRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type StepUpResponse struct {
+	StepUpToken string `json:"stepUpToken"`
+	ExpiresIn   int    `json:"expiresIn"`
+}
+
+// StepUpChallenge is returned with 403 when an action needs step-up
+// authentication first.
+type StepUpChallenge struct {
+	Code           string   `json:"code"`
+	Error          string   `json:"error"`
+	StepUpRequired bool     `json:"stepUpRequired"`
+	Methods        []string `json:"methods"`
+}
+
+type ChangeEmailRequest struct {
+	Email string `json:"email"`
+}
+
+type TOTPCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// TOTP is an account's RFC 6238 authenticator enrollment. It only protects
+// logins once ConfirmedAt is set. LastUsedStep stops a code from being
+// replayed within its validity window.
+type TOTP struct {
+	AccountID    int
+	Secret       string
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+func (t *TOTP) Enabled() bool {
+	return t.ConfirmedAt != nil
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// APIKey lets a server-to-server client act for an account with a subset of
+// the account's permissions. Only a hash of the key is stored; Prefix is kept
+// so that the owner can tell keys apart.
+type APIKey struct {
+	ID          int          `json:"id"`
+	AccountID   int          `json:"accountId"`
+	Name        string       `json:"name"`
+	Prefix      string       `json:"prefix"`
+	KeyHash     string       `json:"-"`
+	Permissions []Permission `json:"permissions"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	LastUsedAt  *time.Time   `json:"lastUsedAt"`
+	RevokedAt   *time.Time   `json:"revokedAt"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// CreatedAPIKey is the only response that contains the key itself.
+type CreatedAPIKey struct {
+	*APIKey
+	Key string `json:"key"`
+}
+
+// LoginThrottle tracks consecutive failed logins with an email address,
+// whether or not an account uses it.
+type LoginThrottle struct {
+	Email         string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// LoginEvent is an entry in an account's login audit trail. AccountID is
+// zero for attempts against unknown emails.
+type LoginEvent struct {
+	ID        int       `json:"id"`
+	AccountID int       `json:"accountId"`
+	Email     string    `json:"email"`
+	IP        string    `json:"ip"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// PasswordReset is a single-use token mailed by /password/forgot. Only a hash
+// of the token is stored.
+type PasswordReset struct {
+	ID        int
+	AccountID int
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// IdempotencyRecord remembers the response to a request made with an
+// Idempotency-Key. StatusCode is zero while the first request is in flight.
+type IdempotencyRecord struct {
+	AccountID   int
+	Key         string
+	Fingerprint string
+	StatusCode  int
+	Response    []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
 }
 
 type NewAccount struct {
-	FirstName         string `json:"firstName"`
-	LastName          string `json:"lastName"`
-	Email             string `json:"email"`
-	EncryptedPassword string `json:"-"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	Role      Role   `json:"role,omitempty"`
+}
+
+const (
+	maxNameLength     = 50
+	maxEmailLength    = 50
+	minPasswordLength = 8
+	// bcrypt ignores everything after the first 72 bytes. argon2id has no
+	// such limit, but bcrypt can still be selected with PASSWORD_HASH_ALGORITHM.
+	maxPasswordLength = 72
+)
+
+// Validate checks the fields of a new account before it is created. It trims
+// surrounding whitespace from the name and normalizes the email in place.
+func (a *NewAccount) Validate() error {
+	a.FirstName = strings.TrimSpace(a.FirstName)
+	a.LastName = strings.TrimSpace(a.LastName)
+	a.Email = normalizeEmail(a.Email)
+
+	if a.FirstName == "" || a.LastName == "" {
+		return validationError("first and last name are required")
+	}
+	if len(a.FirstName) > maxNameLength || len(a.LastName) > maxNameLength {
+		return validationError("names must be at most %d characters", maxNameLength)
+	}
+	if err := validateEmail(a.Email); err != nil {
+		return err
+	}
+	return validatePassword(a.Password)
+}
+
+// normalizeEmail trims and lowercases an email address. Emails are stored and
+// looked up in this form, so that A@x.com and a@x.com are the same account.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func validateEmail(email string) error {
+	if len(email) > maxEmailLength {
+		return validationError("email must be at most %d characters", maxEmailLength)
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return validationError("invalid email address")
+	}
+	return nil
+}
+
+// validatePassword requires at least minPasswordLength characters with at
+// least one letter and one digit.
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return validationError("password must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return validationError("password must be at most %d bytes", maxPasswordLength)
+	}
+
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return validationError("password must contain both letters and digits")
+	}
+	return nil
 }
 
 func GenerateNewAccount(firstname, lastname, email, password string) (*Account, error) {
 	if email == "" {
-		return nil, errors.New("email cannot be empty")
+		return nil, validationError("email cannot be empty")
 	}
 	if password == "" {
-		return nil, errors.New("password cannot be empty")
+		return nil, validationError("password cannot be empty")
 	}
 
-	enpw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	enpw, err := currentPasswordHasher().Hash(password)
 	if err != nil {
 		return nil, err
 	}
@@ -54,8 +420,9 @@ func GenerateNewAccount(firstname, lastname, email, password string) (*Account,
 		FirstName:         firstname,
 		LastName:          lastname,
 		Email:             email,
-		EncryptedPassword: string(enpw),
+		EncryptedPassword: enpw,
 		Phone:             int64(rand.Intn(1e5)),
 		CreatedAt:         time.Now().UTC(),
+		Role:              RoleCustomer,
 	}, nil
-} 
+}
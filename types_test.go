@@ -5,7 +5,6 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func TestGenerateNewAccount(t *testing.T) {
@@ -36,11 +35,13 @@ func TestGenerateNewAccount(t *testing.T) {
 				assert.Equal(t, tc.email, acc.Email)
 				assert.NotEmpty(t, acc.EncryptedPassword)
 				assert.NotZero(t, acc.Phone)
+				assert.Equal(t, RoleCustomer, acc.Role)
 				assert.WithinDuration(t, time.Now().UTC(), acc.CreatedAt, 2*time.Second)
 
 				// Verify password encryption
-				err = bcrypt.CompareHashAndPassword([]byte(acc.EncryptedPassword), []byte(tc.password))
+				ok, err := currentPasswordHasher().Verify(tc.password, acc.EncryptedPassword)
 				assert.NoError(t, err)
+				assert.True(t, ok)
 			}
 		})
 	}
@@ -63,7 +64,7 @@ func TestTransferRequest(t *testing.T) {
 	}
 
 	assert.Equal(t, 123, tr.ToAccount)
-	assert.Equal(t, 1000, tr.Amount)
+	assert.Equal(t, int64(1000), tr.Amount)
 }
 
 func TestAccount(t *testing.T) {
@@ -91,14 +92,71 @@ func TestAccount(t *testing.T) {
 
 func TestNewAccount(t *testing.T) {
 	na := NewAccount{
-		FirstName:         "Charlie",
-		LastName:          "Brown",
-		Email:             "charlie@peanuts.com",
-		EncryptedPassword: "snoopy",
+		FirstName: "Charlie",
+		LastName:  "Brown",
+		Email:     "charlie@peanuts.com",
+		Password:  "snoopy",
 	}
 
 	assert.Equal(t, "Charlie", na.FirstName)
 	assert.Equal(t, "Brown", na.LastName)
 	assert.Equal(t, "charlie@peanuts.com", na.Email)
-	assert.Equal(t, "snoopy", na.EncryptedPassword)
+	assert.Equal(t, "snoopy", na.Password)
+}
+
+func TestRolePermissions(t *testing.T) {
+	assert.True(t, RoleCustomer.Can(PermTransfersWrite))
+	assert.False(t, RoleCustomer.Can(PermAdmin))
+	assert.True(t, RoleAdmin.Can(PermAdmin))
+	assert.False(t, Role("auditor").Valid())
+	assert.False(t, Role("auditor").Can(PermAccountsRead))
+}
+
+func TestParseScope(t *testing.T) {
+	scopes, err := parseScope(RoleCustomer, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []Permission{PermAccountsRead, PermAccountsWrite, PermTransfersWrite}, scopes)
+
+	scopes, err = parseScope(RoleCustomer, " accounts:read  accounts:read ")
+	assert.NoError(t, err)
+	assert.Equal(t, []Permission{PermAccountsRead}, scopes)
+	assert.Equal(t, "accounts:read", formatScope(scopes))
+
+	_, err = parseScope(RoleCustomer, "accounts:read admin")
+	assert.Error(t, err)
+
+	_, err = parseScope(RoleAdmin, "accounts:delete")
+	assert.Error(t, err)
+
+	authCtx := &AuthContext{Role: RoleAdmin, Scopes: splitScope("accounts:read admin")}
+	assert.True(t, authCtx.Can(PermAdmin))
+	assert.False(t, authCtx.Can(PermTransfersWrite))
+	assert.Nil(t, splitScope(""))
+}
+
+func TestValidateNewAccount(t *testing.T) {
+	testCases := []struct {
+		name    string
+		account NewAccount
+		valid   bool
+	}{
+		{"Valid account", NewAccount{FirstName: "Ann", LastName: "Lee", Email: "ann@example.com", Password: "password1"}, true},
+		{"Missing name", NewAccount{FirstName: " ", LastName: "Lee", Email: "ann@example.com", Password: "password1"}, false},
+		{"Invalid email", NewAccount{FirstName: "Ann", LastName: "Lee", Email: "ann.example.com", Password: "password1"}, false},
+		{"Email with display name", NewAccount{FirstName: "Ann", LastName: "Lee", Email: "Ann <ann@example.com>", Password: "password1"}, false},
+		{"Email without domain dot", NewAccount{FirstName: "Ann", LastName: "Lee", Email: "ann@localhost", Password: "password1"}, false},
+		{"Short password", NewAccount{FirstName: "Ann", LastName: "Lee", Email: "ann@example.com", Password: "pass1"}, false},
+		{"Password without digits", NewAccount{FirstName: "Ann", LastName: "Lee", Email: "ann@example.com", Password: "passwordonly"}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.account.Validate()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
 }
\ No newline at end of file
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultEmailVerificationTTL = 72 * time.Hour
+
+	tokenTypeVerifyEmail = "verify_email"
+)
+
+// createVerificationToken signs a link token for the account's current email
+// address, so a link mailed before an email change cannot verify the new one.
+func createVerificationToken(account *Account, ttl time.Duration) (string, error) {
+	return signJWT(jwt.MapClaims{
+		"id":    account.ID,
+		"email": account.Email,
+		"typ":   tokenTypeVerifyEmail,
+		"exp":   time.Now().Add(ttl).Unix(),
+	})
+}
+
+// sendVerificationEmail mails a verification link to a new account. Errors
+// are only logged: the customer can ask for another link later.
+func (s *APIServer) sendVerificationEmail(r *http.Request, account *Account) {
+	ttl := getEnvDuration("EMAIL_VERIFICATION_TTL", defaultEmailVerificationTTL)
+	token, err := createVerificationToken(account, ttl)
+	if err != nil {
+		log.Printf("Error creating verification token for account %d: %v", account.ID, err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", appBaseURL(), url.QueryEscape(token))
+	msg := &Message{
+		To:      account.Email,
+		Subject: "Confirm your gomoni email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link within %s:\n\n%s\n\n"+
+			"Until then you can log in, but not send money.\n",
+			account.FirstName, ttl, link),
+	}
+	if err := s.mailer.Send(r.Context(), msg); err != nil {
+		log.Printf("Error sending verification email to account %d: %v", account.ID, err)
+	}
+}
+
+func (s *APIServer) handleVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	invalid := APIError{Code: errCodeInvalidLink, Error: "Invalid or expired verification link"}
+
+	claims, err := parseJWT(r.URL.Query().Get("token"), tokenTypeVerifyEmail)
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, invalid)
+	}
+
+	accountID, ok := claims["id"].(float64)
+	if !ok {
+		return WriteJSON(w, http.StatusBadRequest, invalid)
+	}
+	email, ok := claims["email"].(string)
+	if !ok {
+		return WriteJSON(w, http.StatusBadRequest, invalid)
+	}
+
+	if err := s.store.VerifyEmail(r.Context(), int(accountID), email); err != nil {
+		log.Printf("Email verification rejected: %v", err)
+		return WriteJSON(w, http.StatusBadRequest, invalid)
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "Email verified"})
+}
+
+// handleResendVerification mails a new verification link to the caller.
+func (s *APIServer) handleResendVerification(w http.ResponseWriter, r *http.Request) error {
+	authCtx, _ := GetAuthContext(r.Context())
+
+	account, err := s.store.GetAccountByID(authCtx.AccountID)
+	if err != nil {
+		return err
+	}
+	if account.EmailVerified {
+		return conflictError("Email is already verified")
+	}
+
+	s.sendVerificationEmail(r, account)
+
+	return WriteJSON(w, http.StatusAccepted, struct {
+		Message string `json:"message"`
+	}{Message: "Verification email sent"})
+}